@@ -2,12 +2,20 @@ package ogdl
 
 import (
 	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math"
+	"math/rand"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // path.go
@@ -73,6 +81,52 @@ func TestFlowSyntaxInPath(t *testing.T) {
 	}
 }
 
+func TestPathString(t *testing.T) {
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"a.b.c", "a.b.c"},
+		{"a.b[ 2 ].c{ 1 }", "a.b[2].c{1}"},
+		{"a{}", "a{}"},
+		{"a#", "a#"},
+		{"a?.b", "a?.b"},
+		{"'a.b'.c", `"a.b".c`},
+		{"x.'y z'", `x."y z"`},
+		{`x.'y"z'`, `x.'y"z'`},
+		{"a[ i + 1 ]", "a[i+1]"},
+		{"a[1,2]", "a[1, 2]"},
+		{"a['k']", `a["k"]`},
+		{"f( b,1 )", "f(b, 1)"},
+		{"a.(b)", "a.(b)"},
+		{"a[(i+1)*2]", "a[(i+1)*2]"},
+		{"f( (1+2) * 3, a+b )", "f((1+2)*3, a+b)"},
+		{"a[i*(j-1)]", "a[i*(j-1)]"},
+		{"a.b[ ?c > 1 ].d", "a.b[?c>1].d"},
+		{"*[?name=='x']", `*[?name=="x"]`},
+	}
+
+	for _, test := range tests {
+		s := NewPath(test.path).PathString()
+		if s != test.want {
+			t.Errorf("%s: got %s, want %s", test.path, s, test.want)
+		}
+		if !NewPath(s).Equals(NewPath(test.path)) {
+			t.Errorf("%s: %s does not parse to the same path", test.path, s)
+		}
+	}
+
+	if s := NewPath("a/b.c", '/').PathString(); s != `a."b.c"` {
+		t.Error("PathString with another separator:", s)
+	}
+
+	var g *Graph
+	if g.PathString() != "" {
+		t.Error("PathString of nil graph should be empty")
+	}
+}
+
 // binary.go
 
 func TestBinParser1(t *testing.T) {
@@ -228,6 +282,156 @@ func TestBinParser4(t *testing.T) {
 	}
 }
 
+func TestMarshalBinary(t *testing.T) {
+
+	g := New()
+	a := g.Add("a")
+	a.Add(int64(-42))
+	a.Add(3.5)
+	a.Add(true)
+	a.Add(false)
+	a.Add([]byte{0, 1, 2})
+	a.Add("text with\nnewline and \x00 zero")
+	a.Add("")
+	g.Add(nil).Add("under a nil node")
+	g.Add(int64(1 << 40)).Add(math.Inf(-1))
+
+	b, err := g.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g2 := New("old content")
+	g2.Add("old subnode")
+	if err = g2.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if !g2.Equals(g) {
+		t.Error("MarshalBinary round trip\n" + g2.Show())
+	}
+	if _, ok := g2.Get("a").Out[0].This.(int64); !ok {
+		t.Error("MarshalBinary should keep int64 values")
+	}
+	if _, ok := g2.Get("a").Out[1].This.(float64); !ok {
+		t.Error("MarshalBinary should keep float64 values")
+	}
+	if _, ok := g2.Get("a").Out[4].This.([]byte); !ok {
+		t.Error("MarshalBinary should keep []byte values")
+	}
+
+	// Other types are converted
+	g = New()
+	g.Add(int32(7))
+	g.Add(float32(0.5))
+	g.Add(struct{ A int }{1})
+	b, _ = g.MarshalBinary()
+	g2 = New()
+	g2.UnmarshalBinary(b)
+	if g2.Out[0].This != int64(7) || g2.Out[1].This != 0.5 || g2.Out[2].This != "{1}" {
+		t.Error("MarshalBinary conversions", g2.Out[0].This, g2.Out[1].This, g2.Out[2].This)
+	}
+
+	// Errors
+	b, _ = FromString("a b c").MarshalBinary()
+	for i := 0; i < len(b); i++ {
+		if err := New().UnmarshalBinary(b[:i]); err == nil {
+			t.Error("UnmarshalBinary of truncated data should fail", i)
+		}
+	}
+	if err := New().UnmarshalBinary(append(b, 0)); err == nil {
+		t.Error("UnmarshalBinary with trailing data should fail")
+	}
+	if err := New().UnmarshalBinary([]byte{2, 'G', 0, 99, 0}); err == nil || !strings.Contains(err.Error(), "unknown type") {
+		t.Error("UnmarshalBinary of an unknown type", err)
+	}
+	if err := New().UnmarshalBinary(FromString("a").Binary()); err == nil {
+		t.Error("UnmarshalBinary of binary OGDL should fail")
+	}
+}
+
+func TestMarshalBinaryRandom(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(1))
+
+	var tree func(depth int) *Graph
+	tree = func(depth int) *Graph {
+		var g *Graph
+		switch rnd.Intn(6) {
+		case 0:
+			g = New()
+		case 1:
+			g = New(fmt.Sprint("s", rnd.Intn(100)))
+		case 2:
+			g = New(rnd.Int63() - rnd.Int63())
+		case 3:
+			g = New(rnd.NormFloat64())
+		case 4:
+			g = New(rnd.Intn(2) == 0)
+		case 5:
+			b := make([]byte, rnd.Intn(10))
+			rnd.Read(b)
+			g = New(b)
+		}
+		if depth > 0 {
+			for i := rnd.Intn(5); i > 0; i-- {
+				g.Add(tree(depth - 1))
+			}
+		}
+		return g
+	}
+
+	for i := 0; i < 100; i++ {
+		g := tree(5)
+		b, err := g.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		g2 := New()
+		if err = g2.UnmarshalBinary(b); err != nil || !g2.Equals(g) {
+			t.Fatal("MarshalBinary round trip of a random tree", err, "\n"+g.Show())
+		}
+	}
+}
+
+func TestGob(t *testing.T) {
+
+	type message struct {
+		Name  string
+		Graph *Graph
+	}
+
+	g := FromString("a\n  b 1\nc")
+	g.Get("a").Add(int64(2))
+	g.Get("a").Add(2.5)
+	g.Get("a").Add(true)
+	g.Get("a").Add([]byte("x"))
+	g.Add(nil)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(message{"m", g}); err != nil {
+		t.Fatal(err)
+	}
+
+	var m message
+	if err := gob.NewDecoder(&buf).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Name != "m" || !m.Graph.Equals(g) {
+		t.Error("gob round trip\n" + m.Graph.Show())
+	}
+	if m.Graph.Get("a").Out[1].This != int64(2) {
+		t.Error("gob should keep int64 values")
+	}
+
+	// An unknown type gives an error, not a panic
+	err := New().GobDecode([]byte{2, 'G', 0, 42, 0})
+	if err == nil || !strings.Contains(err.Error(), "unknown type") {
+		t.Error("GobDecode of an unknown type", err)
+	}
+}
+
 // parser.go
 
 func TestBehavior_Parser(t *testing.T) {
@@ -344,7 +548,7 @@ func TestParseBlock1(t *testing.T) {
 	p.String()
 	p.Space()
 	p.ev.Inc()
-	s, ok := p.Block()
+	s, ok := p.Block(0)
 	if !ok || s != "b\nc" {
 		t.Error("block")
 	}
@@ -360,14 +564,95 @@ func TestParseBlock2(t *testing.T) {
 func TestBlockPrint(t *testing.T) {
 	g := FromString("a \\\n  b\n  c")
 
-	// Blocks are currently printed back as quoted strings
-	if g.Text() != "a\n \"b\n  c\"" {
+	// Multiline leaves are printed back as blocks
+	if g.Text() != "a\n  \\\n    b\n    c" {
 		t.Error("block print\n", g.Text())
 	}
 }
 
+func TestTextBlock(t *testing.T) {
+
+	// Leaves: printed as blocks when possible
+	for _, v := range []string{"l1\nl2", "l1\n  l2\n\nl4", "\nx", "a b\n  (c)", "x\n", " x\ny", "x\r\ny"} {
+		g := New()
+		g.Add("a").Add("b").Add(v)
+		g.Add("c")
+
+		s := g.Text()
+		block := strings.Contains(s, "\\\n")
+		if block != isBlock(v) {
+			t.Errorf("%q: block is %v:\n%s", v, block, s)
+		}
+
+		if v2 := FromString(s).Get("a.b").Out[0].ThisString(); v2 != v {
+			t.Errorf("%q: read back as %q:\n%s", v, v2, s)
+		}
+		if FromString(s).Get("c") == nil {
+			t.Errorf("%q: nodes after the block lost:\n%s", v, s)
+		}
+	}
+
+	if s := FromString("a\n  \"l1\n   l2\"").Text(); s != "a\n  \\\n    l1\n    l2" {
+		t.Error("multiline leaf:\n" + s)
+	}
+
+	// Non-leaves: quoted
+	g := New()
+	g.Add("a").Add("l1\nl2").Add("b")
+	s := g.Text()
+	if s != "a\n \"l1\n  l2\"\n    b" {
+		t.Error("multiline non-leaf:\n" + s)
+	}
+	if !FromString(s).Equals(g) {
+		t.Error("multiline non-leaf does not parse back:\n" + s)
+	}
+}
+
 // Comments
 
+func TestTextComments(t *testing.T) {
+
+	src := "# header\na\n  b 1 # trailing\n  # inner\n  c 2\n"
+	opts := ParserOptions{Comments: true}
+
+	g := FromStringWith(src, opts)
+	if g.Node(TypeComment) == nil || g.Node(TypeComment).String() != " header" {
+		t.Error("comments not kept:\n" + g.Show())
+	}
+
+	want := "# header\na\n  b\n    1\n      # trailing\n  # inner\n  c\n    2"
+	s := g.Text()
+	if s != want {
+		t.Error("comments emitted:\n" + s)
+	}
+	if g2 := FromStringWith(s, opts); !g2.Equals(g) {
+		t.Error("comments do not parse back:\n" + g2.Show())
+	}
+
+	if s := g.MarshalOGDL(EmitOptions{StripComments: true}); s != "a\n  b\n    1\n  c\n    2" {
+		t.Error("comments not stripped:\n" + s)
+	}
+	if !FromString(src).Equals(FromString(g.Text())) {
+		t.Error("comments are not ignored by default")
+	}
+
+	// Strings starting with # are not comments
+	g = New()
+	g.Add("a").Add("#b").Add("#c d")
+	s = g.Text()
+	if s != "a\n \"#b\"\n   \"#c d\"" || !FromString(s).Equals(g) {
+		t.Error("strings starting with #:\n" + s)
+	}
+
+	g = New()
+	g.Add("#x")
+	g.Add("#y z").Add("1")
+	s = g.Text()
+	if s != "\"#x\"\n\"#y z\"\n  1" || !FromString(s).Equals(g) {
+		t.Error("top level strings starting with #:\n" + s)
+	}
+}
+
 func TestComment(t *testing.T) {
 
 	g := FromString("#comment")
@@ -421,6 +706,98 @@ func TestUnread(t *testing.T) {
 	}
 }
 
+func TestRawQuotes(t *testing.T) {
+
+	g := New()
+	g.Add("a").Add(`say "hi", it's`)
+
+	s := g.MarshalOGDL(EmitOptions{RawQuotes: true})
+	if s != "a\n `say \"hi\", it's`" {
+		t.Error("RawQuotes emitter\n", s)
+	}
+
+	g2 := FromStringWith(s, ParserOptions{RawQuotes: true})
+	if !g.Equals(g2) {
+		t.Error("RawQuotes round trip\n", g2.Show())
+	}
+
+	// No escapes in raw strings
+	g = FromStringWith("a `x\\\"y`", ParserOptions{RawQuotes: true})
+	if g.Get("a").String() != "x\\\"y" {
+		t.Error("raw string", g.Get("a").String())
+	}
+
+	// Without the option, backticks are normal characters
+	g = FromString("a `x`")
+	if g.Get("a").String() != "`x`" {
+		t.Error("backtick without RawQuotes", g.Get("a").String())
+	}
+
+	// Default emitter behavior is unchanged
+	g = New()
+	g.Add("a").Add(`say "hi", it's`)
+	if g.Text() != "a\n \"say \\\"hi\\\", it's\"" {
+		t.Error("default quoting\n", g.Text())
+	}
+}
+
+func TestNullMarker(t *testing.T) {
+
+	g := FromStringWith("a ~\nb 1\nc '~'", ParserOptions{Null: "~"})
+
+	a := g.Get("a")
+	if a == nil || a.Len() != 1 || !a.Out[0].IsNil() {
+		t.Error("explicit null not parsed as nil\n", g.Show())
+	}
+	if g.Get("c").String() != "~" {
+		t.Error("quoted null marker should be a string")
+	}
+	if g.Get("x") != nil {
+		t.Error("missing key")
+	}
+
+	s := g.MarshalOGDL(EmitOptions{Null: "~"})
+	if s != "a\n  ~\nb\n  1\nc\n \"~\"" {
+		t.Error("null emitter\n", s)
+	}
+
+	g2 := FromStringWith("a ~\nb 1", ParserOptions{Null: "~"})
+	s = g2.MarshalOGDL(EmitOptions{Null: "~"})
+	g3 := FromStringWith(s, ParserOptions{Null: "~"})
+	if !g2.Equals(g3) || !g3.Get("a").Out[0].IsNil() {
+		t.Error("null round trip\n", g3.Show())
+	}
+
+	// Without the option it is a normal string
+	g = FromString("a null")
+	if g.Get("a").String() != "null" {
+		t.Error("null without option")
+	}
+}
+
+func TestParserTabWidth(t *testing.T) {
+
+	s := "a\n\tb\n        c\n    d"
+
+	// Default: a tab is 8 spaces wide, so b and c are at the same level.
+	g := FromString(s)
+	if g.Text() != "a\n  b\n  c\n  d" {
+		t.Error("tab width 8\n", g.Text())
+	}
+
+	// A tab is 4 spaces wide: c (8 spaces) is under b, and d at b's level.
+	g = FromStringWith(s, ParserOptions{TabWidth: 4})
+	if g.Text() != "a\n  b\n    c\n  d" {
+		t.Error("tab width 4\n", g.Text())
+	}
+
+	// Tab after spaces: advances to the next tab stop
+	g = FromStringWith("a\n  b\n  \tc\n    d", ParserOptions{TabWidth: 4})
+	if g.Text() != "a\n  b\n    c\n    d" {
+		t.Error("space and tab\n", g.Text())
+	}
+}
+
 // chars.go
 // Character classes. Samples.
 
@@ -646,6 +1023,28 @@ func TestCopyAndSubstitute(t *testing.T) {
 	}
 }
 
+func TestSubstituteAt(t *testing.T) {
+
+	g := FromString("dev\n  host $HOST\n  port $PORT\nprod\n  host $HOST")
+
+	g.SubstituteAt("dev", "$HOST", "localhost")
+	if g.Get("dev.host").String() != "localhost" || g.Get("prod.host").String() != "$HOST" {
+		t.Error("SubstituteAt\n" + g.Text())
+	}
+
+	g.SubstituteAt("prod.host", "$HOST", "example.com")
+	if g.Get("prod.host").String() != "example.com" || g.Get("dev.port").String() != "$PORT" {
+		t.Error("SubstituteAt with a longer path\n" + g.Text())
+	}
+
+	// A path that is not found does nothing
+	text := g.Text()
+	g.SubstituteAt("test", "$PORT", "80")
+	if g.Text() != text {
+		t.Error("SubstituteAt with a missing path\n" + g.Text())
+	}
+}
+
 func TestGetChaining(t *testing.T) {
 
 	g := FromString("a b c")
@@ -764,6 +1163,96 @@ func TestDepth(t *testing.T) {
 	}
 }
 
+func TestDepthCycles(t *testing.T) {
+
+	// a -> b -> c -> a
+	a := New("a")
+	b := a.Add("b")
+	c := b.Add("c")
+	c.Add(a)
+
+	if d := a.Depth(); d != -1 {
+		t.Error("Depth of a cyclic graph", d)
+	}
+
+	// A node pointing to itself
+	g := New("x")
+	g.Add(g)
+	if d := g.Depth(); d != -1 {
+		t.Error("Depth of a self reference", d)
+	}
+
+	// A shared node is not a cycle
+	g = New()
+	s := New("s")
+	s.Add("leaf")
+	g.Add("p").Add(s)
+	g.Add("q").Add(s)
+	if d := g.Depth(); d != 3 {
+		t.Error("Depth with a shared node", d)
+	}
+
+	// Deep, but a tree
+	g = New()
+	n := g
+	for i := 0; i < 500; i++ {
+		n = n.Add(i)
+	}
+	if d := g.Depth(); d != 500 {
+		t.Error("Depth of a 500 levels deep graph", d)
+	}
+}
+
+func TestAddf(t *testing.T) {
+
+	g := New()
+	n := g.Addf("host%d", 3)
+	n.Addf("%s:%d", "localhost", 8080)
+
+	if n != g.Out[0] || g.Get("host3").String() != "localhost:8080" {
+		t.Error("Addf", g.Show())
+	}
+
+	if _, ok := n.Out[0].This.(string); !ok || n.Out[0].Len() != 0 {
+		t.Error("Addf should add a string leaf", _typeOf(n.Out[0].This))
+	}
+}
+
+func TestInsertAt(t *testing.T) {
+
+	g := New()
+	g.Add("b")
+	g.Add("d")
+
+	if n := g.InsertAt(0, "a"); n == nil || n.ThisString() != "a" {
+		t.Error("InsertAt should return the node inserted")
+	}
+	g.InsertAt(2, "c")
+	g.InsertAt(4, "e")
+
+	if s := strings.Join(g.Keys(), ","); s != "a,b,c,d,e" {
+		t.Error("InsertAt at front, middle and end:", s)
+	}
+
+	// Out of range: clamped
+	g.InsertAt(-5, "0")
+	g.InsertAt(100, "f")
+	if s := strings.Join(g.Keys(), ","); s != "0,a,b,c,d,e,f" {
+		t.Error("InsertAt out of range:", s)
+	}
+
+	// A Graph is inserted as is
+	h := FromString("x y")
+	if g.InsertAt(1, h.Out[0]) != h.Out[0] || g.Get("x").String() != "y" {
+		t.Error("InsertAt of a Graph:\n" + g.Text())
+	}
+
+	var nilg *Graph
+	if nilg.InsertAt(0, "a") != nil {
+		t.Error("InsertAt on nil graph")
+	}
+}
+
 func TestAddChaining(t *testing.T) {
 
 	g := FromString("a")
@@ -841,848 +1330,4106 @@ func TestGraph_Delete(t *testing.T) {
 	}
 }
 
-// eval.go
+func TestGetCount(t *testing.T) {
 
-func TestEvalCalcMod(t *testing.T) {
+	g := FromString("a\n b 1\n b 2\n c 3\n b 4")
 
-	i := calc(11.0, 2.0, '%')
+	if i := g.Get("a.b#").Int64(); i != 3 {
+		t.Error("a.b#", i)
+	}
 
-	s := reflect.TypeOf(i).String()
+	// _len counts all subnodes, # only those equal to the last element
+	if i := g.Get("a._len").Int64(); i != 4 {
+		t.Error("a._len", i)
+	}
+
+	if i := g.Get("a.c#").Int64(); i != 1 {
+		t.Error("a.c#", i)
+	}
 
-	// % operates on ints!
-	if s != "int" || i != 1 {
-		t.Error("Calc %")
+	if i := g.Get("a#").Int64(); i != 1 {
+		t.Error("a#", i)
+	}
+
+	if g.Get("a.x#") != nil {
+		t.Error("a.x# should be nil")
 	}
 }
 
-func TestEvalCalcStr(t *testing.T) {
+func TestClone(t *testing.T) {
 
-	i := calc("11.0-", 2.0, '+')
+	type point struct{ X, Y int }
 
-	s := reflect.TypeOf(i).String()
+	p := &point{1, 2}
 
-	if s != "string" || i != "11.0-2" {
-		t.Error("string with numbers")
+	g := New("root")
+	g.Add("a").Add("1")
+	g.Add("b").Add(point{3, 4})
+	g.Add("c").Add(p)
+
+	c := g.Clone()
+
+	if !c.Equals(g) {
+		t.Error("clone differs from original\n", c.Show())
 	}
-}
 
-func TestCompare(t *testing.T) {
+	// Value types are copied
+	c.Get("a").Out[0].This = "x"
+	c.Get("b").Out[0].This = point{5, 6}
+	c.Get("a").Add("2")
 
-	b := compare(1, 1, '=')
-	if !b {
-		t.Error("compare =")
+	if g.Get("a").String() != "1" || g.Get("a").Len() != 1 {
+		t.Error("modifying a cloned leaf changed the original", g.Get("a").Text())
 	}
-	b = compare(1, 1.0, '=')
-	if !b {
-		t.Error("compare =")
+	if g.Get("b").Out[0].This != (point{3, 4}) {
+		t.Error("modifying a cloned struct value changed the original")
 	}
-	b = compare(1.0, 1.0, '=')
-	if !b {
-		t.Error("compare =")
+
+	// Pointers are shared
+	c.Get("c").Out[0].This.(*point).X = 10
+	if p.X != 10 || g.Get("c").Out[0].This != p {
+		t.Error("pointer values should be shared by the clone")
 	}
 
-	b = compare(1, 2, '<')
-	if !b {
-		t.Error("compare 3")
+	var nilGraph *Graph
+	if nilGraph.Clone() != nil {
+		t.Error("Clone of a nil graph should be nil")
 	}
-	b = compare(1.0, 2, '<')
-	if !b {
-		t.Error("compare 4")
+}
+
+func TestMap(t *testing.T) {
+
+	g := FromString("name\n  john\nitems\n  a\n  b")
+	g.Get("items").Add(int64(3))
+	g.Get("items").Add(true)
+
+	r := g.Map(func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case string:
+			return strings.ToUpper(v)
+		}
+		return v
+	})
+
+	if r != g {
+		t.Error("Map should return the receiver")
 	}
 
-	b = compare("a", "a", '=')
-	if !b {
-		t.Error("compare =")
+	if g.Text() != "NAME\n  JOHN\nITEMS\n  A\n  B\n  3\n  true" {
+		t.Error("Map\n" + g.Text())
 	}
-	b = compare("a", "a", '!')
-	if b {
-		t.Error("compare =")
+	if g.Get("ITEMS").Out[2].This != int64(3) || g.Get("ITEMS").Out[3].This != true {
+		t.Error("Map should leave non-string values untouched")
 	}
 
-	b = compare(2, 1, '>')
-	if !b {
-		t.Error("compare >")
-	}
-	b = compare(2.0, 1.0, '>')
-	if !b {
-		t.Error("compare >")
+	var nilGraph *Graph
+	if nilGraph.Map(func(v interface{}) interface{} { return v }) != nil {
+		t.Error("Map on nil graph")
 	}
+}
 
-	// <=
-	b = compare(1, 2, '-')
-	if !b {
-		t.Error("compare <=")
+func TestCloneNilRoot(t *testing.T) {
+
+	g := New()
+	g.Add("a").Add("b")
+	g.Add("c")
+	g.Add(New()).Add("d")
+
+	c := g.Clone()
+
+	if !c.IsNil() {
+		t.Error("clone of a nil root should be transparent")
 	}
-	b = compare(2, 2, '-')
-	if !b {
-		t.Error("compare <=")
+	if !c.Equals(g) || c.Text() != g.Text() {
+		t.Error("clone differs from original\n", c.Text())
 	}
-	b = compare(2.0, 2.0, '-')
-	if !b {
-		t.Error("compare <=")
+
+	// Adding the clone to another graph keeps it transparent.
+	h := New()
+	h.Add(c)
+	if h.Text() != g.Text() {
+		t.Error("transparent clone added to graph\n", h.Text())
 	}
 
-	// >=
-	b = compare(2, 1, '+')
-	if !b {
-		t.Error("compare >=")
+	c.Add("e")
+	if g.Len() != 3 {
+		t.Error("modifying the clone changed the original")
 	}
-	b = compare(2, 2, '+')
-	if !b {
-		t.Error("compare >=")
+
+	var n *Graph
+	if !n.IsNil() || n.Clone() != nil {
+		t.Error("nil graph")
 	}
-	b = compare(2.0, 2.0, '+')
-	if !b {
-		t.Error("compare >=")
+}
+
+func TestGetIndexList(t *testing.T) {
+
+	p := NewPath("a.b[0,2,4]")
+	if p.Show() != "!p\n  a\n  b\n  !i\n    0\n    2\n    4" {
+		t.Error("index list path\n", p.Show())
 	}
 
-	// Cannot compare non numbers
-	b = compare("a", 1, '=')
+	g := FromString("a\n  b\n    x0\n    x1\n    x2\n    x3\n    x4")
+
+	r := g.Get("a.b[0,2,4]")
+	if r.Len() != 3 || r.Text() != "x0\nx2\nx4" {
+		t.Error("a.b[0,2,4]\n", r.Text())
+	}
+
+	// Out of range indexes are skipped
+	r = g.Get("a.b[1, 9]")
+	if r.Len() != 1 || r.Text() != "x1" {
+		t.Error("a.b[1,9]\n", r.Text())
+	}
+
+	if g.Get("a.b[7,8]") != nil {
+		t.Error("a.b[7,8] should be nil")
+	}
+}
+
+func TestFirstLast(t *testing.T) {
+
+	g := FromString("a, b, c")
+	if g.First().String() != "" || g.First().ThisString() != "a" || g.Last().ThisString() != "c" {
+		t.Error("First/Last on 3 subnodes")
+	}
+
+	g = FromString("a")
+	if g.First() != g.Last() || g.First().ThisString() != "a" {
+		t.Error("First/Last on 1 subnode")
+	}
+
+	g = New()
+	if g.First() != nil || g.Last() != nil {
+		t.Error("First/Last on empty node")
+	}
+
+	var n *Graph
+	if n.First() != nil || n.Last() != nil {
+		t.Error("First/Last on nil")
+	}
+}
+
+func TestReplaceValue(t *testing.T) {
+
+	g := FromString("a x\nb\n  x\n  c x\nx\n  d")
+
+	n := g.ReplaceValue("x", "y")
+	if n != 3 {
+		t.Error("ReplaceValue count", n)
+	}
+
+	// The non-leaf x node is left alone
+	if g.Text() != "a\n  y\nb\n  y\n  c\n    y\nx\n  d" {
+		t.Error("ReplaceValue\n", g.Text())
+	}
+
+	g = New()
+	g.Add("a").Add(int64(1))
+	g.Add("b").Add([]byte("1"))
+	if n = g.ReplaceValue(int64(1), int64(2)); n != 1 || g.Get("a").Int64() != 2 {
+		t.Error("ReplaceValue int64", n)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+
+	g := FromString("a, b, c, d")
+
+	g.Truncate(9)
+	if g.Len() != 4 {
+		t.Error("Truncate to more than Len()", g.Len())
+	}
+
+	g.Truncate(2)
+	if g.Len() != 2 || g.Text() != "a\nb" {
+		t.Error("Truncate(2)", g.Text())
+	}
+
+	g.Truncate(0)
+	if g.Len() != 0 {
+		t.Error("Truncate(0)", g.Len())
+	}
+
+	var n *Graph
+	n.Truncate(1)
+	n.Truncate(0)
+}
+
+func TestCompact1(t *testing.T) {
+
+	g := FromString("a\n  b 1\n  c 2\nd\n  e\n    f x\n    g 'y z'\nh")
+
+	s := g.Compact1()
+	if s != "a { b 1, c 2 }, d e { f x, g \"y z\" }, h" {
+		t.Error("Compact1", s)
+	}
+
+	g2 := FromCompact(s)
+	if !g.Equals(g2) {
+		t.Error("Compact1 round trip\n", g2.Text())
+	}
+
+	// Same graph as the multi-line text form
+	g3 := FromString(g.Text())
+	if !g3.Equals(g2) {
+		t.Error("Compact1 vs Text\n", g3.Text())
+	}
+
+	if FromCompact("a { }").Text() != "a" {
+		t.Error("Compact1 empty braces")
+	}
+}
+
+func TestGetSep(t *testing.T) {
+
+	g := FromString("hosts\n  example.com\n    port 80\n  a\n    b 1")
+
+	if s := g.GetSep("hosts/example.com/port", '/').String(); s != "80" {
+		t.Error("GetSep /", s)
+	}
+
+	if s := g.GetSep("hosts/a/b", '/').String(); s != "1" {
+		t.Error("GetSep /", s)
+	}
+
+	if s := g.GetSep("hosts/example.com/port[0]", '/').String(); s != "80" {
+		t.Error("GetSep / with index", s)
+	}
+
+	// Default behavior
+	if s := g.Get("hosts.a.b").String(); s != "1" {
+		t.Error("Get", s)
+	}
+	if g.Get("hosts.example.com.port") != nil {
+		t.Error("Get with dotted key should not resolve")
+	}
+	if s := g.Get("hosts.'example.com'.port").String(); s != "80" {
+		t.Error("Get with quoted key", s)
+	}
+}
+
+func TestEqualsNil(t *testing.T) {
+
+	g := FromString("a b")
+
+	var nilGraph *Graph
+
+	if g.Equals(nil) {
+		t.Error("a graph should not equal nil")
+	}
+	if nilGraph.Equals(g) {
+		t.Error("nil should not equal a graph")
+	}
+	if !nilGraph.Equals(nil) {
+		t.Error("nil should equal nil")
+	}
+
+	// Nil subnodes
+	g2 := New()
+	g2.Out = append(g2.Out, nil)
+	g3 := New()
+	g3.Out = append(g3.Out, nil)
+	if !g2.Equals(g3) {
+		t.Error("graphs with nil subnodes at the same positions should be equal")
+	}
+	g3.Out[0] = New("x")
+	if g2.Equals(g3) || g3.Equals(g2) {
+		t.Error("a nil subnode should not equal a node")
+	}
+}
+
+func TestEqualsUnordered(t *testing.T) {
+
+	a := FromString("set\n  x 1\n  y\n    p\n    q\n  x 1\n  z")
+	b := FromString("set\n  z\n  x 1\n  y\n    q\n    p\n  x 1")
+
+	if a.Equals(b) {
+		t.Error("Equals should depend on order")
+	}
+	if !a.EqualsUnordered(b) || !b.EqualsUnordered(a) {
+		t.Error("EqualsUnordered with different order")
+	}
+
+	// Duplicates count
+	c := FromString("set\n  z\n  x 1\n  y\n    q\n    p\n  x 2")
+	if a.EqualsUnordered(c) {
+		t.Error("EqualsUnordered with different duplicates")
+	}
+	d := FromString("a\n  b\n  b\n  c")
+	e := FromString("a\n  b\n  c\n  c")
+	if d.EqualsUnordered(e) {
+		t.Error("EqualsUnordered with different counts")
+	}
+
+	if !a.EqualsUnordered(a) || a.EqualsUnordered(FromString("set")) {
+		t.Error("EqualsUnordered")
+	}
+
+	var nilg *Graph
+	if !nilg.EqualsUnordered(nil) || nilg.EqualsUnordered(a) || a.EqualsUnordered(nil) {
+		t.Error("EqualsUnordered with nil")
+	}
+
+	// Cycles
+	g1 := New("a")
+	g1.Add("b").Add(g1)
+	g2 := New("a")
+	g2.Add("b").Add(g2)
+	if !g1.EqualsUnordered(g2) {
+		t.Error("EqualsUnordered with cycles")
+	}
+}
+
+func TestEqualsSharedAndCyclic(t *testing.T) {
+
+	// DAG: a shared subgraph referenced twice
+	s1 := FromString("x\n  y 1")
+	g1 := New()
+	g1.Add("a").Add(s1)
+	g1.Add("b").Add(s1)
+
+	s2 := FromString("x\n  y 1")
+	g2 := New()
+	g2.Add("a").Add(s2)
+	g2.Add("b").Add(s2.Clone())
+
+	if !g1.Equals(g2) {
+		t.Error("DAGs should be equal")
+	}
+
+	s2.Get("x").Out[0].This = "z"
+	if g1.Equals(g2) {
+		t.Error("DAGs should differ")
+	}
+
+	// Cycles: a -> b -> a
+	c1 := New("a")
+	c1.Add("b").Add(c1)
+	c2 := New("a")
+	c2.Add("b").Add(c2)
+
+	if !c1.Equals(c2) {
+		t.Error("cyclic graphs should be equal")
+	}
+
+	c3 := New("a")
+	c3.Add("c").Add(c3)
+	if c1.Equals(c3) {
+		t.Error("cyclic graphs should differ")
+	}
+}
+
+func TestWalkIndexed(t *testing.T) {
+
+	g := FromString("a\n  b\n  c\n    d\n  e\nf")
+
+	r := ""
+	g.WalkIndexed(func(n *Graph, i, l int) {
+		r += fmt.Sprintf("%s%d/%d ", n.ThisString(), i, l)
+	})
+
+	if r != "a0/2 b0/3 c1/3 d0/1 e2/3 f1/2 " {
+		t.Error("WalkIndexed", r)
+	}
+}
+
+func TestSetIndex(t *testing.T) {
+
+	g := New()
+	g.Set("a[1].b", "x")
+
+	if g.Get("a[1].b").String() != "x" {
+		t.Error("Set with an intermediate index on an empty graph\n" + g.Text())
+	}
+	if g.Get("a").Len() != 2 || g.Get("a").GetAt(0) == nil || g.Get("a").GetAt(0).This != nil {
+		t.Error("Set with an intermediate index should grow the list with empty nodes", g.Get("a").Len())
+	}
+
+	// The new nodes can be traversed
+	g = New()
+	g.EnsurePath("a[2].b")
+	g.Get("a").SortChildrenByValue()
+	g.SortRecursive(func(a, b *Graph) bool { return a.ThisString() < b.ThisString() })
+	if g.Get("a").Len() != 3 || g.Get("a").GetAt(2).Node("b") == nil {
+		t.Error("EnsurePath with an index should grow the list with empty nodes", g.Show())
+	}
+
+	g = FromString("a\n  item\n    b 1\n  item\n    b 2")
+	g.Set("a[1].b", "x")
+	g.Set("a[0].c", "y")
+
+	if g.Text() != "a\n  item\n    b\n      1\n    c\n      y\n  item\n    b\n      x" {
+		t.Error("Set with an intermediate index\n" + g.Text())
+	}
+
+	// Final index: the node itself is replaced
+	g.Set("a[1]", "z")
+	if g.Get("a").GetAt(1).ThisString() != "z" {
+		t.Error("Set with a final index\n" + g.Text())
+	}
+}
+
+func TestSetBadIndex(t *testing.T) {
+
+	g := FromString("a\n  b 1")
+	text := g.Text()
+
+	for _, p := range []string{"a[x]", "a[x].c", "a[-1]", "a[1,2]", "a[2.5].c", "n[x]"} {
+		if g.Set(p, "v") != nil {
+			t.Error("Set with bad index should return nil:", p)
+		}
+		if g.EnsurePath(p) != nil {
+			t.Error("EnsurePath with bad index should return nil:", p)
+		}
+	}
+
+	if g.Text() != text {
+		t.Error("Set with bad index changed the graph:\n" + g.Text())
+	}
+	if g.Get("a").Len() != 1 {
+		t.Error("Set with bad index allocated subnodes:", g.Get("a").Len())
+	}
+
+	if g.Get("a").Int64() != 0 || g.Get("a").Int64(7) != 7 {
+		t.Error("Int64 of a non numeric node should be 0 or the default")
+	}
+}
+
+func TestSetMaxIndex(t *testing.T) {
+
+	g := New()
+
+	if g.Set("a[1000000000]", "x") != nil || g.Set("a[99999999999999999999].b", "x") != nil {
+		t.Error("Set with a huge index should return nil")
+	}
+	if g.EnsurePath("a[1000000000]") != nil {
+		t.Error("EnsurePath with a huge index should return nil")
+	}
+	if g.Len() != 0 {
+		t.Error("Set with a huge index changed the graph:\n" + g.Text())
+	}
+
+	defer func(max int) { MaxIndex = max }(MaxIndex)
+	MaxIndex = 10
+
+	if g.Set("a[10]", "x") == nil || g.Get("a").Len() != 11 {
+		t.Error("Set with index MaxIndex:\n" + g.Text())
+	}
+	if g.Set("a[11]", "x") != nil || g.Get("a").Len() != 11 {
+		t.Error("Set with index over MaxIndex:\n" + g.Text())
+	}
+}
+
+func TestMarshalOGDLIndent(t *testing.T) {
+
+	g := New()
+	a := g.Add("a")
+	a.Add("c").Add("d e")
+	a.Add("x").Add("multi\nline\n  indented")
+	a.Add("key\nwith lines").Add("b")
+
+	tests := []struct{ indent, text string }{
+		{"", "a\n  c\n   \"d e\"\n  x\n    \\\n      multi\n      line\n        indented\n \"key\n  with lines\"\n    b"},
+		{"\t", "a\n\tc\n\t\t\"d e\"\n\tx\n\t\t\\\n\t\t\tmulti\n\t\t\tline\n\t\t\t  indented\n\t\"key\n\t with lines\"\n\t\tb"},
+		{"    ", "a\n    c\n       \"d e\"\n    x\n        \\\n            multi\n            line\n              indented\n   \"key\n    with lines\"\n        b"},
+	}
+
+	for _, tt := range tests {
+		s := g.MarshalOGDL(EmitOptions{IndentString: tt.indent})
+		if s != tt.text {
+			t.Errorf("MarshalOGDL indent %q:\n%s", tt.indent, s)
+		}
+
+		// Continuation lines of quoted strings are read back as written
+		if g2 := FromString(s); !g2.Equals(g) {
+			t.Errorf("MarshalOGDL indent %q does not parse back:\n%s", tt.indent, g2.Text())
+		}
+	}
+}
+
+func TestParentOf(t *testing.T) {
+
+	g := FromString("a\n  b\n    c\n      d 1\n  e\nf")
+
+	d := g.Get("a.b.c.d")
+	if p := g.ParentOf(d); p != g.Get("a.b.c") {
+		t.Error("ParentOf nested node", p.Show())
+	}
+	if p := g.ParentOf(d.Out[0]); p != d {
+		t.Error("ParentOf leaf", p.Show())
+	}
+	if p := g.ParentOf(g.Get("f")); p != g {
+		t.Error("ParentOf top level node", p.Show())
+	}
+
+	if g.ParentOf(g) != nil {
+		t.Error("ParentOf the root should be nil")
+	}
+	if g.ParentOf(New("x")) != nil || g.ParentOf(nil) != nil {
+		t.Error("ParentOf a node not in the graph should be nil")
+	}
+
+	// A search below a node does not find its own parent
+	if g.Get("a.b").ParentOf(g.Get("a.b")) != nil {
+		t.Error("ParentOf only searches below the receiver")
+	}
+
+	// Cycles do not cause an endless search
+	c := New("c")
+	c.Add(c)
+	if c.ParentOf(New("x")) != nil || c.ParentOf(c) != c {
+		t.Error("ParentOf in a cyclic graph")
+	}
+}
+
+func TestDeleteByPath(t *testing.T) {
+
+	g := FromString("a\n  b\n    c 1\n    d 2\n  list\n    x\n    y\n    z\ne 3")
+
+	if !g.DeleteByPath("a.b.c") || g.Text() != "a\n  b\n    d\n      2\n  list\n    x\n    y\n    z\ne\n  3" {
+		t.Error("DeleteByPath of a nested token\n" + g.Text())
+	}
+
+	if !g.DeleteByPath("a.list[1]") || g.Get("a.list").Text() != "x\nz" {
+		t.Error("DeleteByPath of a nested index\n" + g.Text())
+	}
+
+	if !g.DeleteByPath("e") || g.Get("e") != nil {
+		t.Error("DeleteByPath of a top level node\n" + g.Text())
+	}
+
+	text := g.Text()
+	for _, p := range []string{"a.x", "x.b", "a.list[5]", "a.b.d.3"} {
+		if g.DeleteByPath(p) {
+			t.Error("DeleteByPath of a non-existent path", p)
+		}
+	}
+	if g.Text() != text {
+		t.Error("DeleteByPath of non-existent paths should not change the graph\n" + g.Text())
+	}
+
+	var nilGraph *Graph
+	if nilGraph.DeleteByPath("a") {
+		t.Error("DeleteByPath on nil graph")
+	}
+}
+
+func TestReplace(t *testing.T) {
+
+	g := FromString("a\n  b 1\n  c 2\n  d 3")
+
+	// A leaf by a subtree
+	if !g.Replace("a.c", FromString("x\n  y\n  z").Out[0]) {
+		t.Error("Replace of a leaf returned false")
+	}
+	if s := g.Text(); s != "a\n  b\n    1\n  x\n    y\n    z\n  d\n    3" {
+		t.Error("Replace of a leaf with a subtree:\n" + s)
+	}
+
+	// A subtree by a leaf, by index
+	if !g.Replace("a[1]", New("w")) {
+		t.Error("Replace by index returned false")
+	}
+	if s := g.Text(); s != "a\n  b\n    1\n  w\n  d\n    3" {
+		t.Error("Replace of a subtree with a leaf:\n" + s)
+	}
+
+	if !g.Replace("a", New("e")) || g.Text() != "e" {
+		t.Error("Replace of a top level node:\n" + g.Text())
+	}
+
+	for _, p := range []string{"x", "e.f", "e[3]", "e{0}"} {
+		if g.Replace(p, New("v")) {
+			t.Error("Replace of a non-existent path", p)
+		}
+	}
+	if g.Replace("e", nil) || g.Text() != "e" {
+		t.Error("Replace with nil")
+	}
+
+	var nilg *Graph
+	if nilg.Replace("a", New("v")) {
+		t.Error("Replace on nil graph")
+	}
+}
+
+func TestSetStrict(t *testing.T) {
+
+	g := FromString("a\n  port 80\n  name x\n  on true")
+
+	_, err := g.SetStrict("a.port", 8080, nil)
+	if err != nil || g.Get("a.port").Int64() != 8080 {
+		t.Error("SetStrict int over int", err)
+	}
+
+	_, err = g.SetStrict("a.port", "1.5", nil)
+	if err != nil {
+		t.Error("SetStrict numeric string over int", err)
+	}
+
+	_, err = g.SetStrict("a.name", "y", nil)
+	if err != nil || g.Get("a.name").String() != "y" {
+		t.Error("SetStrict string over string", err)
+	}
+
+	_, err = g.SetStrict("a.port", "http", nil)
+	if err == nil || g.Get("a.port").String() != "1.5" {
+		t.Error("SetStrict string over number should fail", g.Get("a.port").String())
+	}
+
+	_, err = g.SetStrict("a.on", 1, nil)
+	if err == nil {
+		t.Error("SetStrict number over bool should fail")
+	}
+
+	_, err = g.SetStrict("a.new", 1, nil)
+	if err != nil || g.Get("a.new").Int64() != 1 {
+		t.Error("SetStrict of a new path", err)
+	}
+
+	// Custom rule: anything goes
+	_, err = g.SetStrict("a.port", "http", func(old, val interface{}) bool { return true })
+	if err != nil || g.Get("a.port").String() != "http" {
+		t.Error("SetStrict with a custom rule", err)
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+
+	g := FromString("a\n  b 1\n  c 2")
+
+	n := g.Get("a[1]")
+	if n.This != nil || n.Len() != 1 {
+		t.Error("a[1] should be wrapped", n.Show())
+	}
+
+	n = n.Unwrap()
+	if n.ThisString() != "c" || n.String() != "2" {
+		t.Error("Unwrap", n.Show())
+	}
+
+	// Not a wrapper: returned as is
+	n = g.Get("a").Unwrap()
+	if n.ThisString() != "a" {
+		t.Error("Unwrap of a named node", n.Show())
+	}
+
+	n = g.Get("a[0,1]")
+	if n.Unwrap() != n || n.Len() != 2 {
+		t.Error("Unwrap of a transparent node with several subnodes", n.Show())
+	}
+
+	n = nil
+	if n.Unwrap() != nil {
+		t.Error("Unwrap of nil")
+	}
+}
+
+func TestParent(t *testing.T) {
+
+	g := FromString("a\n  b\n    c 1\n  d 2")
+
+	p := g.Parent("a.b.c")
+	if p.ThisString() != "b" {
+		t.Error("Parent of a deep leaf", p.Show())
+	}
+
+	p = g.Parent("a[1]")
+	if p.ThisString() != "a" {
+		t.Error("Parent of a[1]", p.Show())
+	}
+
+	p = g.Parent("a[0].c")
+	if p.ThisString() != "b" {
+		t.Error("Parent of a[0].c", p.Show())
+	}
+
+	p = g.Parent("a")
+	if p != g {
+		t.Error("Parent of a top level node should be the root", p.Show())
+	}
+
+	if g.Parent("a.x") != nil || g.Parent("x") != nil {
+		t.Error("Parent of a missing path should be nil")
+	}
+}
+
+// failWriter returns an error after a number of writes
+type failWriter struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func (w *failWriter) Write(b []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("write failed")
+	}
+	w.n--
+	return w.buf.Write(b)
+}
+
+func TestWriteText(t *testing.T) {
+
+	docs := []string{
+		"a\n  b 1\n  c 2\nd 3",
+		"a\n  \"multi\n  line\"\n    b",
+		"'x y'\n  z",
+		"'\"quoted\"'",
+		"",
+	}
+
+	for _, doc := range docs {
+		g := FromString(doc)
+
+		var buf bytes.Buffer
+		if err := g.WriteText(&buf); err != nil || buf.String() != g.Text() {
+			t.Errorf("WriteText %q, Text %q (%v)", buf.String(), g.Text(), err)
+		}
+
+		buf.Reset()
+		if err := g.WriteShow(&buf); err != nil || buf.String() != g.Show() {
+			t.Errorf("WriteShow %q, Show %q (%v)", buf.String(), g.Show(), err)
+		}
+	}
+
+	g := FromString("a\n  b 1\n  c 2\nd 3")
+
+	w := &failWriter{n: 3}
+	err := g.WriteText(w)
+	if err == nil || err.Error() != "write failed" {
+		t.Error("WriteText should return the error of the writer", err)
+	}
+	if !strings.HasPrefix(g.Text(), w.buf.String()) || w.buf.Len() == 0 {
+		t.Error("WriteText partial output", w.buf.String())
+	}
+
+	var nilGraph *Graph
+	if err := nilGraph.WriteText(w); err != nil {
+		t.Error("WriteText on nil graph", err)
+	}
+}
+
+// cancelWriter cancels a context after a number of writes
+type cancelWriter struct {
+	buf    bytes.Buffer
+	n      int
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(b []byte) (int, error) {
+	w.n--
+	if w.n == 0 {
+		w.cancel()
+	}
+	return w.buf.Write(b)
+}
+
+func TestWriteTextContext(t *testing.T) {
+
+	g := FromString("a\n  b 1\n  c 2\nd 3")
+
+	w := &cancelWriter{}
+	err := g.WriteTextContext(context.Background(), &w.buf)
+	if err != nil || w.buf.String() != g.Text() {
+		t.Error("WriteTextContext", err, w.buf.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w = &cancelWriter{n: 3, cancel: cancel}
+
+	err = g.WriteTextContext(ctx, w)
+	if err != context.Canceled {
+		t.Error("WriteTextContext should return the context error", err)
+	}
+	if w.buf.String() != "a\n  b" {
+		t.Error("WriteTextContext partial output", w.buf.String())
+	}
+}
+
+func TestNodeScalar(t *testing.T) {
+
+	g := New()
+	g.Add(int64(2)).Add("two")
+	g.Add("3").Add("three")
+	g.Add(1.5).Add("one and a half")
+	g.Add("x").Add("ex")
+
+	if g.NodeScalar("2").String() != "two" || g.NodeScalar("2.0").String() != "two" {
+		t.Error("NodeScalar int64 by string")
+	}
+
+	if g.NodeScalar(int64(3)).String() != "three" || g.NodeScalar(3.0).String() != "three" {
+		t.Error("NodeScalar string by number")
+	}
+
+	if g.NodeScalar("1.5").String() != "one and a half" {
+		t.Error("NodeScalar float by string")
+	}
+
+	if g.NodeScalar("x").String() != "ex" || g.NodeScalar(4) != nil {
+		t.Error("NodeScalar")
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+
+	a := FromString("server\n  host localhost\n  port 80\nlog info\nname x")
+
+	if s := a.Similarity(a.Clone()); s != 1 {
+		t.Error("Similarity of identical graphs", s)
+	}
+
+	if s := a.Similarity(FromString("other\n  host localhost\nlevel 3")); s != 0 {
+		t.Error("Similarity of disjoint graphs", s)
+	}
+
+	// 3 shared paths, 5 in total
+	b := FromString("server\n  host localhost\n  port 8080\nlog info\nname x")
+	if s := a.Similarity(b); s != 0.6 {
+		t.Error("Similarity of overlapping graphs", s)
+	}
+
+	if s := New().Similarity(nil); s != 1 {
+		t.Error("Similarity of empty graphs", s)
+	}
+}
+
+func TestFold(t *testing.T) {
+
+	g := FromString("a\n  b 1\n  c 2\n    d 3\nname x")
+
+	sum := Fold(g, int64(0), func(acc int64, n *Graph) int64 {
+		if i, ok := _int64f(n.This); ok && n.Len() == 0 {
+			return acc + i
+		}
+		return acc
+	})
+	if sum != 6 {
+		t.Error("Fold sum", sum)
+	}
+
+	s := Fold(g, "", func(acc string, n *Graph) string {
+		if n.Len() == 0 {
+			return acc + n.ThisString()
+		}
+		return acc
+	})
+	if s != "123x" {
+		t.Error("Fold concatenation", s)
+	}
+
+	if Fold(g, 0, func(n int, _ *Graph) int { return n + 1 }) != 9 {
+		t.Error("Fold count")
+	}
+}
+
+func TestTextControlChars(t *testing.T) {
+
+	g := New()
+	g.Add("a").Add("x\x00y\x07z")
+	g.Add("b").Add("cr\r\x7f")
+	g.Add("c").Add("\\x41 y")
+
+	s := g.Text()
+	if s != "a\n \"x\\x00y\\x07z\"\nb\n \"cr\\x0d\\x7f\"\nc\n \"\\x5cx41 y\"" {
+		t.Error("Text with control characters\n", s)
+	}
+
+	g2 := FromString(s)
+	if !g2.Equals(g) {
+		t.Error("control characters do not round-trip\n", g2.Show())
+	}
+
+	// Also at the top level
+	g = New()
+	g.Add("a\x00b\a")
+	g.Add("c\x1b").Add("d")
+
+	s = g.Text()
+	if s != "\"a\\x00b\\x07\"\n\"c\\x1b\"\n  d" {
+		t.Error("Text with top level control characters\n", s)
+	}
+	if g2 = FromString(s); !g2.Equals(g) {
+		t.Error("top level control characters do not round-trip\n", g2.Show())
+	}
+
+	// An incomplete escape is kept as is
+	g2 = FromString("a \"\\x4\"")
+	if g2.Get("a").String() != "\\x4" {
+		t.Error("incomplete \\x escape", g2.Get("a").String())
+	}
+}
+
+func TestSetTyped(t *testing.T) {
+
+	g := New()
+	g.SetTyped("a.n", "42")
+	g.SetTyped("a.f", "1.5")
+	g.SetTyped("a.b", "true")
+	g.SetTyped("a.s", "hello")
+
+	if v := g.Get("a.n").Out[0].This; v != int64(42) {
+		t.Error("SetTyped int", _typeOf(v))
+	}
+	if v := g.Get("a.f").Out[0].This; v != 1.5 {
+		t.Error("SetTyped float", _typeOf(v))
+	}
+	if v := g.Get("a.b").Out[0].This; v != true {
+		t.Error("SetTyped bool", _typeOf(v))
+	}
+	if v := g.Get("a.s").Out[0].This; v != "hello" {
+		t.Error("SetTyped string", _typeOf(v))
+	}
+}
+
+func TestAtDepth(t *testing.T) {
+
+	g := FromString("a\n  b 1\n  c\nd\n  e 2")
+
+	s := ""
+	for _, n := range g.AtDepth(1) {
+		s += n.ThisString()
+	}
+	if s != "ad" {
+		t.Error("AtDepth(1)", s)
+	}
+
+	s = ""
+	for _, n := range g.AtDepth(2) {
+		s += n.ThisString()
+	}
+	if s != "bce" {
+		t.Error("AtDepth(2)", s)
+	}
+
+	if r := g.AtDepth(0); len(r) != 1 || r[0] != g {
+		t.Error("AtDepth(0)")
+	}
+
+	if g.AtDepth(4) != nil || g.AtDepth(-1) != nil {
+		t.Error("AtDepth beyond the graph")
+	}
+}
+
+func TestFindFunc(t *testing.T) {
+
+	g := FromString("a\n  b\n    c 1\n  d\n    c 2\ne 3")
+
+	n := g.FindFunc(func(n *Graph) bool { return n.ThisString() == "c" })
+	if n == nil || n.String() != "1" {
+		t.Error("FindFunc didn't return the first match:", n)
+	}
+
+	n = g.FindFunc(func(n *Graph) bool { return n.ThisString() == "2" })
+	if n == nil || n.ThisString() != "2" || n.Len() != 0 {
+		t.Error("FindFunc didn't find a deep leaf:", n)
+	}
+
+	n = g.FindFunc(func(n *Graph) bool { return n.Len() == 2 })
+	if n == nil || n.ThisString() != "a" {
+		t.Error("FindFunc by number of subnodes failed:", n)
+	}
+
+	if g.FindFunc(func(n *Graph) bool { return n.ThisString() == "x" }) != nil {
+		t.Error("FindFunc should return nil without matches")
+	}
+
+	var nilg *Graph
+	if nilg.FindFunc(func(n *Graph) bool { return true }) != nil {
+		t.Error("FindFunc on nil graph should return nil")
+	}
+}
+
+func TestCount(t *testing.T) {
+
+	g := FromString("a\n  version 1\n  b\n    version 2\nversion 3\nc")
+
+	if n := g.Count(func(n *Graph) bool { return n.ThisString() == "version" }); n != 3 {
+		t.Error("Count of repeated keys: got", n)
+	}
+
+	if n := g.Count(func(n *Graph) bool { return n.Len() == 0 }); n != 4 {
+		t.Error("Count of leaf nodes: got", n)
+	}
+
+	var nilg *Graph
+	if nilg.Count(func(n *Graph) bool { return true }) != 0 {
+		t.Error("Count on nil graph should be 0")
+	}
+}
+
+func TestDump(t *testing.T) {
+
+	g := New()
+	a := g.Add("a b")
+	a.Add(int64(1))
+	a.Add(1.5)
+	a.Add(true)
+	a.Add([]byte("x"))
+	a.Add(nil)
+	g.Out = append(g.Out, nil)
+
+	want := "<nil>\n  string \"a b\"\n    int64 1\n    float64 1.5\n    bool true\n    []byte \"x\"\n    <nil>\n  <nil node>"
+	if s := g.Dump(); s != want {
+		t.Error("Dump:\n" + s)
+	}
+
+	c := New("c")
+	c.Add(c)
+	if s := c.Dump(); s != "string \"c\"\n  string \"c\" (cycle)" {
+		t.Error("Dump with a cycle:\n" + s)
+	}
+
+	var nilg *Graph
+	if nilg.Dump() != "" {
+		t.Error("Dump of nil graph")
+	}
+}
+
+func TestFilter(t *testing.T) {
+
+	g := FromString("a\nb\n  1\nc\n  1\n  2\na")
+
+	r := g.Filter(func(n *Graph) bool { return n.ThisString() == "a" })
+	if r.Len() != 2 || r.Out[0] != g.Out[0] || r.Out[1] != g.Out[3] || r.This != nil {
+		t.Error("Filter by value", r.Show())
+	}
+
+	r = g.Filter(func(n *Graph) bool { return n.Len() > 0 })
+	if r.Text() != "b\n  1\nc\n  1\n  2" {
+		t.Error("Filter by out-degree", r.Text())
+	}
+
+	// Nodes are shared
+	r.Out[0].Add("x")
+	if g.Get("b").Len() != 2 {
+		t.Error("Filter should share the nodes")
+	}
+
+	r = g.Filter(func(n *Graph) bool { return false })
+	if r == nil || r.Len() != 0 {
+		t.Error("Filter with no matches should return an empty graph")
+	}
+
+	var nilGraph *Graph
+	if r = nilGraph.Filter(func(n *Graph) bool { return true }); r == nil || r.Len() != 0 {
+		t.Error("Filter on nil graph")
+	}
+}
+
+func TestSortChildren(t *testing.T) {
+
+	g := FromString("b\n  2\na\n  1\nc\na\n  3\nb\n  1")
+
+	g.SortChildrenByValue()
+
+	// Stable: the two a and b nodes keep their relative order
+	if g.Text() != "a\n  1\na\n  3\nb\n  2\nb\n  1\nc" {
+		t.Error("SortChildrenByValue\n" + g.Text())
+	}
+
+	// By number of subnodes, descending
+	g = FromString("x\ny\n  1\n  2\nz\n  1\nw\n  1\n  2")
+	g.SortChildren(func(a, b *Graph) bool { return a.Len() > b.Len() })
+	if g.Text() != "y\n  1\n  2\nw\n  1\n  2\nz\n  1\nx" {
+		t.Error("SortChildren\n" + g.Text())
+	}
+
+	// Not recursive
+	g = FromString("b\n  z\n  y\na")
+	g.SortChildrenByValue()
+	if g.Text() != "a\nb\n  z\n  y" {
+		t.Error("SortChildren should not recurse\n" + g.Text())
+	}
+
+	g.SortRecursive(func(a, b *Graph) bool { return _string(a.This) < _string(b.This) })
+	if g.Text() != "a\nb\n  y\n  z" {
+		t.Error("SortRecursive\n" + g.Text())
+	}
+
+	var nilGraph *Graph
+	nilGraph.SortChildrenByValue()
+	nilGraph.SortRecursive(nil)
+}
+
+func TestPartition(t *testing.T) {
+
+	g := FromString("a 1\nb 20\nc 3\nd 40")
+
+	big := func(n *Graph) bool { return n.Int64() > 10 }
+
+	match, rest := g.Partition(big)
+	if len(match) != 2 || match[0].ThisString() != "b" || match[1].ThisString() != "d" {
+		t.Error("Partition match", len(match))
+	}
+	if len(rest) != 2 || rest[0].ThisString() != "a" || rest[1].ThisString() != "c" {
+		t.Error("Partition rest", len(rest))
+	}
+
+	// All nodes: the leaves have no subnodes, so Int64() is 0
+	match, rest = g.Partition(big, true)
+	if len(match) != 2 || len(rest) != 6 {
+		t.Error("Partition recursive", len(match), len(rest))
+	}
+}
+
+func TestMarshalOGDL(t *testing.T) {
+
+	g := FromString("b\n  y 2\n  x 1\na\n  c\n    d long_value")
+
+	if g.MarshalOGDL(EmitOptions{}) != g.Text() {
+		t.Error("MarshalOGDL default should be Text()")
+	}
+	if g.MarshalOGDL(EmitOptions{IncludeRoot: true}) != g.Show() {
+		t.Error("MarshalOGDL with root should be Show()")
+	}
+
+	s := g.MarshalOGDL(EmitOptions{IndentString: "\t"})
+	if s != "b\n\ty\n\t\t2\n\tx\n\t\t1\na\n\tc\n\t\td\n\t\t\tlong_value" {
+		t.Error("MarshalOGDL IndentString\n", s)
+	}
+
+	s = g.MarshalOGDL(EmitOptions{SortKeys: true})
+	if s != "a\n  c\n    d\n      long_value\nb\n  x\n    1\n  y\n    2" {
+		t.Error("MarshalOGDL SortKeys\n", s)
+	}
+	if g.Out[0].ThisString() != "b" {
+		t.Error("MarshalOGDL SortKeys should not modify the graph")
+	}
+
+	s = g.MarshalOGDL(EmitOptions{MaxDepth: 2})
+	if s != "b\n  y\n  x\na\n  c" {
+		t.Error("MarshalOGDL MaxDepth\n", s)
+	}
+
+	s = g.MarshalOGDL(EmitOptions{Width: 12})
+	if s != "b\n  y 2\n  x 1\na\n  c\n    d\n      long_value" {
+		t.Error("MarshalOGDL Width\n", s)
+	}
+
+	s = g.MarshalOGDL(EmitOptions{Width: 80, SortKeys: true, IncludeRoot: true})
+	if s != "_\n  a c d long_value\n  b\n    x 1\n    y 2" {
+		t.Error("MarshalOGDL Width, SortKeys and IncludeRoot\n", s)
+	}
+
+	s = g.MarshalOGDL(EmitOptions{Width: 80, MaxDepth: 2, IndentString: "    "})
+	if s != "b\n    y\n    x\na\n    c" {
+		t.Error("MarshalOGDL Width and MaxDepth\n", s)
+	}
+
+	// Lines folded by Width parse back to the same graph
+	if !FromString(g.MarshalOGDL(EmitOptions{Width: 80})).Equals(g) {
+		t.Error("MarshalOGDL Width round trip")
+	}
+}
+
+func TestWalk(t *testing.T) {
+
+	g := FromString("a\n  b\n  c\n    d\n  e\nf")
+
+	var values []string
+	g.Walk(func(n *Graph, depth int) bool {
+		values = append(values, fmt.Sprintf("%s%d", n.ThisString(), depth))
+		return true
+	})
+
+	if strings.Join(values, " ") != "a0 b1 c1 d2 e1 f0" {
+		t.Error("Walk", values)
+	}
+
+	var nilGraph *Graph
+	nilGraph.Walk(func(n *Graph, depth int) bool {
+		t.Error("Walk on nil graph visits", n)
+		return true
+	})
+}
+
+func TestWalkPrune(t *testing.T) {
+
+	g := FromString("a\n  b\n  c\n    d\n  e\nf")
+
+	values := ""
+	g.Walk(func(n *Graph, depth int) bool {
+		values += n.ThisString()
+		return n.ThisString() != "c"
+	})
+
+	if values != "abcef" {
+		t.Error("Walk with pruning", values)
+	}
+}
+
+func TestGetAll(t *testing.T) {
+
+	g := FromString("list\n  item 1\n  item 2\n  other 3\n  item 4\nlist\n  item 5")
+
+	values := func(nn []*Graph) string {
+		var s []string
+		for _, n := range nn {
+			s = append(s, n.Text())
+		}
+		return strings.Join(s, ",")
+	}
+
+	// Final token: all matches; intermediate token: first match
+	if r := values(g.GetAll("list.item")); r != "1,2,4" {
+		t.Error("GetAll ending in token", r)
+	}
+
+	// Final index
+	nn := g.GetAll("list[1]")
+	if len(nn) != 1 || nn[0].ThisString() != "item" || nn[0].String() != "2" {
+		t.Error("GetAll ending in index", values(nn))
+	}
+
+	// Index followed by token
+	if r := values(g.GetAll("[1].item")); r != "5" {
+		t.Error("GetAll index then token", r)
+	}
+
+	// Selector followed by token
+	if r := values(g.GetAll("list{1}.item")); r != "5" {
+		t.Error("GetAll selector then token", r)
+	}
+
+	// All occurrences by selector (their subnodes, as in Get)
+	if r := values(g.GetAll("list{}")); r != "1,2,3,4,5" {
+		t.Error("GetAll ending in {}", r)
+	}
+
+	for _, p := range []string{"list.none", "none.item", "list[9]"} {
+		nn := g.GetAll(p)
+		if nn == nil || len(nn) != 0 {
+			t.Error("GetAll with no match should return an empty slice", p, nn)
+		}
+	}
+
+	var nilGraph *Graph
+	if nn := nilGraph.GetAll("a"); nn == nil || len(nn) != 0 {
+		t.Error("GetAll on nil graph", nn)
+	}
+}
+
+func TestGetNegativeIndex(t *testing.T) {
+
+	g := FromString("a\n  x\n  y\n  z")
+
+	if s := g.Get("a[-1]").String(); s != "z" {
+		t.Error("a[-1]: got", s)
+	}
+	if s := g.Get("a[-2]").String(); s != "y" {
+		t.Error("a[-2]: got", s)
+	}
+	if s := g.Get("a[-3]").String(); s != "x" {
+		t.Error("a[-3]: got", s)
+	}
+	if g.Get("a[-4]") != nil {
+		t.Error("a[-4] should be nil")
+	}
+	if s := g.Get("a[0,-1]").Text(); s != "x\nz" {
+		t.Error("a[0,-1]: got", s)
+	}
+
+	// Eval returns the subnodes of the node found
+	h := FromString("a\n  x 1\n  y 2\n  z 3")
+	if n, ok := h.Eval(NewExpression("a[-1]")).(*Graph); !ok || n.Text() != "3" {
+		t.Error("Eval a[-1]: got", n)
+	}
+	if v := g.Eval(NewExpression("a[-4]")); v != nil {
+		if n, ok := v.(*Graph); !ok || n != nil {
+			t.Error("Eval a[-4] should be nil, got", v)
+		}
+	}
+
+	if !g.DeleteByPath("a[-1]") || g.Get("a").Text() != "x\ny" {
+		t.Error("DeleteByPath a[-1]\n" + g.Text())
+	}
+}
+
+func TestGetSlice(t *testing.T) {
+
+	g := FromString("items\n  a\n  b\n  c\n  d")
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"items[1:3]", "b\nc"},
+		{"items[2:]", "c\nd"},
+		{"items[:2]", "a\nb"},
+		{"items[:]", "a\nb\nc\nd"},
+		{"items[-2:]", "c\nd"},
+		{"items[1:-1]", "b\nc"},
+		{"items[-10:1]", "a"},
+		{"items[2:10]", "c\nd"},
+	}
+
+	for _, test := range tests {
+		if s := g.Get(test.path).Text(); s != test.want {
+			t.Errorf("%s: got %q, want %q", test.path, s, test.want)
+		}
+	}
+
+	for _, p := range []string{"items[3:1]", "items[4:]", "items[x:]"} {
+		if g.Get(p) != nil {
+			t.Error(p, "should be nil")
+		}
+	}
+
+	if n := len(g.GetAll("items[1:]")); n != 3 {
+		t.Error("GetAll of a slice: got", n)
+	}
+
+	if s := NewPath("items[ 1 : ]").PathString(); s != "items[1:]" {
+		t.Error("PathString of a slice:", s)
+	}
+}
+
+func TestGetWildcard(t *testing.T) {
+
+	g := FromString("root\n  x\n    name a\n    id 1\n  y\n    id 2\n  z\n    name c")
+
+	if s := g.Get("root.*.name").Text(); s != "name\n  a\nname\n  c" {
+		t.Error("wildcard in the middle:\n" + s)
+	}
+	if s := g.Get("root.*.id[0]").Text(); s != "1\n2" {
+		t.Error("wildcard followed by an index:\n" + s)
+	}
+	if s := g.Get("root.*").Text(); s != g.Get("root").Text() {
+		t.Error("wildcard at the end:\n" + s)
+	}
+	if s := g.Get("root.x.*").Text(); s != "name\n  a\nid\n  1" {
+		t.Error("wildcard at the end:\n" + s)
+	}
+	if s := g.Get("*.*.id").Text(); s != "id\n  1\nid\n  2" {
+		t.Error("wildcard at the beginning:\n" + s)
+	}
+
+	if g.Get("root.*.missing") != nil {
+		t.Error("wildcard without matches should return nil")
+	}
+
+	if n := len(g.GetAll("root.*.name")); n != 2 {
+		t.Error("GetAll with wildcard: got", n)
+	}
+
+	if s := NewPath("root.*.name").PathString(); s != "root.*.name" {
+		t.Error("PathString with wildcard:", s)
+	}
+}
+
+func TestKeys(t *testing.T) {
+
+	g := FromString("host a\nport 80\nhost b\n'x y'\nport 81")
+
+	if s := strings.Join(g.Keys(), ","); s != "host,port,host,x y,port" {
+		t.Error("Keys:", s)
+	}
+	if s := strings.Join(g.UniqueKeys(), ","); s != "host,port,x y" {
+		t.Error("UniqueKeys:", s)
+	}
+
+	var nilg *Graph
+	if k := nilg.Keys(); k == nil || len(k) != 0 {
+		t.Error("Keys of nil graph should be empty")
+	}
+	if k := New().UniqueKeys(); k == nil || len(k) != 0 {
+		t.Error("UniqueKeys of empty graph should be empty")
+	}
+}
+
+func TestSyncGraph(t *testing.T) {
+
+	s := NewSyncGraph(FromString("count 0"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Set("w"+fmt.Sprint(i), j)
+				s.Do(func(g *Graph) {
+					g.Set("count", g.Get("count").Int64()+1)
+				})
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Get("count").Int64()
+				_ = s.Text()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := s.Get("count").Int64(); n != 800 {
+		t.Error("SyncGraph lost updates: got", n)
+	}
+	if s.Get("w7").Int64() != 99 {
+		t.Error("SyncGraph Set:\n" + s.Text())
+	}
+
+	// Get returns a copy
+	s.Get("count").Set("x", 1)
+	if s.Get("count.x") != nil {
+		t.Error("SyncGraph Get should return a copy")
+	}
+
+	s.Add("a")
+	s.Delete("a")
+	if !s.DeleteByPath("w0") || s.Get("a") != nil || s.Get("w0") != nil {
+		t.Error("SyncGraph Delete:\n" + s.Text())
+	}
+}
+
+func TestEnsurePath(t *testing.T) {
+
+	g := FromString("a\n  b\n    c 1")
+
+	n := g.EnsurePath("a.b")
+	if n == nil || n.ThisString() != "b" || n.Get("c").Int64() != 1 {
+		t.Error("EnsurePath of an existing path:", n)
+	}
+
+	n = g.EnsurePath("a.b.d.e")
+	if n == nil || n.ThisString() != "e" || n.Len() != 0 {
+		t.Error("EnsurePath of a new path:", n)
+	}
+	n.Add("x")
+
+	g.EnsurePath("a.b.d").Add("f")
+
+	if s := g.Text(); s != "a\n  b\n    c\n      1\n    d\n      e\n        x\n      f" {
+		t.Error("EnsurePath should reuse existing branches:\n" + s)
+	}
+
+	n = g.EnsurePath("list[2].name")
+	if n == nil || n.ThisString() != "name" || g.Get("list").Len() != 3 {
+		t.Error("EnsurePath with index:\n" + g.Text())
+	}
+	if g.EnsurePath("list[2].name") != n || g.Get("list").Len() != 3 {
+		t.Error("EnsurePath with index should reuse nodes:\n" + g.Text())
+	}
+
+	if g.EnsurePath("a[-1]") != nil {
+		t.Error("EnsurePath with negative index should return nil")
+	}
+
+	var nilg *Graph
+	if nilg.EnsurePath("a") != nil {
+		t.Error("EnsurePath on nil graph should return nil")
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	schema := FromString(`
+name string
+server
+  host string
+  port int
+  ratio !float
+  tls bool
+debug
+`)
+
+	g := FromString(`
+name test
+server
+  host localhost
+  port 8080
+  ratio 0.5
+  tls true
+  extra x
+debug
+`)
+
+	if errs := g.Validate(schema); len(errs) != 0 {
+		t.Error("Validate of a valid document:", errs)
+	}
+
+	g.DeleteByPath("server.host")
+	g.DeleteByPath("debug")
+	g.Set("server.port", "eighty")
+	g.Set("server.tls", "maybe")
+
+	var msgs []string
+	for _, err := range g.Validate(schema) {
+		msgs = append(msgs, err.Error())
+	}
+	want := `server.host: missing|server.port: want int, got "eighty"|server.tls: want bool, got "maybe"|debug: missing`
+	if s := strings.Join(msgs, "|"); s != want {
+		t.Error("Validate errors:\n" + s)
+	}
+
+	g = FromString("name\n  a\n  b\nserver 1")
+	msgs = nil
+	for _, err := range g.Validate(FromString("name string\nserver\n  port int")) {
+		msgs = append(msgs, err.Error())
+	}
+	if s := strings.Join(msgs, "|"); s != "name: want a single string value|server.port: missing" {
+		t.Error("Validate errors:\n" + s)
+	}
+
+	var nilg *Graph
+	if errs := nilg.Validate(FromString("a")); len(errs) != 1 {
+		t.Error("Validate of nil graph:", errs)
+	}
+	if errs := g.Validate(nil); errs != nil {
+		t.Error("Validate with nil schema:", errs)
+	}
+}
+
+// eval.go
+
+func TestEvalCalcMod(t *testing.T) {
+
+	i := calc(11.0, 2.0, '%')
+
+	s := reflect.TypeOf(i).String()
+
+	if s != "float64" || i != 1.0 {
+		t.Error("Calc %", s, i)
+	}
+
+	tests := []struct {
+		v1, v2 interface{}
+		f      float64
+	}{
+		{7.5, 2.0, math.Mod(7.5, 2)},
+		{7.5, int64(2), math.Mod(7.5, 2)},
+		{int64(7), 2.5, math.Mod(7, 2.5)},
+		{-7.5, 2.0, math.Mod(-7.5, 2)},
+	}
+
+	for _, tt := range tests {
+		i := calc(tt.v1, tt.v2, '%')
+		if f, ok := i.(float64); !ok || f != tt.f {
+			t.Error("Calc % with floats", tt.v1, tt.v2, i)
+		}
+	}
+
+	if i := calc(int64(7), int64(2), '%'); i != int64(1) {
+		t.Error("Calc % with ints", i)
+	}
+}
+
+func TestEvalAssignMissing(t *testing.T) {
+
+	g := FromString("a 10\nempty")
+
+	tests := []struct {
+		expr, path string
+		value      int64
+	}{
+		{"a += 2", "a", 12},
+		{"a -= 4", "a", 8},
+		{"a *= 3", "a", 24},
+		{"x += 2", "x", 2},
+		{"y -= 2", "y", -2},
+		{"z *= 2", "z", 0},
+		{"empty += 5", "empty", 5},
+	}
+
+	for _, tt := range tests {
+		g.Eval(NewExpression(tt.expr))
+		if i := g.Get(tt.path).Int64(); i != tt.value {
+			t.Error("compound assignment", tt.expr, i)
+		}
+	}
+}
+
+func TestEvalAssignCompound(t *testing.T) {
+
+	g := FromString("a 10")
+
+	g.Eval(NewExpression("a += 5"))
+	if i := g.Get("a").Int64(); i != 15 {
+		t.Error("a += 5", g.Text())
+	}
+
+	tests := []struct {
+		expr string
+		text string
+	}{
+		{"a -= 3", "12"},
+		{"a *= 2", "24"},
+		{"a /= 5", "4"},
+		{"a %= 3", "1"},
+		{"a += 0.5", "1.5"},
+		{"b /= 2", "0"},
+		{"c %= 2", "0"},
+	}
+
+	for _, tt := range tests {
+		g.Eval(NewExpression(tt.expr))
+		if s := g.Get(tt.expr[:1]).String(); s != tt.text {
+			t.Error("compound assignment", tt.expr, s)
+		}
+	}
+}
+
+func TestEvalAssignDivideByZero(t *testing.T) {
+
+	g := FromString("a 10")
+
+	for _, e := range []string{"a /= 0", "a %= 0", "x /= 0", "y %= 0"} {
+		if r := g.Eval(NewExpression(e)); r != nil {
+			t.Error(e, r)
+		}
+	}
+
+	if g.Get("a").Int64() != 10 || g.Get("x") != nil || g.Get("y") != nil {
+		t.Error("division by zero modified the graph", g.Text())
+	}
+
+	if r := g.Eval(NewExpression("1/0")); r != nil {
+		t.Error("1/0", r)
+	}
+}
+
+func TestEvalPrecedence(t *testing.T) {
+
+	g := New()
+
+	tests := []struct {
+		expr  string
+		value interface{}
+	}{
+		{"2+3*4", int64(14)},
+		{"2+3*4 == 14", true},
+		{"2*3+4*5", int64(26)},
+		{"10-4-3", int64(3)},
+		{"8/2/2", int64(2)},
+		{"1+1==2 && 0<1", true},
+		{"1 < 2 || 1 > 2 && 0 > 1", true},
+		{"(2+3)*4", int64(20)},
+		{"2*(3+4)", int64(14)},
+		{"((1+2)*3)", int64(9)},
+		{"(2)", int64(2)},
+		{"(1 < 2 || 1 > 2) && 0 > 1", false},
+	}
+
+	for _, tt := range tests {
+		if v := g.Eval(NewExpression(tt.expr)); v != tt.value {
+			t.Error("precedence", tt.expr, v)
+		}
+	}
+}
+
+func TestEvalPower(t *testing.T) {
+
+	g := New()
+
+	if v := g.Eval(NewExpression("2**10")); v != int64(1024) {
+		t.Error("2**10", v)
+	}
+	if v := g.Eval(NewExpression("2.0**0.5")); v != math.Sqrt2 {
+		t.Error("2.0**0.5", v)
+	}
+	if v := g.Eval(NewExpression("2 ** -1")); v != 0.5 {
+		t.Error("2 ** -1", v)
+	}
+	if v := g.Eval(NewExpression("2**-1")); v != 0.5 {
+		t.Error("2**-1", v)
+	}
+	if v := g.Eval(NewExpression("2**-2*4")); v != 1.0 {
+		t.Error("2**-2*4", v)
+	}
+	if v := g.Eval(NewExpression("4 ** 0.5")); v != 2.0 {
+		t.Error("4 ** 0.5", v)
+	}
+	if v := g.Eval(NewExpression("3**0")); v != int64(1) {
+		t.Error("3**0", v)
+	}
+
+	// Higher precedence than * and right associative
+	if v := g.Eval(NewExpression("2*3**2")); v != int64(18) {
+		t.Error("2*3**2", v)
+	}
+	if v := g.Eval(NewExpression("2**3**2")); v != int64(512) {
+		t.Error("2**3**2", v)
+	}
+	if v := g.Eval(NewExpression("(2**3)**2")); v != int64(64) {
+		t.Error("(2**3)**2", v)
+	}
+}
+
+func TestEvalCalcStr(t *testing.T) {
+
+	i := calc("11.0-", 2.0, '+')
+
+	s := reflect.TypeOf(i).String()
+
+	if s != "string" || i != "11.0-2" {
+		t.Error("string with numbers")
+	}
+}
+
+func TestCompare(t *testing.T) {
+
+	b := compare(1, 1, '=')
+	if !b {
+		t.Error("compare =")
+	}
+	b = compare(1, 1.0, '=')
+	if !b {
+		t.Error("compare =")
+	}
+	b = compare(1.0, 1.0, '=')
+	if !b {
+		t.Error("compare =")
+	}
+
+	b = compare(1, 2, '<')
+	if !b {
+		t.Error("compare 3")
+	}
+	b = compare(1.0, 2, '<')
+	if !b {
+		t.Error("compare 4")
+	}
+
+	b = compare("a", "a", '=')
+	if !b {
+		t.Error("compare =")
+	}
+	b = compare("a", "a", '!')
+	if b {
+		t.Error("compare =")
+	}
+
+	b = compare(2, 1, '>')
+	if !b {
+		t.Error("compare >")
+	}
+	b = compare(2.0, 1.0, '>')
+	if !b {
+		t.Error("compare >")
+	}
+
+	// <=
+	b = compare(1, 2, '-')
+	if !b {
+		t.Error("compare <=")
+	}
+	b = compare(2, 2, '-')
+	if !b {
+		t.Error("compare <=")
+	}
+	b = compare(2.0, 2.0, '-')
+	if !b {
+		t.Error("compare <=")
+	}
+
+	// >=
+	b = compare(2, 1, '+')
+	if !b {
+		t.Error("compare >=")
+	}
+	b = compare(2, 2, '+')
+	if !b {
+		t.Error("compare >=")
+	}
+	b = compare(2.0, 2.0, '+')
+	if !b {
+		t.Error("compare >=")
+	}
+
+	// Cannot compare non numbers
+	b = compare("a", 1, '=')
+	if b {
+		t.Error("compare a string")
+	}
+	b = compare(1, "a", '=')
 	if b {
 		t.Error("compare a string")
 	}
-	b = compare(1, "a", '=')
-	if b {
-		t.Error("compare a string")
+
+	// !
+	b = compare(1, 2, '!')
+	if !b {
+		t.Error("compare !=")
+	}
+	b = compare(1, 1, '!')
+	if b {
+		t.Error("compare !=")
+	}
+	b = compare(1.0, 2.0, '!')
+	if !b {
+		t.Error("compare !=")
+	}
+	b = compare(1.0, 1.0, '!')
+	if b {
+		t.Error("compare !=")
+	}
+}
+
+func TestEvalPath1(t *testing.T) {
+
+	// Create a path and check it
+	path := NewPath("a")
+	s := path.Show()
+	if s != "!p\n  a" {
+		t.Error("NewPath", s)
+	}
+
+	g := New()
+	g.Add("a").Add("b")
+
+	i := g.evalPath(path)
+
+	if _show(i) != "_\n  b" {
+		t.Errorf("EvalPath\n[%s]\n", _show(i))
+	}
+
+	g = New()
+	g.Add("a").Add(1)
+
+	i = g.evalPath(path)
+	s = _typeOf(i)
+	if i != 1 || s != "int" {
+		t.Error("EvalPath 1", _show(i), _typeOf(i))
+	}
+
+	g = New()
+	g.Add("a").Add("id").Add("100")
+	i = g.evalPath(path)
+
+	if _text(i) != "id\n  100" || _typeOf(i) != "*ogdl.Graph" {
+		println(_show(i), _typeOf(i))
+		t.Error()
+	}
+}
+
+func TestEvalPath_Index2(t *testing.T) {
+
+	g := FromString("a\n b\n  c\n  d")
+
+	p := NewPath("a")
+	i := g.evalPath(p)
+	if _show(i) != "_\n  b\n    c\n    d" {
+		t.Error(_show(i))
+	}
+
+	p = NewPath("a[0]")
+	i = g.evalPath(p)
+	if _show(i) != "_\n  b\n    c\n    d" {
+		t.Error(_show(i))
+	}
+
+}
+
+func TestEvalPath_Index(t *testing.T) {
+	g := FromString("a\n b 1\n b 2")
+
+	p := NewPath("a.b[0]")
+
+	i := g.evalPath(p)
+
+	if _string(i) != "1" {
+		t.Error("EvalPath_Index", _string(i))
+	}
+
+	p = NewPath("a.b")
+
+	i = g.evalPath(p)
+
+	if _string(i) != "1" {
+		t.Error("EvalPath_Index", _string(i))
+	}
+
+	p = NewPath("a.b{1}")
+
+	i = g.evalPath(p)
+
+	if _string(i) != "2" {
+		t.Error("EvalPath_Selector", _text(i))
+	}
+
+	p = NewPath("a.b{}")
+
+	i = g.evalPath(p)
+
+	if _text(i) != "1\n2" {
+		t.Error("EvalPath_Selector", _text(i))
+	}
+}
+
+func TestEvalPath_Selector(t *testing.T) {
+
+	g := FromString("a\n b 1\n c 2\n b 3\ni 1\nj x")
+
+	// get is set if Get gives the same result: it does not evaluate
+	// expressions in selectors.
+	tests := []struct {
+		path, text string
+		get        bool
+	}{
+		{"a.b{0}", "1", true},
+		{"a.b{1}", "3", true},
+		{"a.b{}", "1\n3", true},
+		{"a.b{i}", "3", false},
+	}
+
+	for _, tt := range tests {
+		r := g.Eval(NewPath(tt.path))
+		if _text(r) != tt.text {
+			t.Error("Eval selector", tt.path, _text(r))
+		}
+		if tt.get && g.Get(tt.path).Text() != tt.text {
+			t.Error("Get and Eval differ", tt.path)
+		}
+	}
+
+	for _, p := range []string{"a.b{2}", "a.b{j}", "a.c{1}", "a.x{}"} {
+		if r := g.Eval(NewPath(p)); r != nil {
+			t.Error("Eval selector out of range", p, _text(r))
+		}
+	}
+}
+
+func TestEvalScalar(t *testing.T) {
+
+	g := New()
+	p := New("1")
+
+	// constants
+	i := g.Eval(p)
+	s := reflect.TypeOf(i).String()
+	if i != int64(1) || s != "int64" {
+		t.Error("Eval constant")
+	}
+
+	p = New("1.1")
+	i = g.Eval(p)
+	s = reflect.TypeOf(i).String()
+	if i != float64(1.1) || s != "float64" {
+		t.Error("Eval constant int")
+	}
+
+	p = New(1.1)
+	i = g.Eval(p)
+	s = reflect.TypeOf(i).String()
+	if i != float64(1.1) || s != "float64" {
+		t.Error("Eval constant float")
+	}
+
+	p = New('c')
+	i = g.Eval(p)
+	s = reflect.TypeOf(i).String()
+	if i != int64('c') || s != "int64" {
+		t.Error("Eval constant char")
+	}
+
+	p = New("true")
+	i = g.Eval(p)
+	s = reflect.TypeOf(i).String()
+	if i != true || s != "bool" {
+		t.Error("Eval constant bool")
+	}
+
+	p = New(true)
+	i = g.Eval(p)
+	s = reflect.TypeOf(i).String()
+	if i != true || s != "bool" {
+		t.Error("Eval constant bool 2")
+	}
+}
+
+// TestEvalArgOfGraph tests the following situation:
+//
+//    $a(b)
+//
+// where a is a graph and b is a variable containing a path
+//
+func TestEvalArgOfGraph(t *testing.T) {
+
+	g := New()
+	g.Add("a").Add("c").Add(int64(1))
+	g.Add("b").Add("c")
+
+	p := NewPath("a.(b)")
+	r := g.Eval(p)
+
+	ty := _typeOf(r)
+
+	if ty != "int64" || r != int64(1) {
+		t.Errorf("a(b): %s %v", ty, r)
+	}
+}
+
+func TestEvalExpression(t *testing.T) {
+
+	// The context
+	g := FromString("a b")
+
+	// 'a' is a string constant
+	p := NewExpression("a=='b'")
+	r := g.Eval(p)
+
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("a=='b'")
+	}
+
+	p = NewExpression("'a'!='b'")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("'a'!='b'")
+	}
+
+	p = NewExpression("2>1")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("'a'!='b'")
+	}
+	p = NewExpression("2>=2")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("'a'!='b'")
+	}
+	p = NewExpression("1<2")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("'a'!='b'")
+	}
+	p = NewExpression("1<=2")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("'a'!='b'")
+	}
+	p = NewExpression("1<0")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != false {
+		t.Error("'a'!='b'")
+	}
+
+	// logic
+	e := "'false' || 'true'"
+	p = NewExpression(e)
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error(e)
+	}
+	e = "'true' && 'true'"
+	p = NewExpression(e)
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error(e)
+	}
+
+	// Assign
+	g = New()
+	e = "a=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, err := g.GetInt64("a"); i != 1 || err != nil {
+		t.Error(e, _typeOf(i), _text(i), err.Error())
+	}
+
+	e = "a+=12"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("a"); i != 13 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	e = "a-=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("a"); i != 12 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	e = "a*=2"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("a"); i != 24 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	e = "a/=4"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("a"); i != 6 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	e = "a%=4"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("a"); i != 2 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	// b non existent
+	e = "b+=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("b"); i != 1 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	// c non existent
+	e = "c-=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("c"); i != -1 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	// d non existent
+	e = "d*=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("d"); i != 0 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	// e non existent
+	e = "e/=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, err := g.GetInt64("e"); i != 0 || err != nil {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	e = "1+2"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != int64(3) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "1+2.0"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != float64(3) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "1.0+2.0"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != float64(3) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "2-4"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != int64(-2) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "10*3"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != int64(30) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "10.0*3"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != float64(30) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "10*3.0"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != float64(30) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "10/3"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != int64(3) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "10%3"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != int64(1) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+}
+
+func TestEvalBool(t *testing.T) {
+
+	g := New()
+	g.Add("a").Add(1)
+
+	p := NewExpression("1=='1'")
+	r := g.evalBool(p)
+	if r != true {
+		t.Error("1=='1'")
+	}
+
+	p = NewExpression("true")
+	r = g.evalBool(p)
+	if r != false {
+		t.Error("true as a path")
+	}
+
+	p = NewExpression("'true'")
+	r = g.evalBool(p)
+	if r != true {
+		t.Error("'true' keyword")
+	}
+}
+
+func TestEvalNullSafe(t *testing.T) {
+
+	p := NewPath("a?.b.c")
+	if p.Show() != "!p\n  a\n  !?\n  b\n  c" {
+		t.Error("null-safe path\n", p.Show())
+	}
+
+	g := FromString("a\n  b\n    c 1\n  x y")
+
+	r := g.Eval(NewPath("a?.b?.c"))
+	if _text(r) != "1" {
+		t.Error("a?.b?.c", _text(r))
+	}
+
+	r = g.Eval(NewPath("a?.z?.c"))
+	if r != nil {
+		t.Error("a?.z?.c should be nil", r)
+	}
+
+	r = g.Eval(NewPath("z?.b"))
+	if r != nil {
+		t.Error("z?.b should be nil", r)
+	}
+
+	r = g.Eval(NewPath("a[5]?.b"))
+	if r != nil {
+		t.Error("a[5]?.b should be nil", r)
+	}
+
+	r = g.Eval(NewExpression("a?.x?.c"))
+	if r != nil {
+		t.Error("expression a?.x?.c should be nil", r)
+	}
+
+	if g.Get("a?.b?.c").String() != "1" || g.Get("a?.z?.c") != nil {
+		t.Error("Get with ?.")
+	}
+}
+
+func TestEvalMatch(t *testing.T) {
+
+	g := FromString("name joe\nid a-123")
+
+	r := g.Eval(NewExpression("name =~ '^j.e$'"))
+	if r != true {
+		t.Error("=~ match", r)
+	}
+
+	r = g.Eval(NewExpression("id =~ '^[0-9]+$'"))
+	if r != false {
+		t.Error("=~ no match", r)
+	}
+
+	r = g.Eval(NewExpression("id !~ '^[0-9]+$'"))
+	if r != true {
+		t.Error("!~", r)
+	}
+
+	r = g.Eval(NewExpression("'abc' =~ 'b' && name !~ 'x'"))
+	if r != true {
+		t.Error("=~ with &&", r)
+	}
+
+	r = g.Eval(NewExpression("name =~ '(j'"))
+	if _, ok := r.(error); !ok {
+		t.Error("=~ with an invalid regexp should return an error", r)
+	}
+}
+
+func TestCompareStrings(t *testing.T) {
+
+	tests := []struct {
+		s1, s2 string
+		op     int
+		r      bool
+	}{
+		{"a", "b", '<', true},
+		{"b", "a", '<', false},
+		{"b", "a", '>', true},
+		{"a", "a", '<', false},
+		{"a", "a", '+', true},
+		{"a", "a", '-', true},
+		{"a", "ab", '<', true},
+		{"ab", "a", '>', true},
+		{"ab", "a", '-', false},
+		{"", "a", '<', true},
+		{"v1.10", "v1.9", '<', true},
+	}
+
+	for _, tt := range tests {
+		if compare(tt.s1, tt.s2, tt.op) != tt.r {
+			t.Errorf("compare(%q, %q, %c) should be %v", tt.s1, tt.s2, tt.op, tt.r)
+		}
+	}
+
+	// Numbers are compared as numbers
+	if !compare(int64(9), int64(10), '<') || !compare(9.5, 10.0, '<') {
+		t.Error("numeric comparison")
+	}
+
+	g := New()
+	if g.Eval(NewExpression("'v2' > 'v10'")) != true || g.Eval(NewExpression("'a' < 'b'")) != true {
+		t.Error("string ordering in expressions")
+	}
+}
+
+func TestEvalFilter(t *testing.T) {
+
+	g := FromString("a 3\nb 10\nc\n  d 1\n  e 2\nv 1.10\nname x\nversion v2")
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"a < b", true},
+		{"b > a", true},
+		{"a == 3.0", true},
+		{"3 < b", true},
+		{"name == 'x'", true},
+		{"version > 'v10'", true},
+		{"c == 1", false},
+		{"c != 1", true},
+		{"v == 1.1", true},
+		{"missing == 1", false},
+		{"a > 1 && b >= 5", true},
+		{"a > 5 || name != 'x'", false},
+		{"a > 1 ? b > 5 : false", true},
+	}
+
+	for _, tt := range tests {
+		if r := g.evalFilter(NewExpression(tt.expr)); r != tt.want {
+			t.Error(tt.expr, r)
+		}
+	}
+
+	// Outside filters, paths are not reduced to their value
+	if g.Eval(NewExpression("a < b")) == true {
+		t.Error("path compared by value outside a filter")
+	}
+}
+
+func TestCompareQuiet(t *testing.T) {
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+
+	g := FromString("a 1\nb x")
+	for _, e := range []string{"a == 1", "a != 2", "a < 3", "a >= 1", "b == 'x'", "1 > 2"} {
+		g.Eval(NewExpression(e))
+	}
+
+	os.Stdout = stdout
+	w.Close()
+
+	var buf bytes.Buffer
+	buf.ReadFrom(r)
+	r.Close()
+
+	if buf.Len() != 0 {
+		t.Error("comparisons write to stdout", buf.String())
+	}
+}
+
+func TestOperator(t *testing.T) {
+
+	e := NewExpression("1+2")
+	if op, ok := e.Out[0].Operator(); !ok || op != "+" {
+		t.Error("Operator of +", op, ok)
+	}
+
+	e = NewExpression("a == -2")
+	if op, ok := e.Out[0].Operator(); !ok || op != "==" {
+		t.Error("Operator of ==", op, ok)
+	}
+	if _, ok := e.Out[0].Out[0].Operator(); ok {
+		t.Error("Operator of a path")
+	}
+	if _, ok := e.Out[0].Out[1].Operator(); ok {
+		t.Error("Operator of a negative number")
+	}
+
+	e = NewExpression("!a")
+	if op, ok := e.Out[0].Operator(); !ok || op != "!" {
+		t.Error("Operator of unary !", op, ok)
+	}
+
+	if _, ok := NewPath("a.b").Operator(); ok {
+		t.Error("Operator of a path node")
+	}
+}
+
+func TestEvalConditional(t *testing.T) {
+
+	g := FromString("a 2\nb -1")
+
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"2 > 0 ? 'pos' : 'neg'", "pos"},
+		{"-1 > 0 ? 'pos' : 'neg'", "neg"},
+		{"2>0?1:2", "1"},
+		{"2 > 0 ? -1 > 0 ? 1 : 2 : 3", "2"},
+		{"-1 > 0 ? 1 : 2 > 5 ? 2 : 3", "3"},
+		{"1 == 1 || 0 > 1 ? 10 : 20", "10"},
+		{"(2 > 0 ? 1 : 2) + 10", "11"},
+	}
+
+	for _, test := range tests {
+		if s := _string(g.Eval(NewExpression(test.expr))); s != test.want {
+			t.Errorf("%s: got %q, want %q", test.expr, s, test.want)
+		}
+	}
+
+	// Only the branch taken is evaluated.
+	g.Eval(NewExpression("2 > 0 ? x = 1 : y = 2"))
+	if g.Get("x").Int64() != 1 || g.Node("y") != nil {
+		t.Error("conditional evaluated the wrong branch:\n" + g.Text())
+	}
+
+	g.Eval(NewExpression("z = -1 > 0 ? 5 : 6"))
+	if g.Get("z").Int64() != 6 {
+		t.Error("assignment of conditional failed:\n" + g.Text())
+	}
+}
+
+// Get types
+
+func TestGetTypes(t *testing.T) {
+
+	g := FromString("aa, ab, bb, axx, aj, vv")
+	r, _ := g.Find("a[a-b]")
+
+	if r.Len() != 2 || r.Text() != "aa\nab" {
+		t.Error("Find(regex)")
+	}
+
+	g = FromString("111")
+	if g.Int64() != 111 {
+		t.Error("Int64")
+	}
+
+	g = FromString("111.1")
+	if g.Float64() != 111.1 {
+		t.Error("Float64")
+	}
+
+	g = New()
+	g.Add(float32(111.2))
+	if g.Float64() != 111.2 {
+		t.Error("Float64")
+	}
+
+	g = FromString("true")
+	if g.Bool() != true {
+		t.Error("Bool")
+	}
+
+	g = FromString("a 1")
+	if i, _ := g.GetInt64("a"); i != 1 {
+		t.Error("GetInt64")
+	}
+
+	g = FromString("a 1.1")
+	if i, _ := g.GetFloat64("a"); i != 1.1 {
+		t.Error("GetFloat64")
+	}
+
+	g = FromString("a 'false'")
+	if i, err := g.GetBool("a"); err != nil || i != false {
+		t.Error("GetBool")
+	}
+
+	g = FromString("a 'text'")
+	if i, err := g.GetBytes("a"); err != nil || len(i) != 4 {
+		t.Error("GetBytes", len(i))
+	}
+}
+
+func TestIsInteger(t *testing.T) {
+	ss := [...]string{"-1", "2", "9.1", " 14", " - 1", " -1 ", "a", "3a", ""}
+	rr := [...]bool{true, true, false, true, false, true, false, false, false}
+
+	for i, s := range ss {
+		b := isInteger(s)
+		if b != rr[i] {
+			t.Error("IsInteger() failed")
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+
+	g := FromString("text \\\n  line 1\n  line 2\n  line 3\nname bob")
+
+	l := g.Lines("text")
+	if len(l) != 3 || l[0] != "line 1" || l[2] != "line 3" {
+		t.Error("Lines on block", len(l), l)
+	}
+
+	l = g.Lines("name")
+	if len(l) != 1 || l[0] != "bob" {
+		t.Error("Lines on single line", l)
+	}
+
+	l = g.Lines("none")
+	if l == nil || len(l) != 0 {
+		t.Error("Lines on missing path", l)
+	}
+
+	g = New()
+	g.Add("empty").Add("")
+	if len(g.Lines("empty")) != 0 {
+		t.Error("Lines on empty leaf")
+	}
+}
+
+func TestInt64Trim(t *testing.T) {
+
+	g := New()
+	g.Add(" 42 ")
+	if g.Int64() != 42 {
+		t.Error("Int64 with spaces", g.Int64())
+	}
+
+	g = New()
+	g.Add("+7")
+	if g.Int64() != 7 {
+		t.Error("Int64 with + sign", g.Int64())
+	}
+
+	g = New()
+	g.Add("4 2")
+	if g.Int64() != 0 || g.Int64(-1) != -1 {
+		t.Error("Int64 of a non number", g.Int64())
+	}
+
+	// Index given as a string with spaces
+	g = New()
+	g.set(&Graph{TypePath, []*Graph{{"a", nil}, {TypeIndex, []*Graph{{" 1 ", nil}}}}}, "x")
+	if g.Get("a").Len() != 2 || g.Get("a[1]").Unwrap().ThisString() != "x" {
+		t.Error("set with index given as string", g.Show())
+	}
+}
+
+func TestScalar(t *testing.T) {
+
+	g := New()
+	g.Add("42")
+	if v := g.Scalar(); v != int64(42) {
+		t.Error("Scalar of a numeric string", _typeOf(v), v)
+	}
+
+	g = New()
+	g.Add(int64(7))
+	if v := g.Scalar(); v != int64(7) {
+		t.Error("Scalar of an int64", _typeOf(v), v)
+	}
+
+	g = New()
+	g.Add([]byte("abc"))
+	if v, ok := g.Scalar().([]byte); !ok || string(v) != "abc" {
+		t.Error("Scalar of []byte", _typeOf(g.Scalar()))
+	}
+
+	g = New()
+	g.Add([]byte("true"))
+	if v := g.Scalar(); v != true {
+		t.Error("Scalar of []byte bool", _typeOf(v))
+	}
+
+	g = New()
+	g.Add("1.50")
+	if s := g.ScalarString(); s != "1.5" {
+		t.Error("ScalarString", s)
+	}
+
+	if v := New("3").ThisScalar(); v != int64(3) {
+		t.Error("ThisScalar", _typeOf(v))
+	}
+
+	g = nil
+	if g.Scalar() != nil || g.ScalarString() != "" || New().Scalar() != nil {
+		t.Error("Scalar of nil")
+	}
+}
+
+func TestStringContract(t *testing.T) {
+
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{"abc", "abc"},
+		{[]byte("xyz"), "xyz"},
+		{int64(80), "80"},
+		{int64(-3), "-3"},
+		{1.5, "1.5"},
+		{2.0, "2"},
+		{true, "true"},
+		{false, "false"},
+	}
+
+	for _, test := range tests {
+		g := New("key")
+		g.Add(test.v)
+		if s := g.String(); s != test.want {
+			t.Errorf("String of %#v: got %q, want %q", test.v, s, test.want)
+		}
+		if s := g.Out[0].ThisString(); s != test.want {
+			t.Errorf("ThisString of %#v: got %q, want %q", test.v, s, test.want)
+		}
+		if s := g.ThisString(); s != "key" {
+			t.Errorf("ThisString should be the node itself: %q", s)
+		}
+	}
+
+	g := New("key")
+	if g.String() != "" || g.String("def") != "" {
+		t.Error("String without subnodes should be empty")
+	}
+	g.Add(nil)
+	if g.String() != "" {
+		t.Error("String of nil content should be empty")
+	}
+
+	var nilg *Graph
+	if nilg.String() != "" || nilg.String("def") != "def" || nilg.ThisString("def") != "def" {
+		t.Error("String of nil graph")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+
+	tests := []struct {
+		in, want interface{}
+	}{
+		{"42", int64(42)},
+		{"-3", int64(-3)},
+		{"1.5", 1.5},
+		{"true", true},
+		{"false", false},
+		{"abc", "abc"},
+		{"12abc", "12abc"},
+		{"", ""},
+		{int(5), int64(5)},
+		{uint8(5), int64(5)},
+		{int32(-5), int64(-5)},
+		{float32(0.5), 0.5},
+		{true, true},
+		{nil, nil},
+	}
+
+	for _, test := range tests {
+		if v := Normalize(test.in); v != test.want {
+			t.Errorf("Normalize(%#v): got %#v, want %#v", test.in, v, test.want)
+		}
+	}
+
+	if v := Normalize([]byte("7")); v != int64(7) {
+		t.Errorf("Normalize of numeric []byte: %#v", v)
+	}
+	if v, ok := Normalize([]byte("x")).([]byte); !ok || string(v) != "x" {
+		t.Errorf("Normalize of []byte: %#v", v)
+	}
+}
+
+func TestGetValue(t *testing.T) {
+
+	g := FromString("server\n  port 8080\n  on true\n  hosts\n    a\n    b\nname")
+
+	if v := g.GetValue("server.port"); v != int64(8080) {
+		t.Error("GetValue of a nested value", _typeOf(v), v)
+	}
+
+	if v := g.GetValue("server.on"); v != true {
+		t.Error("GetValue of a bool", _typeOf(v), v)
+	}
+
+	if v := g.GetValue("server.hosts[1]"); v != "b" {
+		t.Error("GetValue of an index", v)
+	}
+
+	if v := g.GetValue("name"); v != "name" {
+		t.Error("GetValue of a leaf", v)
+	}
+
+	if v := g.GetValue("server.hosts"); v != "hosts" {
+		t.Error("GetValue of a node with several subnodes", v)
+	}
+
+	if v := g.GetValue("none"); v != nil {
+		t.Error("GetValue of a missing path", v)
+	}
+}
+
+func TestThisTyped(t *testing.T) {
+
+	g := FromString("i 42\nf 1.5\nb true\nx abc\nn -7")
+
+	if i, ok := g.Get("i").Out[0].ThisInt64(); !ok || i != 42 {
+		t.Error("ThisInt64 of parsed text", i, ok)
+	}
+	if i, ok := g.Get("n").Out[0].ThisInt64(); !ok || i != -7 {
+		t.Error("ThisInt64 of negative number", i, ok)
+	}
+	if _, ok := g.Get("x").Out[0].ThisInt64(); ok {
+		t.Error("ThisInt64 of text should fail")
+	}
+
+	if f, ok := g.Get("f").Out[0].ThisFloat64(); !ok || f != 1.5 {
+		t.Error("ThisFloat64 of parsed text", f, ok)
+	}
+	if f, ok := g.Get("i").Out[0].ThisFloat64(); !ok || f != 42 {
+		t.Error("ThisFloat64 of integer text", f, ok)
+	}
+	if _, ok := g.Get("x").Out[0].ThisFloat64(); ok {
+		t.Error("ThisFloat64 of text should fail")
+	}
+
+	if b, ok := g.Get("b").Out[0].ThisBool(); !ok || !b {
+		t.Error("ThisBool of parsed text", b, ok)
+	}
+	if _, ok := g.Get("x").Out[0].ThisBool(); ok {
+		t.Error("ThisBool of text should fail")
+	}
+
+	if string(g.Get("x").Out[0].ThisBytes()) != "abc" || g.Get("x").Out[0].ThisString() != "abc" {
+		t.Error("ThisBytes and ThisString of parsed text")
+	}
+
+	// Native types
+	n := New()
+	n.Add(int64(3))
+	n.Add(2.5)
+	n.Add(false)
+	if i, ok := n.Out[0].ThisInt64(); !ok || i != 3 {
+		t.Error("ThisInt64 of int64", i, ok)
+	}
+	if f, ok := n.Out[1].ThisFloat64(); !ok || f != 2.5 {
+		t.Error("ThisFloat64 of float64", f, ok)
+	}
+	if b, ok := n.Out[2].ThisBool(); !ok || b {
+		t.Error("ThisBool of bool", b, ok)
+	}
+
+	var nilGraph *Graph
+	if _, ok := nilGraph.ThisInt64(); ok {
+		t.Error("ThisInt64 of nil graph")
+	}
+	if _, ok := nilGraph.ThisFloat64(); ok {
+		t.Error("ThisFloat64 of nil graph")
+	}
+	if _, ok := nilGraph.ThisBool(); ok {
+		t.Error("ThisBool of nil graph")
+	}
+	if nilGraph.ThisBytes() != nil {
+		t.Error("ThisBytes of nil graph")
+	}
+}
+
+// interface conversion to native types
+
+func TestI2string(t *testing.T) {
+
+	var i interface{}
+
+	i = "2.2"
+
+	s := _string(i)
+	ty := reflect.TypeOf(s).String()
+
+	if ty != "string" {
+		t.Error("should return a string")
+	}
+
+	i = 1.1
+
+	s = _string(i)
+	ty = reflect.TypeOf(s).String()
+
+	if ty != "string" {
+		t.Error("should return a string")
+	}
+}
+
+// Templates
+
+func TestTemplateIndex(ts *testing.T) {
+	// Context
+	g := FromString("space\n  design\n    doc1\n    doc2")
+
+	t := NewTemplate("$space")
+
+	s := t.Process(g)
+
+	t = NewTemplate("$space[0]")
+
+	s2 := t.Process(g)
+
+	if string(s) != "design\n  doc1\n  doc2" {
+		ts.Errorf("\n[%s]\n", string(s))
+	}
+
+	if string(s2) != "doc1\ndoc2" {
+		ts.Errorf("\n[%s]\n", string(s2))
+	}
+}
+
+func TestTemplate1(ts *testing.T) {
+	// Context
+	g := New()
+	g.Add("b").Add(1)
+
+	t := NewTemplate("a $b")
+
+	s := t.Process(g)
+
+	if string(s) != "a 1" {
+		ts.Error("template", string(s))
+	}
+}
+
+func TestTemplateOperatorConfusion(ts *testing.T) {
+	// Context
+	g := New()
+	g.Add("b").Add(1)
+
+	t := NewTemplate("$(a='/') $a $b")
+
+	s := t.Process(g)
+
+	if string(s) != " / 1" {
+		ts.Error("template", string(s))
+	}
+}
+
+func TestTemplateIfEmptyString(ts *testing.T) {
+	// Context
+	g := New()
+	g.Add("b").Add("")
+
+	t := NewTemplate("$if(b=='') text $end")
+
+	s := t.Process(g)
+
+	if string(s) != " text " {
+		ts.Error("template", string(s))
+	}
+}
+
+func TestTemplateIf(ts *testing.T) {
+	// Context
+	g := New()
+
+	t := NewTemplate("$if('false') a $else b $end")
+
+	s := t.Process(g)
+	if string(s) != " b " {
+		ts.Error("template")
 	}
 
-	// !
-	b = compare(1, 2, '!')
-	if !b {
-		t.Error("compare !=")
+	t = NewTemplate("$if('true') a $else b $end")
+	s = t.Process(g)
+	if string(s) != " a " {
+		ts.Error("template")
 	}
-	b = compare(1, 1, '!')
-	if b {
-		t.Error("compare !=")
+}
+
+func TestTemplateFor(ts *testing.T) {
+	// Context
+	g := New()
+	c := g.Add("b")
+	c.Add(1)
+	c.Add(2)
+
+	t := NewTemplate("$b\n---\n$for(a,b) [$a] $end")
+
+	s := t.Process(g)
+	if string(s) != "1\n2\n---\n [1]  [2] " {
+		ts.Errorf("template\n%s", string(s))
 	}
-	b = compare(1.0, 2.0, '!')
-	if !b {
-		t.Error("compare !=")
+
+	// The variable
+	g = FromString("result\n  item id 0\n  item id 1")
+
+	t = NewTemplate("$for(a,result) $a.item.id $end")
+
+	s = t.Process(g)
+	if string(s) != " 0  1 " {
+		ts.Error("template: " + string(s))
+		println(g.Show())
 	}
-	b = compare(1.0, 1.0, '!')
-	if b {
-		t.Error("compare !=")
+}
+
+// function.go
+
+func TestFunction3(ts *testing.T) {
+	// Context
+	g := New()
+
+	t := NewTemplate("$(R.y='h')$(R.x0='user')")
+	t.Process(g)
+
+	t = NewTemplate("$R")
+	b := t.Process(g)
+
+	if string(b) != "y\n  h\nx0\n  user" {
+		ts.Error("Template processing of variable", string(b))
 	}
+
+	t = NewTemplate("$T(R)")
+	b = t.Process(g)
+
+	/*
+
+		println(t.Show())
+		b := t.Process(g)
+
+		if string(b) != "Title: A nice title" {
+			ts.Error("function T", string(b))
+		} */
 }
 
-func TestEvalPath1(t *testing.T) {
+type Math struct {
+}
 
-	// Create a path and check it
-	path := NewPath("a")
-	s := path.Show()
-	if s != "!p\n  a" {
-		t.Error("NewPath", s)
+func (*Math) Sin(x float64) float64 {
+	return math.Sin(x)
+}
+
+func Sin(x float64) float64 {
+	return math.Sin(x)
+}
+
+func TestFunction2b(t *testing.T) {
+
+	g := New()
+	f := g.Add("math")
+	f.Add(&Math{})
+
+	path := NewPath("math.Sin(1.0)")
+
+	i := g.Eval(path)
+	s := _typeOf(i)
+	v := _string(i)[:10]
+
+	if s != "float64" || v != "0.84147098" {
+		t.Error("math.Sin()", s, v, i)
 	}
+}
+
+func TestFunction2c(t *testing.T) {
 
 	g := New()
-	g.Add("a").Add("b")
+	f := g.Add("Sin")
+	f.Add(Sin)
 
-	i := g.evalPath(path)
+	path := NewPath("Sin(1.0)")
 
-	if _show(i) != "_\n  b" {
-		t.Errorf("EvalPath\n[%s]\n", _show(i))
+	i := g.Eval(path)
+	s := _typeOf(i)
+	v := _string(i)[:10]
+
+	if s != "float64" || v != "0.84147098" {
+		t.Error("Sin()", s, v)
 	}
+}
 
-	g = New()
-	g.Add("a").Add(1)
+// log.go
 
-	i = g.evalPath(path)
-	s = _typeOf(i)
-	if i != 1 || s != "int" {
-		t.Error("EvalPath 1", _show(i), _typeOf(i))
+func TestLog(t *testing.T) {
+
+	file := "/tmp/log.gb"
+
+	log, _ := OpenLog(file)
+
+	g := FromString("a b, c, d")
+	b := g.Binary()
+
+	n := log.Add(g)
+	m := log.Add(g)
+	o := log.AddBinary(b)
+
+	if n != 0 || m != 16 || o != 32 {
+		t.Error("log.Add", o)
 	}
 
-	g = New()
-	g.Add("a").Add("id").Add("100")
-	i = g.evalPath(path)
+	g2, n2, _ := log.Get(0)
+	g3, n3, _ := log.Get(n2)
+	b2, _, _ := log.GetBinary(n3)
 
-	if _text(i) != "id\n  100" || _typeOf(i) != "*ogdl.Graph" {
-		println(_show(i), _typeOf(i))
-		t.Error()
+	g4 := FromBinary(b2)
+
+	if !g.Equals(g2) {
+		t.Error("n!=n2")
+	}
+
+	if !g.Equals(g3) {
+		t.Error("n!=n3")
+	}
+
+	if !g.Equals(g4) {
+		t.Error("n!=n3")
 	}
+
+	log.Sync()
+
+	log.Close()
+
+	os.Remove(file)
 }
 
-func TestEvalPath_Index2(t *testing.T) {
+// builtins.go
 
-	g := FromString("a\n b\n  c\n  d")
+func TestBuiltinStringFunctions(t *testing.T) {
 
-	p := NewPath("a")
-	i := g.evalPath(p)
-	if _show(i) != "_\n  b\n    c\n    d" {
-		t.Error(_show(i))
+	g := FromString("name bob\nitems\n  a\n  b")
+
+	r := g.Eval(NewExpression("upper(\"ab\")"))
+	if r != "AB" {
+		t.Error("upper", r)
 	}
 
-	p = NewPath("a[0]")
-	i = g.evalPath(p)
-	if _show(i) != "_\n  b\n    c\n    d" {
-		t.Error(_show(i))
+	r = g.Eval(NewExpression("lower('AB')"))
+	if r != "ab" {
+		t.Error("lower", r)
+	}
+
+	r = g.Eval(NewExpression("len(\"abc\")"))
+	if r != int64(3) {
+		t.Error("len", _typeOf(r), r)
+	}
+
+	r = g.Eval(NewExpression("contains(\"hello\", \"ell\")"))
+	if r != true {
+		t.Error("contains", r)
+	}
+
+	r = g.Eval(NewExpression("contains('hello', 'x')"))
+	if r != false {
+		t.Error("contains", r)
 	}
 
+	r = g.Eval(NewExpression("split('a,b,c', ',')"))
+	if _text(r) != "a\nb\nc" {
+		t.Error("split", _text(r))
+	}
+
+	// Path arguments
+	r = g.Eval(NewExpression("upper(name)"))
+	if r != "BOB" {
+		t.Error("upper(path)", r)
+	}
+
+	r = g.Eval(NewExpression("len(items)"))
+	if r != int64(2) {
+		t.Error("len(path)", r)
+	}
 }
 
-func TestEvalPath_Index(t *testing.T) {
-	g := FromString("a\n b 1\n b 2")
+// env.go
 
-	p := NewPath("a.b[0]")
+func TestEnvFile(t *testing.T) {
 
-	i := g.evalPath(p)
+	g := FromString("db\n  host localhost\n  port 5432\n  user.name 'joe doe'\nhosts\n  a\n  b\nname \"it's\"")
 
-	if _string(i) != "1" {
-		t.Error("EvalPath_Index", _string(i))
+	s := g.EnvFile()
+	r := "DB_HOST=localhost\nDB_PORT=5432\nDB_USER_NAME='joe doe'\nHOSTS_0=a\nHOSTS_1=b\nNAME='it'\\''s'\n"
+
+	if s != r {
+		t.Errorf("EnvFile\n%s", s)
 	}
+}
 
-	p = NewPath("a.b")
+func TestBuiltinAggregates(t *testing.T) {
 
-	i = g.evalPath(p)
+	g := FromString("items\n  price 10\n  price 25\n  price 5\n  name x")
+
+	r := g.Eval(NewExpression("sum(items.price)"))
+	if r != int64(40) {
+		t.Error("sum", _typeOf(r), r)
+	}
+
+	r = g.Eval(NewExpression("max(items.price)"))
+	if r != int64(25) {
+		t.Error("max", _typeOf(r), r)
+	}
+
+	r = g.Eval(NewExpression("min(items.price)"))
+	if r != int64(5) {
+		t.Error("min", _typeOf(r), r)
+	}
+
+	r = g.Eval(NewExpression("count(items.price)"))
+	if r != int64(3) {
+		t.Error("count", _typeOf(r), r)
+	}
+
+	// A list of records with repeated keys
+	g = FromString("items\n  item\n    price 1.5\n  item\n    price 2.5\n  item\n    price 5")
+
+	r = g.Eval(NewExpression("sum(items.item.price)"))
+	if r != 9.0 {
+		t.Error("sum of records", _typeOf(r), r)
+	}
+
+	r = g.Eval(NewExpression("avg(items.item.price)"))
+	if r != 3.0 {
+		t.Error("avg of records", _typeOf(r), r)
+	}
+
+	r = g.Eval(NewExpression("max(items.item.price)"))
+	if r != int64(5) {
+		t.Error("max of records", _typeOf(r), r)
+	}
+
+	r = g.Eval(NewExpression("max(none)"))
+	if r != nil {
+		t.Error("max of nothing", r)
+	}
+}
+
+// encoding.go
+
+func TestFromJSON(t *testing.T) {
+
+	g, err := FromJSON([]byte(`{"db": {"host": "localhost", "port": 5432, "ssl": true}, "name": "x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Get("db.host").String() != "localhost" || g.Get("db.port").Float64() != 5432 || !g.Get("db.ssl").Bool() {
+		t.Error("FromJSON nested object\n" + g.Text())
+	}
+	if g.Text() != "db\n  host\n    localhost\n  port\n    5432\n  ssl\n    true\nname\n  x" {
+		t.Error("FromJSON nested object\n" + g.Text())
+	}
+	if _, ok := g.Get("db.port").Out[0].This.(float64); !ok {
+		t.Error("FromJSON numbers should be float64")
+	}
+
+	g, err = FromJSON([]byte(`{"items": [{"id": 1, "tags": ["a", "b"]}, {"id": 2}], "list": [1, 2]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Get("items").Len() != 2 || g.Get("items[1].id").String() != "2" || g.Get("items[0].tags").Len() != 2 {
+		t.Error("FromJSON array of objects\n" + g.Show())
+	}
+	if g.Get("list").Len() != 2 || g.Get("list[1]").Unwrap().ThisString() != "2" {
+		t.Error("FromJSON array of scalars\n" + g.Show())
+	}
+
+	g, err = FromJSON([]byte(`{"a": null, "b": [1, null]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := g.Get("a"); n.Len() != 1 || n.Out[0].This != nil {
+		t.Error("FromJSON null value\n" + g.Show())
+	}
+	if n := g.Get("b"); n.Len() != 2 || n.Out[1].This != nil {
+		t.Error("FromJSON null in array\n" + g.Show())
+	}
 
-	if _string(i) != "1" {
-		t.Error("EvalPath_Index", _string(i))
+	if _, err = FromJSON([]byte(`{"a": `)); err == nil {
+		t.Error("FromJSON should fail on invalid JSON")
 	}
+}
 
-	p = NewPath("a.b{1}")
+func TestToJSON(t *testing.T) {
 
-	i = g.evalPath(p)
+	docs := []string{
+		`{"db":{"host":"localhost","port":5432,"ssl":true},"name":"x"}`,
+		`{"items":[{"id":1,"tags":["a","b"]},{"id":2}],"list":[1,2.5,"c"]}`,
+		`{"a":null,"b":[1,null],"c":{"d":{"e":false}}}`,
+		`[{"a":1},{"b":[1,2]}]`,
+		`"x"`,
+	}
 
-	if _string(i) != "2" {
-		t.Error("EvalPath_Selector", _text(i))
+	for _, doc := range docs {
+		g, err := FromJSON([]byte(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := g.ToJSON()
+		if err != nil {
+			t.Error("ToJSON", doc, err)
+			continue
+		}
+
+		var v1, v2 interface{}
+		json.Unmarshal([]byte(doc), &v1)
+		if err = json.Unmarshal(b, &v2); err != nil || !reflect.DeepEqual(v1, v2) {
+			t.Error("ToJSON round trip", doc, string(b), err)
+		}
 	}
 
-	p = NewPath("a.b{}")
+	// Native types, repeated names and named leaves in an object
+	g := New()
+	g.Add("n").Add(int64(1))
+	g.Add("s").Add("1")
+	g.Add("item").Add("a")
+	g.Add("item").Add("b")
+	g.Add("flag")
+	g.Add("x").Add("k").Add("v")
 
-	i = g.evalPath(p)
+	b, err := g.ToJSON()
+	if err != nil || string(b) != `{"n":1,"s":"1","item":["a","b"],"flag":null,"x":{"k":"v"}}` {
+		t.Error("ToJSON", string(b), err)
+	}
 
-	if _text(i) != "1\n2" {
-		t.Error("EvalPath_Selector", _text(i))
+	// Parsed OGDL text
+	b, _ = FromString("hosts\n  a\n  b\nport 80").ToJSON()
+	if string(b) != `{"hosts":["a","b"],"port":"80"}` {
+		t.Error("ToJSON of parsed text", string(b))
+	}
+
+	g = New()
+	g.Add("f").Add(func() {})
+	if _, err = g.ToJSON(); err == nil {
+		t.Error("ToJSON should fail on values that cannot be encoded")
 	}
 }
 
-func TestEvalScalar(t *testing.T) {
+func TestToMap(t *testing.T) {
 
-	g := New()
-	p := New("1")
+	g := FromString("db\n  host localhost\n  port 5432\n  opts\n    ssl true\nname x\nhosts\n  a\n  b\nitem\n  id 1\nitem\n  id 2\nflag")
+	g.Get("db.port").Out[0].This = int64(5432)
 
-	// constants
-	i := g.Eval(p)
-	s := reflect.TypeOf(i).String()
-	if i != int64(1) || s != "int64" {
-		t.Error("Eval constant")
+	m := g.ToMap()
+
+	expected := map[string]interface{}{
+		"db": map[string]interface{}{
+			"host": "localhost",
+			"port": int64(5432),
+			"opts": map[string]interface{}{"ssl": "true"},
+		},
+		"name":  "x",
+		"hosts": []interface{}{"a", "b"},
+		"item": []interface{}{
+			map[string]interface{}{"id": "1"},
+			map[string]interface{}{"id": "2"},
+		},
+		"flag": nil,
 	}
 
-	p = New("1.1")
-	i = g.Eval(p)
-	s = reflect.TypeOf(i).String()
-	if i != float64(1.1) || s != "float64" {
-		t.Error("Eval constant int")
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("ToMap\n%#v", m)
 	}
 
-	p = New(1.1)
-	i = g.Eval(p)
-	s = reflect.TypeOf(i).String()
-	if i != float64(1.1) || s != "float64" {
-		t.Error("Eval constant float")
+	// The same as ToJSON, but for the order of keys
+	b1, _ := json.Marshal(m)
+	b2, _ := g.ToJSON()
+	var v1, v2 interface{}
+	json.Unmarshal(b1, &v1)
+	json.Unmarshal(b2, &v2)
+	if !reflect.DeepEqual(v1, v2) {
+		t.Error("ToMap and ToJSON differ", string(b1), string(b2))
 	}
 
-	p = New('c')
-	i = g.Eval(p)
-	s = reflect.TypeOf(i).String()
-	if i != int64('c') || s != "int64" {
-		t.Error("Eval constant char")
+	var nilGraph *Graph
+	if m := nilGraph.ToMap(); m == nil || len(m) != 0 {
+		t.Error("ToMap of nil graph", m)
 	}
+}
 
-	p = New("true")
-	i = g.Eval(p)
-	s = reflect.TypeOf(i).String()
-	if i != true || s != "bool" {
-		t.Error("Eval constant bool")
+func TestFlatten(t *testing.T) {
+
+	g := FromString(`
+name test
+server
+  host localhost
+  port 80
+  port 81
+  tags
+    a
+    b
+item
+  id 1
+item
+  id 2
+  'x y' z
+debug
+`)
+	g.Set("n", int64(5))
+
+	m := g.Flatten()
+
+	want := map[string]interface{}{
+		"name":           "test",
+		"server.host":    "localhost",
+		"server.port":    "80",
+		"server.port{1}": "81",
+		"server.tags[0]": "a",
+		"server.tags[1]": "b",
+		"item.id":        "1",
+		"item{1}.id":     "2",
+		`item{1}."x y"`:  "z",
+		"[4]":            "debug",
+		"n":              int64(5),
+	}
+
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("Flatten:\n%v", m)
+	}
+
+	for path, v := range m {
+		if s := g.Get(path).String(); s != _string(v) {
+			t.Errorf("%s: Get gives %q, want %q", path, s, _string(v))
+		}
 	}
 
-	p = New(true)
-	i = g.Eval(p)
-	s = reflect.TypeOf(i).String()
-	if i != true || s != "bool" {
-		t.Error("Eval constant bool 2")
+	var nilg *Graph
+	if m := nilg.Flatten(); m == nil || len(m) != 0 {
+		t.Error("Flatten of nil graph should be empty")
 	}
 }
 
-// TestEvalArgOfGraph tests the following situation:
-//
-//    $a(b)
-//
-// where a is a graph and b is a variable containing a path
-//
-func TestEvalArgOfGraph(t *testing.T) {
-
-	g := New()
-	g.Add("a").Add("c").Add(int64(1))
-	g.Add("b").Add("c")
+func TestLoad(t *testing.T) {
 
-	p := NewPath("a.(b)")
-	r := g.Eval(p)
+	dir := t.TempDir()
 
-	ty := _typeOf(r)
+	files := map[string]string{
+		"a.ogdl": "a\n  c\n    1\n    x",
+		"a.json": `{"a":{"c":[1,"x"]}}`,
+		"a.xml":  `<a><b>1</b><c>1</c><c>x</c></a>`,
+		"a.conf": "a\n  b 1",
+		"a.yaml": "a: 1",
+	}
+	for name, s := range files {
+		os.WriteFile(dir+"/"+name, []byte(s), 0644)
+	}
 
-	if ty != "int64" || r != int64(1) {
-		t.Errorf("a(b): %s %v", ty, r)
+	g, err := Load(dir + "/a.ogdl")
+	if err != nil || g.Get("a.c").Len() != 2 {
+		t.Error("Load ogdl", err)
 	}
-}
 
-func TestEvalExpression(t *testing.T) {
+	g2, err := Load(dir + "/a.json")
+	if err != nil || g2.Text() != g.Text() {
+		t.Error("Load json", err, g2.Text())
+	}
 
-	// The context
-	g := FromString("a b")
+	g, err = Load(dir + "/a.xml")
+	if err != nil || g.Text() != "a\n  b\n    1\n  c\n    1\n  c\n    x" {
+		t.Error("Load xml", err, g.Text())
+	}
 
-	// 'a' is a string constant
-	p := NewExpression("a=='b'")
-	r := g.Eval(p)
+	g, err = Load(dir + "/a.conf")
+	if err != nil || g.Get("a.b").String() != "1" {
+		t.Error("Load unknown extension", err)
+	}
 
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("a=='b'")
+	_, err = Load(dir + "/a.yaml")
+	if err == nil {
+		t.Error("Load yaml should fail")
 	}
 
-	p = NewExpression("'a'!='b'")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("'a'!='b'")
+	_, err = Load(dir + "/none.ogdl")
+	if err == nil {
+		t.Error("Load of a missing file should fail")
 	}
+}
 
-	p = NewExpression("2>1")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("'a'!='b'")
+// slog.go
+
+func TestLogAttrs(t *testing.T) {
+
+	g := FromString("user joe\nid 12\nratio 0.5\nok true")
+
+	attrs := g.LogAttrs()
+	if len(attrs) != 4 {
+		t.Fatal("LogAttrs", attrs)
 	}
-	p = NewExpression("2>=2")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("'a'!='b'")
+	if attrs[0].Key != "user" || attrs[0].Value.Kind() != slog.KindString || attrs[0].Value.String() != "joe" {
+		t.Error("LogAttrs string", attrs[0])
 	}
-	p = NewExpression("1<2")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("'a'!='b'")
+	if attrs[1].Key != "id" || attrs[1].Value.Kind() != slog.KindInt64 || attrs[1].Value.Int64() != 12 {
+		t.Error("LogAttrs int", attrs[1])
 	}
-	p = NewExpression("1<=2")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("'a'!='b'")
+	if attrs[2].Value.Kind() != slog.KindFloat64 || attrs[2].Value.Float64() != 0.5 {
+		t.Error("LogAttrs float", attrs[2])
 	}
-	p = NewExpression("1<0")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != false {
-		t.Error("'a'!='b'")
+	if attrs[3].Value.Kind() != slog.KindBool || !attrs[3].Value.Bool() {
+		t.Error("LogAttrs bool", attrs[3])
 	}
 
-	// logic
-	e := "'false' || 'true'"
-	p = NewExpression(e)
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error(e)
+	g = FromString("req\n  method GET\n  path /\n  tags a b\nid 1")
+
+	attrs = g.LogAttrs()
+	if len(attrs) != 2 || attrs[0].Key != "req" || attrs[0].Value.Kind() != slog.KindGroup {
+		t.Fatal("LogAttrs group", attrs)
 	}
-	e = "'true' && 'true'"
-	p = NewExpression(e)
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error(e)
+	group := attrs[0].Value.Group()
+	if len(group) != 3 || group[0].Key != "method" || group[0].Value.String() != "GET" || group[1].Value.String() != "/" {
+		t.Error("LogAttrs group content", group)
+	}
+	if attrs[1].Value.Int64() != 1 {
+		t.Error("LogAttrs after group", attrs[1])
 	}
 
-	// Assign
-	g = New()
-	e = "a=1"
-	p = NewExpression(e)
-	g.Eval(p)
+	// nil subnodes are skipped
+	g = FromString("a 1\nreq\n  method GET\n  path /")
+	req := g.Out[1]
+	req.Out = append(req.Out, nil)
+	g.Out = append([]*Graph{nil}, g.Out...)
 
-	if i, err := g.GetInt64("a"); i != 1 || err != nil {
-		t.Error(e, _typeOf(i), _text(i), err.Error())
+	attrs = g.LogAttrs()
+	if len(attrs) != 2 || attrs[0].Key != "a" || len(attrs[1].Value.Group()) != 2 {
+		t.Error("LogAttrs with nil subnodes", attrs)
 	}
+}
 
-	e = "a+=12"
-	p = NewExpression(e)
-	g.Eval(p)
+// query.go
 
-	if i, _ := g.GetInt64("a"); i != 13 {
-		t.Error(e, _typeOf(g), _text(g))
-	}
+func TestQuery(t *testing.T) {
 
-	e = "a-=1"
-	p = NewExpression(e)
-	g.Eval(p)
+	g := FromString("items\n  item\n    name a\n    price 10\n  item\n    name b\n    price 20\n  other\n    name c\n    price 30")
 
-	if i, _ := g.GetInt64("a"); i != 12 {
-		t.Error(e, _typeOf(g), _text(g))
+	r := g.Query("items.*[?price > 15].name")
+	if len(r) != 2 || r[0].String() != "b" || r[1].String() != "c" {
+		t.Error("Query with wildcard and filter", len(r))
 	}
 
-	e = "a*=2"
-	p = NewExpression(e)
-	g.Eval(p)
+	r = g.Query("items.item[?name == 'a']")
+	if len(r) != 1 || r[0].Get("price").String() != "10" {
+		t.Error("Query with filter", len(r))
+	}
 
-	if i, _ := g.GetInt64("a"); i != 24 {
-		t.Error(e, _typeOf(g), _text(g))
+	r = g.Query("items.item{1}.name")
+	if len(r) != 1 || r[0].String() != "b" {
+		t.Error("Query with selector", len(r))
 	}
 
-	e = "a/=4"
-	p = NewExpression(e)
-	g.Eval(p)
+	r = g.Query("items.*.price")
+	if len(r) != 3 {
+		t.Error("Query with wildcard", len(r))
+	}
 
-	if i, _ := g.GetInt64("a"); i != 6 {
-		t.Error(e, _typeOf(g), _text(g))
+	r = g.Query("items[2]")
+	if len(r) != 1 || r[0].ThisString() != "other" {
+		t.Error("Query with index", len(r))
 	}
 
-	e = "a%=4"
-	p = NewExpression(e)
-	g.Eval(p)
+	r = g.Query("items[-1].name")
+	if len(r) != 1 || r[0].String() != "c" {
+		t.Error("Query with a negative index", len(r))
+	}
 
-	if i, _ := g.GetInt64("a"); i != 2 {
-		t.Error(e, _typeOf(g), _text(g))
+	r = g.Query("items.*[0:1]")
+	if len(r) != 3 || r[2].String() != "c" {
+		t.Error("Query with a slice", len(r))
 	}
 
-	// b non existent
-	e = "b+=1"
-	p = NewExpression(e)
-	g.Eval(p)
+	r = g.Query("items.item{}[?price < 15]")
+	if len(r) != 1 || r[0].Get("name").String() != "a" {
+		t.Error("Query with a filter after a selector", len(r))
+	}
 
-	if i, _ := g.GetInt64("b"); i != 1 {
-		t.Error(e, _typeOf(g), _text(g))
+	if g.Query("items.none") != nil || g.Query("items[x]") != nil || g.Query("items.item#") != nil {
+		t.Error("Query with no results")
 	}
+}
 
-	// c non existent
-	e = "c-=1"
-	p = NewExpression(e)
-	g.Eval(p)
+func TestGetFilter(t *testing.T) {
 
-	if i, _ := g.GetInt64("c"); i != -1 {
-		t.Error(e, _typeOf(g), _text(g))
+	g := FromString("items\n  item\n    name a\n    price 10\n  item\n    name b\n    price 20\n  item\n    name c\n    price 30")
+
+	r := g.Get("items.item[?price > 15]")
+	if r.Len() != 2 || r.Out[0].Get("name").String() != "b" || r.Out[1].Get("name").String() != "c" {
+		t.Error("Get with a filter\n", r.Show())
 	}
 
-	// d non existent
-	e = "d*=1"
-	p = NewExpression(e)
-	g.Eval(p)
+	if n := len(g.GetAll("items.item[?name != 'b']")); n != 2 {
+		t.Error("GetAll with a filter", n)
+	}
 
-	if i, _ := g.GetInt64("d"); i != 0 {
-		t.Error(e, _typeOf(g), _text(g))
+	// After an index, the filter applies to the node reached
+	if g.Get("items[0][?price == 10]") == nil || g.Get("items[1][?price == 10]") != nil {
+		t.Error("Get with a filter after an index")
 	}
 
-	// e non existent
-	e = "e/=1"
-	p = NewExpression(e)
-	g.Eval(p)
+	r = g.Get("items.*[?price >= 20].name")
+	if r.Len() != 2 || r.Out[1].String() != "c" {
+		t.Error("Get with a wildcard and a filter\n", r.Show())
+	}
 
-	if _, err := g.GetInt64("e"); err == nil {
-		t.Error(e, _typeOf(g), _text(g))
+	if g.Get("items.item[?price > 100]") != nil {
+		t.Error("Get with a filter that matches nothing")
 	}
+}
 
-	e = "1+2"
-	p = NewExpression(e)
-	r = g.Eval(p)
+// kind.go
 
-	if r != int64(3) {
-		t.Error(e, _typeOf(r), _text(r))
-	}
+func TestKind(t *testing.T) {
 
-	e = "1+2.0"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	g := FromString("name joe\nhosts\n  a\n  b\nserver\n  host localhost\n  port 80")
 
-	if r != float64(3) {
-		t.Error(e, _typeOf(r), _text(r))
+	if k := g.Get("name").Out[0].Kind(); k != KindScalar {
+		t.Error("Kind of a leaf", k)
 	}
 
-	e = "1.0+2.0"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	if k := g.Get("hosts").Kind(); k != KindList {
+		t.Error("Kind of a list", k)
+	}
 
-	if r != float64(3) {
-		t.Error(e, _typeOf(r), _text(r))
+	if k := g.Get("server").Kind(); k != KindMap {
+		t.Error("Kind of a map", k)
 	}
 
-	e = "2-4"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	if k := New().Kind(); k != KindEmpty {
+		t.Error("Kind of an empty node", k)
+	}
 
-	if r != int64(-2) {
-		t.Error(e, _typeOf(r), _text(r))
+	g = nil
+	if k := g.Kind(); k != KindEmpty || k.String() != "empty" {
+		t.Error("Kind of nil", k)
 	}
+}
 
-	e = "10*3"
-	p = NewExpression(e)
-	r = g.Eval(p)
+// merge.go
 
-	if r != int64(30) {
-		t.Error(e, _typeOf(r), _text(r))
-	}
+func TestMerge(t *testing.T) {
 
-	e = "10.0*3"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	g := FromString("server\n  host a\n  port 80\nitem\n  x 1\nitem\n  y 2")
+	c := FromString("server\n  port 8080\n  tls true\nitem\n  z 3\nitem\n  y 2\nitem\n  w 4\nlog debug")
 
-	if r != float64(30) {
-		t.Error(e, _typeOf(r), _text(r))
-	}
+	g.Merge(c)
 
-	e = "10*3.0"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	expected := "server\n  host\n    a\n  port\n    80\n    8080\n  tls\n    true\nitem\n  x\n    1\n  z\n    3\nitem\n  y\n    2\nitem\n  w\n    4\nlog\n  debug"
+	if g.Text() != expected {
+		t.Error("Merge\n" + g.Text())
+	}
 
-	if r != float64(30) {
-		t.Error(e, _typeOf(r), _text(r))
+	// c is not modified by the merge
+	if c.Get("server.port").String() != "8080" || c.Len() != 5 {
+		t.Error("Merge modifies its argument\n" + c.Text())
 	}
+}
 
-	e = "10/3"
-	p = NewExpression(e)
-	r = g.Eval(p)
+func TestMergeReplace(t *testing.T) {
 
-	if r != int64(3) {
-		t.Error(e, _typeOf(r), _text(r))
-	}
+	g := FromString("server\n  host a\n  port 80\nitem 1\nitem 2")
+	c := FromString("server\n  port 8080\nitem 3")
 
-	e = "10%3"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	g.MergeReplace(c)
 
-	if r != int64(1) {
-		t.Error(e, _typeOf(r), _text(r))
+	expected := "server\n  host\n    a\n  port\n    8080\nitem\n  3\nitem\n  2"
+	if g.Text() != expected {
+		t.Error("MergeReplace\n" + g.Text())
 	}
 }
 
-func TestEvalBool(t *testing.T) {
+func TestMergeEmpty(t *testing.T) {
 
-	g := New()
-	g.Add("a").Add(1)
+	c := FromString("a\n  b 1\nc 2")
 
-	p := NewExpression("1=='1'")
-	r := g.evalBool(p)
-	if r != true {
-		t.Error("1=='1'")
+	g := New()
+	g.Merge(c)
+	if !g.Equals(c) {
+		t.Error("Merge into empty graph\n" + g.Text())
 	}
 
-	p = NewExpression("true")
-	r = g.evalBool(p)
-	if r != false {
-		t.Error("true as a path")
+	// The result is a copy
+	g.Get("a.b").Out[0].This = "x"
+	if c.Get("a.b").String() != "1" {
+		t.Error("Merge shares nodes with its argument")
 	}
 
-	p = NewExpression("'true'")
-	r = g.evalBool(p)
-	if r != true {
-		t.Error("'true' keyword")
+	g = New()
+	g.MergeReplace(c)
+	if !g.Equals(c) {
+		t.Error("MergeReplace into empty graph\n" + g.Text())
 	}
+
+	var nilGraph *Graph
+	nilGraph.Merge(c)
+	g.Merge(nil)
 }
 
-// Get types
+func TestDiff(t *testing.T) {
 
-func TestGetTypes(t *testing.T) {
+	g := FromString("server\n  host a\n  port 80\n  debug true\nitem\n  x 1\nitem\n  y 2")
+	c := FromString("server\n  host a\n  port 8080\n  tls on\nitem\n  x 1\nitem\n  y 3")
 
-	g := FromString("aa, ab, bb, axx, aj, vv")
-	r, _ := g.Find("a[a-b]")
+	var r []string
+	for _, d := range g.Diff(c) {
+		r = append(r, fmt.Sprintf("%s %s/%s", d.Path, d.Mine.Text(), d.Other.Text()))
 
-	if r.Len() != 2 || r.Text() != "aa\nab" {
-		t.Error("Find(regex)")
+		// Paths can be resolved with Get
+		if d.Mine != nil && g.Get(d.Path).Unwrap().String() != d.Mine.String() {
+			t.Error("Diff path does not resolve", d.Path)
+		}
 	}
 
-	g = FromString("111")
-	if g.Int64() != 111 {
-		t.Error("Int64")
+	expected := "server.port 80/8080|server.debug true/|server.tls /on|item{1}.y 2/3"
+	if strings.Join(r, "|") != expected {
+		t.Error("Diff", strings.Join(r, "|"))
 	}
 
-	g = FromString("111.1")
-	if g.Float64() != 111.1 {
-		t.Error("Float64")
+	if d := g.Diff(g.Clone()); len(d) != 0 {
+		t.Error("Diff of equal graphs", d)
 	}
 
-	g = New()
-	g.Add(float32(111.2))
-	if g.Float64() != 111.2 {
-		t.Error("Float64")
+	d := New().Diff(c)
+	if len(d) != 3 || d[2].Path != "item{1}" || d[0].Path != "server" || d[0].Mine != nil || d[0].Other != c.Out[0] {
+		t.Error("Diff with an empty graph", d)
 	}
+}
 
-	g = FromString("true")
-	if g.Bool() != true {
-		t.Error("Bool")
-	}
+func TestMergeWith(t *testing.T) {
 
-	g = FromString("a 1")
-	if i, _ := g.GetInt64("a"); i != 1 {
-		t.Error("GetInt64")
+	a := "server\n  port 80\n  hosts\n    a\n    b"
+	b := "server\n  port\n    8080\n  hosts\n    c\n  name\n    x"
+
+	g := FromString(a)
+	g.MergeWith(FromString(b), AppendArrays)
+	if g.Text() != "server\n  port\n    80\n    8080\n  hosts\n    a\n    b\n    c\n  name\n    x" {
+		t.Error("MergeWith AppendArrays\n", g.Text())
 	}
 
-	g = FromString("a 1.1")
-	if i, _ := g.GetFloat64("a"); i != 1.1 {
-		t.Error("GetFloat64")
+	g = FromString(a)
+	g.MergeWith(FromString(b), ReplaceArrays)
+	if g.Text() != "server\n  port\n    8080\n  hosts\n    c\n  name\n    x" {
+		t.Error("MergeWith ReplaceArrays\n", g.Text())
 	}
 
-	g = FromString("a 'false'")
-	if i, err := g.GetBool("a"); err != nil || i != false {
-		t.Error("GetBool")
+	g = FromString(a)
+	g.MergeWith(FromString(b), MergeByIndex)
+	if g.Text() != "server\n  port\n    8080\n  hosts\n    c\n    b\n  name\n    x" {
+		t.Error("MergeWith MergeByIndex\n", g.Text())
 	}
 
-	g = FromString("a 'text'")
-	if i, err := g.GetBytes("a"); err != nil || len(i) != 4 {
-		t.Error("GetBytes", len(i))
+	// c is not modified, and items added are copies
+	c := FromString(b)
+	g = FromString(a)
+	g.MergeWith(c, AppendArrays)
+	g.Get("server.name").Out[0].This = "y"
+	if c.Get("server.name").String() != "x" {
+		t.Error("MergeWith should copy")
 	}
-}
 
-func TestIsInteger(t *testing.T) {
-	ss := [...]string{"-1", "2", "9.1", " 14", " - 1", " -1 ", "a", "3a", ""}
-	rr := [...]bool{true, true, false, true, false, true, false, false, false}
+	// Lists with one item
+	tests := []struct {
+		strategy MergeStrategy
+		want     string
+	}{
+		{AppendArrays, "tags\n  x\n  y"},
+		{ReplaceArrays, "tags\n  y"},
+		{MergeByIndex, "tags\n  y"},
+	}
 
-	for i, s := range ss {
-		b := isInteger(s)
-		if b != rr[i] {
-			t.Error("IsInteger() failed")
+	for _, tt := range tests {
+		g = FromString("tags\n  x")
+		g.MergeWith(FromString("tags\n  y"), tt.strategy)
+		if g.Text() != tt.want {
+			t.Error("MergeWith into a list with one item", tt.strategy, "\n"+g.Text())
 		}
 	}
+
+	g = FromString("tags\n  x")
+	g.MergeWith(FromString("tags\n  y\n  z"), MergeByIndex)
+	if g.Text() != "tags\n  y\n  z" {
+		t.Error("MergeWith MergeByIndex into a list with one item\n", g.Text())
+	}
 }
 
-// interface conversion to native types
+// gosource.go
 
-func TestI2string(t *testing.T) {
+func TestGoSource(t *testing.T) {
 
-	var i interface{}
+	g := FromString("a\n  b 1\n  c")
+	g.Get("a").Add(int64(2))
+	g.Get("a").Add(1.5)
+	g.Get("a").Add(true)
 
-	i = "2.2"
+	s := g.GoSource("g")
+	r := "g := ogdl.New()\ng1 := g.Add(\"a\")\ng2 := g1.Add(\"b\")\ng2.Add(\"1\")\ng1.Add(\"c\")\ng1.Add(int64(2))\ng1.Add(float64(1.5))\ng1.Add(true)\n"
+	if s != r {
+		t.Errorf("GoSource\n%s", s)
+	}
 
-	s := _string(i)
-	ty := reflect.TypeOf(s).String()
+	// What the code above does
+	g2 := New()
+	g21 := g2.Add("a")
+	g22 := g21.Add("b")
+	g22.Add("1")
+	g21.Add("c")
+	g21.Add(int64(2))
+	g21.Add(float64(1.5))
+	g21.Add(true)
 
-	if ty != "string" {
-		t.Error("should return a string")
+	if !g.Equals(g2) {
+		t.Error("GoSource does not rebuild the graph")
 	}
 
-	i = 1.1
+	if New().GoSource("x") != "x := ogdl.New()\n" {
+		t.Error("GoSource of an empty graph")
+	}
 
-	s = _string(i)
-	ty = reflect.TypeOf(s).String()
+	g = New()
+	g.Add(math.NaN())
+	g.Add(math.Inf(1))
+	g.Add(math.Inf(-1))
+	g.Add(float32(math.Inf(-1)))
+	g.Add(float32(0.25))
 
-	if ty != "string" {
-		t.Error("should return a string")
+	s = g.GoSource("g")
+	r = "g := ogdl.New()\ng.Add(math.NaN())\ng.Add(math.Inf(1))\ng.Add(math.Inf(-1))\ng.Add(float32(math.Inf(-1)))\ng.Add(float32(0.25))\n"
+	if s != r {
+		t.Errorf("GoSource of special floats\n%s", s)
 	}
 }
 
-// Templates
-
-func TestTemplateIndex(ts *testing.T) {
-	// Context
-	g := FromString("space\n  design\n    doc1\n    doc2")
-
-	t := NewTemplate("$space")
+func TestDiff3(t *testing.T) {
 
-	s := t.Process(g)
+	base := FromString("server\n  host localhost\n  port 80\nlog info\nold 1")
+	mine := FromString("server\n  host example.com\n  port 80\nlog info")
+	other := FromString("server\n  host localhost\n  port 8080\nlog info\nold 1\nnew 2")
 
-	t = NewTemplate("$space[0]")
+	r, c := mine.Diff3(base, other)
+	if len(c) != 0 {
+		t.Error("Diff3 clean merge with conflicts", c)
+	}
+	if r.Text() != "server\n  host\n    example.com\n  port\n    8080\nlog\n  info\nnew\n  2" {
+		t.Error("Diff3 clean merge\n", r.Text())
+	}
 
-	s2 := t.Process(g)
+	other = FromString("server\n  host other.com\n  port 80\nlog debug\nold 1")
 
-	if string(s) != "design\n  doc1\n  doc2" {
-		ts.Errorf("\n[%s]\n", string(s))
+	r, c = mine.Diff3(base, other)
+	if len(c) != 1 || c[0].Path != "server.host" || c[0].Base.String() != "localhost" || c[0].Mine.String() != "example.com" || c[0].Other.String() != "other.com" {
+		t.Error("Diff3 conflict", c)
 	}
-
-	if string(s2) != "doc1\ndoc2" {
-		ts.Errorf("\n[%s]\n", string(s2))
+	if r.Get("server.host").String() != "example.com" || r.Get("log").String() != "debug" {
+		t.Error("Diff3 with conflict\n", r.Text())
 	}
 }
 
-func TestTemplate1(ts *testing.T) {
-	// Context
-	g := New()
-	g.Add("b").Add(1)
+func TestDiff3Repeated(t *testing.T) {
 
-	t := NewTemplate("a $b")
+	base := FromString("item 1\nitem 2")
+	mine := FromString("item 1\nitem 2\nx 1")
 
-	s := t.Process(g)
+	r, c := mine.Diff3(base, base.Clone())
+	if len(c) != 0 || r.Text() != "item\n  1\nitem\n  2\nx\n  1" {
+		t.Error("Diff3 with repeated keys\n", r.Text(), c)
+	}
 
-	if string(s) != "a 1" {
-		ts.Error("template", string(s))
+	// The second item changed in both, differently
+	mine = FromString("item 1\nitem 3")
+	other := FromString("item 1\nitem 4\nitem 5")
+
+	r, c = mine.Diff3(base, other)
+	if len(c) != 1 || c[0].Path != "item{1}" || c[0].Other.String() != "4" {
+		t.Error("Diff3 conflict in repeated key", c)
+	}
+	if r.Text() != "item\n  1\nitem\n  3\nitem\n  5" {
+		t.Error("Diff3 with repeated keys\n", r.Text())
 	}
 }
 
-func TestTemplateOperatorConfusion(ts *testing.T) {
-	// Context
-	g := New()
-	g.Add("b").Add(1)
-
-	t := NewTemplate("$(a='/') $a $b")
+func TestOverridesOf(t *testing.T) {
 
-	s := t.Process(g)
+	base := FromString("server\n  host localhost\n  port 80\n  tls\n    on false\n    cert a.pem\nlog info\nname x")
+	g := FromString("server\n  host localhost\n  port 8080\n  tls\n    on false\n    cert b.pem\nlog info\nname x")
 
-	if string(s) != " / 1" {
-		ts.Error("template", string(s))
+	r := g.OverridesOf(base)
+	if r.Text() != "server\n  port\n    8080\n  tls\n    cert\n      b.pem" {
+		t.Error("OverridesOf\n", r.Text())
 	}
-}
 
-func TestTemplateIfEmptyString(ts *testing.T) {
-	// Context
-	g := New()
-	g.Add("b").Add("")
+	// Merging the overrides into base gives g
+	base.MergeWith(r, ReplaceArrays)
+	if !base.Equals(g) {
+		t.Error("OverridesOf merged back\n", base.Text())
+	}
 
-	t := NewTemplate("$if(b=='') text $end")
+	if g.OverridesOf(g).Len() != 0 {
+		t.Error("OverridesOf itself should be empty")
+	}
 
-	s := t.Process(g)
+	// Repeated keys are matched by position
+	base = FromString("port 80\nport 81\nhost a")
+	g = FromString("port 80\nport 81\nhost b")
+	if r := g.OverridesOf(base); r.Text() != "host\n  b" {
+		t.Error("OverridesOf with repeated keys\n", r.Text())
+	}
 
-	if string(s) != " text " {
-		ts.Error("template", string(s))
+	g = FromString("port 80\nport 82\nport 83\nhost a")
+	if r := g.OverridesOf(base); r.Text() != "port\n  82\nport\n  83" {
+		t.Error("OverridesOf with changed repeated keys\n", r.Text())
 	}
 }
 
-func TestTemplateIf(ts *testing.T) {
-	// Context
-	g := New()
+func TestRegisterFunc(t *testing.T) {
 
-	t := NewTemplate("$if('false') a $else b $end")
+	RegisterFunc("double", func(args ...interface{}) interface{} {
+		n, _ := _int64f(args[0])
+		return 2 * n
+	})
+	defer delete(functions, "double")
 
-	s := t.Process(g)
-	if string(s) != " b " {
-		ts.Error("template")
+	RegisterFunc("join", func(args ...interface{}) interface{} {
+		var ss []string
+		for _, a := range args {
+			ss = append(ss, _string(a))
+		}
+		return strings.Join(ss, "-")
+	})
+	defer delete(functions, "join")
+
+	g := FromString("a\n  b 21\nname x")
+
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		{"double(4)", int64(8)},
+		{"double(a.b)", int64(42)},
+		{"double(a.b) + 1", int64(43)},
+		{"join(name, 'y', 3)", "x-y-3"},
+		{"upper(join(name, name))", "X-X"},
+	}
+
+	for _, test := range tests {
+		if v := g.Eval(NewExpression(test.expr)); v != test.want {
+			t.Errorf("%s: got %#v, want %#v", test.expr, v, test.want)
+		}
 	}
 
-	t = NewTemplate("$if('true') a $else b $end")
-	s = t.Process(g)
-	if string(s) != " a " {
-		ts.Error("template")
+	if v := g.Eval(NewExpression("unknown(1)")); v != nil {
+		t.Errorf("unknown function: got %#v", v)
 	}
 }
 
-func TestTemplateFor(ts *testing.T) {
-	// Context
-	g := New()
-	c := g.Add("b")
-	c.Add(1)
-	c.Add(2)
-
-	t := NewTemplate("$b\n---\n$for(a,b) [$a] $end")
+func TestRegisterContextFunction(t *testing.T) {
 
-	s := t.Process(g)
-	if string(s) != "1\n2\n---\n [1]  [2] " {
-		ts.Errorf("template\n%s", string(s))
-	}
+	RegisterContextFunction("url", func(ctx *Graph, args []interface{}) (interface{}, error) {
+		if err := checkArgs("url", args, 1); err != nil {
+			return nil, err
+		}
+		return "http://" + ctx.Get("server.host").String() + _string(args[0]), nil
+	})
+	defer delete(functions, "url")
 
-	// The variable
-	g = FromString("result\n  item id 0\n  item id 1")
+	g := FromString("server\n  host example.com\npath /index.html")
 
-	t = NewTemplate("$for(a,result) $a.item.id $end")
+	r := g.Eval(NewExpression("url(path)"))
+	if r != "http://example.com/index.html" {
+		t.Error("context function", r)
+	}
 
-	s = t.Process(g)
-	if string(s) != " 0  1 " {
-		ts.Error("template: " + string(s))
-		println(g.Show())
+	r = g.Eval(NewExpression("url(path, path)"))
+	if r != "url: invalid number of arguments" {
+		t.Error("context function error", r)
 	}
 }
 
-// function.go
+// toml.go
 
-func TestFunction3(ts *testing.T) {
-	// Context
-	g := New()
+func TestTOML(t *testing.T) {
 
-	t := NewTemplate("$(R.y='h')$(R.x0='user')")
-	t.Process(g)
+	doc := `# A comment
+title = "TOML \"example\""
+on = true
 
-	t = NewTemplate("$R")
-	b := t.Process(g)
+[server]
+host = "localhost"  # inline comment
+ports = [ 80, 443 ]
+ratio = 0.5
+"odd key" = 'C:\temp'
+started = 1979-05-27T07:32:00Z
 
-	if string(b) != "y\n  h\nx0\n  user" {
-		ts.Error("Template processing of variable", string(b))
-	}
+[[products]]
+name = "Hammer"
+sku = 738594937
 
-	t = NewTemplate("$T(R)")
-	b = t.Process(g)
+[[products]]
+name = "Nail"
+sizes = [ [1, 2], [3] ]
+`
 
-	/*
+	g, err := FromTOML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		println(t.Show())
-		b := t.Process(g)
+	if g.Get("title").String() != `TOML "example"` || g.Get("on").Out[0].This != true {
+		t.Error("FromTOML keys", g.Text())
+	}
+	if g.Get("server.ports").Len() != 2 || g.Get("server.ports").Out[1].This != int64(443) {
+		t.Error("FromTOML array", g.Get("server.ports").Show())
+	}
+	if g.Get("server.ratio").Out[0].This != 0.5 || g.Get("server.'odd key'").String() != `C:\temp` {
+		t.Error("FromTOML values", g.Get("server").Show())
+	}
+	if tm, ok := g.Get("server.started").Out[0].This.(time.Time); !ok || tm.Year() != 1979 {
+		t.Error("FromTOML datetime", _typeOf(g.Get("server.started").Out[0].This))
+	}
 
-		if string(b) != "Title: A nice title" {
-			ts.Error("function T", string(b))
-		} */
-}
+	products := g.Get("products")
+	if products.Len() != 2 || products.Out[1].Get("name").String() != "Nail" || products.Out[0].Get("sku").Out[0].This != int64(738594937) {
+		t.Error("FromTOML array of tables", products.Show())
+	}
 
-type Math struct {
-}
+	b, err := g.TOML()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func (*Math) Sin(x float64) float64 {
-	return math.Sin(x)
-}
+	r := `title = "TOML \"example\""
+on = true
 
-func Sin(x float64) float64 {
-	return math.Sin(x)
-}
+[server]
+host = "localhost"
+ports = [ 80, 443 ]
+ratio = 0.5
+"odd key" = "C:\\temp"
+started = 1979-05-27T07:32:00Z
 
-func TestFunction2b(t *testing.T) {
+[[products]]
+name = "Hammer"
+sku = 738594937
 
-	g := New()
-	f := g.Add("math")
-	f.Add(&Math{})
+[[products]]
+name = "Nail"
+sizes = [ [ 1, 2 ], [ 3 ] ]
+`
+	if string(b) != r {
+		t.Error("TOML\n", string(b))
+	}
 
-	path := NewPath("math.Sin(1.0)")
+	g2, err := FromTOML(b)
+	if err != nil || !g2.Equals(g) {
+		t.Error("TOML round trip", err)
+	}
 
-	i := g.Eval(path)
-	s := _typeOf(i)
-	v := _string(i)[:10]
+	if _, err = FromTOML([]byte("a = ")); err == nil {
+		t.Error("FromTOML of an invalid document")
+	}
 
-	if s != "float64" || v != "0.84147098" {
-		t.Error("math.Sin()", s, v, i)
+	if _, err = FromString("a\n  b").Get("a").TOML(); err == nil {
+		t.Error("TOML of a key without value")
 	}
 }
 
-func TestFunction2c(t *testing.T) {
+func TestTOMLStrings(t *testing.T) {
 
 	g := New()
-	f := g.Add("Sin")
-	f.Add(Sin)
-
-	path := NewPath("Sin(1.0)")
-
-	i := g.Eval(path)
-	s := _typeOf(i)
-	v := _string(i)[:10]
+	g.Set("zip", "017")
+	g.Set("version", "1.0")
+	g.Set("flag", "true")
+	g.Set("n", int64(17))
 
-	if s != "float64" || v != "0.84147098" {
-		t.Error("Sin()", s, v)
+	b, err := g.TOML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "zip = \"017\"\nversion = \"1.0\"\nflag = \"true\"\nn = 17\n" {
+		t.Error("TOML of strings\n", string(b))
 	}
-}
-
-// log.go
 
-func TestLog(t *testing.T) {
+	g2, err := FromTOML(b)
+	if err != nil || !g2.Equals(g) {
+		t.Error("TOML round trip of strings", err)
+	}
 
-	file := "/tmp/log.gb"
+	for _, s := range []string{"a = 017", "a = -01", "a = 00.5"} {
+		if _, err := FromTOML([]byte(s)); err == nil {
+			t.Error("FromTOML with a leading zero", s)
+		}
+	}
 
-	log, _ := OpenLog(file)
+	g, err = FromTOML([]byte("a = \"\"\"x \\\n  # not a comment\ny\"\"\"\nb = 0"))
+	if err != nil || g.Get("a").String() != "x # not a comment\ny" || g.Get("b").Out[0].This != int64(0) {
+		t.Error("FromTOML line ending backslash", err, g.Text())
+	}
+}
 
-	g := FromString("a b, c, d")
-	b := g.Binary()
+func TestBuiltinCasts(t *testing.T) {
 
-	n := log.Add(g)
-	m := log.Add(g)
-	o := log.AddBinary(b)
+	g := FromString("n 42\nf 2.5\ns abc")
 
-	if n != 0 || m != 16 || o != 32 {
-		t.Error("log.Add", o)
+	r := g.Eval(NewExpression("int('42')"))
+	if r != int64(42) {
+		t.Error("int('42')", _typeOf(r), r)
 	}
 
-	g2, n2, _ := log.Get(0)
-	g3, n3, _ := log.Get(n2)
-	b2, _, _ := log.GetBinary(n3)
-
-	g4 := FromBinary(b2)
+	r = g.Eval(NewExpression("int(f)"))
+	if r != int64(2) {
+		t.Error("int(f)", _typeOf(r), r)
+	}
 
-	if !g.Equals(g2) {
-		t.Error("n!=n2")
+	r = g.Eval(NewExpression("int(n) + 1"))
+	if r != int64(43) {
+		t.Error("int(n) + 1", _typeOf(r), r)
 	}
 
-	if !g.Equals(g3) {
-		t.Error("n!=n3")
+	r = g.Eval(NewExpression("float(n)"))
+	if r != 42.0 {
+		t.Error("float(n)", _typeOf(r), r)
 	}
 
-	if !g.Equals(g4) {
-		t.Error("n!=n3")
+	r = g.Eval(NewExpression("string(42)"))
+	if r != "42" {
+		t.Error("string(42)", _typeOf(r), r)
 	}
 
-	log.Sync()
+	r = g.Eval(NewExpression("bool(n)"))
+	if r != true {
+		t.Error("bool(n)", _typeOf(r), r)
+	}
 
-	log.Close()
+	r = g.Eval(NewExpression("bool(0)"))
+	if r != false {
+		t.Error("bool(0)", _typeOf(r), r)
+	}
 
-	os.Remove(file)
+	r = g.Eval(NewExpression("int(s)"))
+	if r != "int: cannot convert abc" {
+		t.Error("int(s)", r)
+	}
 }
 
 // -------------------------------------------------------------------------
@@ -7,8 +7,12 @@ package ogdl
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
 	"io/ioutil"
+	"math"
+	"strconv"
 )
 
 // BinParser and its methods implement a parser for binary OGDL, as defined in the
@@ -332,3 +336,206 @@ func (p *binParser) unread() {
 		p.r.UnreadByte()
 	}
 }
+
+// Typed binary format, used by MarshalBinary and UnmarshalBinary. Unlike
+// binary OGDL, it keeps the type of the content of each node:
+//
+//     graph ::= 0x02 'G' 0x00 node
+//     node  ::= type content count node{count}
+//     count ::= uvarint
+//
+// where type is one of the following constants, and content depends on it:
+// nothing for nil, uvarint length and bytes for strings and []byte, varint
+// for int64, 8 bytes (IEEE 754, little endian) for float64 and one byte
+// for bool.
+const (
+	binNil byte = iota
+	binString
+	binBytes
+	binInt64
+	binFloat64
+	binBool
+)
+
+var errBinary = errors.New("ogdl: invalid or truncated binary graph")
+
+// MarshalBinary encodes the graph, including the root node, in a compact
+// binary format that keeps the type of the content of each node, so that
+// UnmarshalBinary gives back an equal graph. It implements the
+// encoding.BinaryMarshaler interface.
+//
+// Strings, []byte, int64, float64, bool and nil are encoded as such. Other
+// integer types are encoded as int64, float32 as float64, and any other type
+// as its string representation. Nil subnodes are encoded as nodes with nil
+// content. The graph must not have cycles.
+//
+// This format is not binary OGDL, which holds only text and is produced by
+// Binary().
+func (g *Graph) MarshalBinary() ([]byte, error) {
+	buf := []byte{2, 'G', 0}
+	return g.appendBinary(buf), nil
+}
+
+func (g *Graph) appendBinary(buf []byte) []byte {
+
+	var v interface{}
+	if g != nil {
+		v = g.This
+	}
+
+	switch x := v.(type) {
+	case nil:
+		buf = append(buf, binNil)
+	case string:
+		buf = append(buf, binString)
+		buf = binary.AppendUvarint(buf, uint64(len(x)))
+		buf = append(buf, x...)
+	case []byte:
+		buf = append(buf, binBytes)
+		buf = binary.AppendUvarint(buf, uint64(len(x)))
+		buf = append(buf, x...)
+	case bool:
+		buf = append(buf, binBool)
+		if x {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	case float32, float64:
+		f, _ := _float64(x)
+		buf = append(buf, binFloat64)
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(f))
+	default:
+		if i, ok := _int64(x); ok {
+			buf = append(buf, binInt64)
+			buf = binary.AppendVarint(buf, i)
+		} else {
+			s := _string(x)
+			buf = append(buf, binString)
+			buf = binary.AppendUvarint(buf, uint64(len(s)))
+			buf = append(buf, s...)
+		}
+	}
+
+	if g == nil {
+		return append(buf, 0)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(g.Out)))
+	for _, n := range g.Out {
+		buf = n.appendBinary(buf)
+	}
+	return buf
+}
+
+// UnmarshalBinary decodes a graph encoded with MarshalBinary into g,
+// replacing its content and subnodes. It implements the
+// encoding.BinaryUnmarshaler interface.
+func (g *Graph) UnmarshalBinary(data []byte) error {
+	if g == nil {
+		return errors.New("ogdl: UnmarshalBinary on nil Graph")
+	}
+
+	if len(data) < 3 || data[0] != 2 || data[1] != 'G' || data[2] != 0 {
+		return errors.New("ogdl: not a typed binary graph")
+	}
+
+	n, rest, err := readBinary(data[3:])
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errBinary
+	}
+
+	*g = *n
+	return nil
+}
+
+// readBinary decodes one node, with its subnodes, and returns it together
+// with the remaining bytes.
+func readBinary(b []byte) (*Graph, []byte, error) {
+
+	if len(b) == 0 {
+		return nil, nil, errBinary
+	}
+
+	typ := b[0]
+	b = b[1:]
+
+	g := New()
+
+	switch typ {
+	case binNil:
+	case binString, binBytes:
+		l, n := binary.Uvarint(b)
+		if n <= 0 || l > uint64(len(b)-n) {
+			return nil, nil, errBinary
+		}
+		s := b[n : n+int(l)]
+		if typ == binString {
+			g.This = string(s)
+		} else {
+			g.This = append([]byte{}, s...)
+		}
+		b = b[n+int(l):]
+	case binInt64:
+		i, n := binary.Varint(b)
+		if n <= 0 {
+			return nil, nil, errBinary
+		}
+		g.This = i
+		b = b[n:]
+	case binFloat64:
+		if len(b) < 8 {
+			return nil, nil, errBinary
+		}
+		g.This = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		b = b[8:]
+	case binBool:
+		if len(b) < 1 || b[0] > 1 {
+			return nil, nil, errBinary
+		}
+		g.This = b[0] == 1
+		b = b[1:]
+	default:
+		return nil, nil, errors.New("ogdl: unknown type in binary graph: " + strconv.Itoa(int(typ)))
+	}
+
+	count, n := binary.Uvarint(b)
+	// Each node takes at least two bytes
+	if n <= 0 || count > uint64(len(b)-n)/2 {
+		return nil, nil, errBinary
+	}
+	b = b[n:]
+
+	if count != 0 {
+		g.Out = make([]*Graph, 0, count)
+	}
+
+	for ; count > 0; count-- {
+		var nn *Graph
+		var err error
+		nn, b, err = readBinary(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		g.Out = append(g.Out, nn)
+	}
+
+	return g, b, nil
+}
+
+// GobEncode implements the gob.GobEncoder interface, so that graphs can be
+// sent with encoding/gob (and net/rpc). The encoding is that of
+// MarshalBinary, and so are the types kept.
+func (g *Graph) GobEncode() ([]byte, error) {
+	return g.MarshalBinary()
+}
+
+// GobDecode implements the gob.GobDecoder interface. It returns an error if
+// the data is not a graph encoded by GobEncode, including the case of a type
+// of content it does not know.
+func (g *Graph) GobDecode(data []byte) error {
+	return g.UnmarshalBinary(data)
+}
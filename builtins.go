@@ -0,0 +1,369 @@
+// Copyright 2012-2017, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// functions holds the functions that can be called by name from expressions,
+// as in upper(name). They receive the evaluation context and the already
+// evaluated arguments.
+//
+// A node in the context graph with the same name takes precedence over a
+// function in this table.
+var functions = map[string]func(g *Graph, args []interface{}) (interface{}, error){
+	"upper":    fnUpper,
+	"lower":    fnLower,
+	"len":      fnLen,
+	"contains": fnContains,
+	"split":    fnSplit,
+	"int":      fnInt,
+	"float":    fnFloat,
+	"string":   fnString,
+	"bool":     fnBool,
+}
+
+// aggregates holds the functions that fold the values found along a path,
+// as in sum(items.price). A path given as argument is followed through all
+// matching nodes, not only the first one, and the leaf values found at the
+// end are passed to the function.
+var aggregates = map[string]func(values []interface{}) (interface{}, error){
+	"sum":   fnSum,
+	"avg":   fnAvg,
+	"min":   fnMin,
+	"max":   fnMax,
+	"count": fnCount,
+}
+
+// RegisterContextFunction adds a function that can be called by name from
+// expressions. It receives the graph in which the expression is evaluated,
+// so that it can read other values from it, and the evaluated arguments. A
+// function already registered with the same name, including the built-in
+// ones, is replaced.
+//
+// Functions should be registered before evaluating expressions, for example
+// in an init() function: the registry is not safe for concurrent use.
+func RegisterContextFunction(name string, fn func(ctx *Graph, args []interface{}) (interface{}, error)) {
+	functions[name] = fn
+}
+
+// RegisterFunc adds a function that can be called by name from expressions,
+// as in double(a.b), with the evaluated arguments. It is a simpler form of
+// RegisterContextFunction, for functions that need no context and cannot
+// fail. Calling a name that is neither a registered function nor a node in
+// the context graph evaluates to nil.
+func RegisterFunc(name string, fn func(args ...interface{}) interface{}) {
+	RegisterContextFunction(name, func(_ *Graph, args []interface{}) (interface{}, error) {
+		return fn(args...), nil
+	})
+}
+
+// builtin calls the function or aggregate with the given name, if there is
+// one, with the arguments in group (!g). The boolean returned is false if no
+// such function exists.
+func (g *Graph) builtin(name string, group *Graph) (interface{}, bool, error) {
+
+	if fn, ok := functions[name]; ok {
+		itf, err := g.callFunction(fn, group)
+		return itf, true, err
+	}
+
+	if fn, ok := aggregates[name]; ok {
+		itf, err := g.callAggregate(fn, group)
+		return itf, true, err
+	}
+
+	return nil, false, nil
+}
+
+// callFunction evaluates the arguments given in a group (!g) and calls fn
+// with them.
+func (g *Graph) callFunction(fn func(*Graph, []interface{}) (interface{}, error), group *Graph) (interface{}, error) {
+
+	var args []interface{}
+
+	for _, arg := range group.Out {
+		args = append(args, argValue(g.evalExpression(arg)))
+	}
+
+	return fn(g, args)
+}
+
+// callAggregate collects the values referenced by the first argument given in
+// a group (!g) and calls fn with them.
+func (g *Graph) callAggregate(fn func([]interface{}) (interface{}, error), group *Graph) (interface{}, error) {
+
+	if group.Len() != 1 {
+		return nil, errors.New("aggregate: invalid number of arguments")
+	}
+
+	arg := group.Out[0]
+	if arg.ThisString() == TypeExpression {
+		arg = arg.GetAt(0)
+	}
+
+	var values []interface{}
+
+	if arg.ThisString() == TypePath {
+		values = g.values(arg)
+	} else {
+		v := g.evalExpression(arg)
+		if n, ok := v.(*Graph); ok {
+			for _, nn := range n.Out {
+				values = append(values, nn.This)
+			}
+		} else {
+			values = append(values, v)
+		}
+	}
+
+	return fn(values)
+}
+
+// values follows a path through all matching nodes and returns the leaf
+// values found at the end of it. Only tokens and indexes are supported as
+// path elements.
+func (g *Graph) values(path *Graph) []interface{} {
+
+	nodes := []*Graph{g}
+
+	for _, elem := range path.Out {
+		var next []*Graph
+
+		switch elem.ThisString() {
+		case TypeIndex:
+			ix, ok := _int64f(g.evalExpression(elem.GetAt(0)))
+			if !ok {
+				return nil
+			}
+			for _, n := range nodes {
+				if nn := n.GetAt(int(ix)); nn != nil {
+					next = append(next, nn)
+				}
+			}
+		default:
+			s := elem.ThisString()
+			for _, n := range nodes {
+				for _, nn := range n.Out {
+					if _string(nn.This) == s {
+						next = append(next, nn)
+					}
+				}
+			}
+		}
+		nodes = next
+	}
+
+	var values []interface{}
+	for _, n := range nodes {
+		if n.Len() == 0 {
+			values = append(values, n.This)
+			continue
+		}
+		for _, nn := range n.Out {
+			if nn.Len() == 0 {
+				values = append(values, nn.This)
+			}
+		}
+	}
+	return values
+}
+
+// argValue reduces the result of a path that points to a single leaf to the
+// value of that leaf. Other values are returned as is.
+func argValue(v interface{}) interface{} {
+	if n, ok := v.(*Graph); ok && n != nil && n.This == nil && n.Len() == 1 && n.Out[0].Len() == 0 {
+		return n.Out[0].This
+	}
+	return v
+}
+
+func checkArgs(name string, args []interface{}, n int) error {
+	if len(args) != n {
+		return errors.New(name + ": invalid number of arguments")
+	}
+	return nil
+}
+
+// upper(s) returns s in upper case.
+func fnUpper(g *Graph, args []interface{}) (interface{}, error) {
+	if err := checkArgs("upper", args, 1); err != nil {
+		return nil, err
+	}
+	return strings.ToUpper(_string(args[0])), nil
+}
+
+// lower(s) returns s in lower case.
+func fnLower(g *Graph, args []interface{}) (interface{}, error) {
+	if err := checkArgs("lower", args, 1); err != nil {
+		return nil, err
+	}
+	return strings.ToLower(_string(args[0])), nil
+}
+
+// len(s) returns the number of characters of s, or the number of subnodes
+// if s is a Graph.
+func fnLen(g *Graph, args []interface{}) (interface{}, error) {
+	if err := checkArgs("len", args, 1); err != nil {
+		return nil, err
+	}
+	if n, ok := args[0].(*Graph); ok {
+		return int64(n.Len()), nil
+	}
+	return int64(utf8.RuneCountInString(_string(args[0]))), nil
+}
+
+// contains(s, sub) returns true if sub is within s.
+func fnContains(g *Graph, args []interface{}) (interface{}, error) {
+	if err := checkArgs("contains", args, 2); err != nil {
+		return nil, err
+	}
+	return strings.Contains(_string(args[0]), _string(args[1])), nil
+}
+
+// split(s, sep) returns a Graph with the substrings of s separated by sep
+// as subnodes.
+func fnSplit(g *Graph, args []interface{}) (interface{}, error) {
+	if err := checkArgs("split", args, 2); err != nil {
+		return nil, err
+	}
+	r := New()
+	for _, s := range strings.Split(_string(args[0]), _string(args[1])) {
+		r.Add(s)
+	}
+	return r, nil
+}
+
+// int(x) converts x to an int64. Floats are truncated.
+func fnInt(g *Graph, args []interface{}) (interface{}, error) {
+	if err := checkArgs("int", args, 1); err != nil {
+		return nil, err
+	}
+	if i, ok := _int64f(args[0]); ok {
+		return i, nil
+	}
+	if f, ok := _float64f(args[0]); ok {
+		return int64(f), nil
+	}
+	return nil, errors.New("int: cannot convert " + _string(args[0]))
+}
+
+// float(x) converts x to a float64.
+func fnFloat(g *Graph, args []interface{}) (interface{}, error) {
+	if err := checkArgs("float", args, 1); err != nil {
+		return nil, err
+	}
+	if f, ok := _float64f(args[0]); ok {
+		return f, nil
+	}
+	return nil, errors.New("float: cannot convert " + _string(args[0]))
+}
+
+// string(x) converts x to a string.
+func fnString(g *Graph, args []interface{}) (interface{}, error) {
+	if err := checkArgs("string", args, 1); err != nil {
+		return nil, err
+	}
+	return _string(args[0]), nil
+}
+
+// bool(x) converts x to a bool. Numbers are true if not zero, and strings
+// must be "true" or "false".
+func fnBool(g *Graph, args []interface{}) (interface{}, error) {
+	if err := checkArgs("bool", args, 1); err != nil {
+		return nil, err
+	}
+	if b, ok := _boolf(args[0]); ok {
+		return b, nil
+	}
+	if f, ok := _float64f(args[0]); ok {
+		return f != 0, nil
+	}
+	return nil, errors.New("bool: cannot convert " + _string(args[0]))
+}
+
+// numbers returns the values that are numeric, as int64 or float64, and
+// whether all of them are integers.
+func numbers(values []interface{}) ([]interface{}, bool) {
+	var r []interface{}
+	ints := true
+	for _, v := range values {
+		n := number(v)
+		if n == nil {
+			continue
+		}
+		if _, ok := n.(float64); ok {
+			ints = false
+		}
+		r = append(r, n)
+	}
+	return r, ints
+}
+
+// sum(path) returns the sum of the numeric values, as an int64 if all
+// of them are integers, else as a float64.
+func fnSum(values []interface{}) (interface{}, error) {
+	nn, ints := numbers(values)
+	if ints {
+		var i int64
+		for _, n := range nn {
+			i += n.(int64)
+		}
+		return i, nil
+	}
+	var f float64
+	for _, n := range nn {
+		v, _ := _float64f(n)
+		f += v
+	}
+	return f, nil
+}
+
+// avg(path) returns the mean of the numeric values as a float64, or nil if
+// there are none.
+func fnAvg(values []interface{}) (interface{}, error) {
+	nn, _ := numbers(values)
+	if len(nn) == 0 {
+		return nil, nil
+	}
+	var f float64
+	for _, n := range nn {
+		v, _ := _float64f(n)
+		f += v
+	}
+	return f / float64(len(nn)), nil
+}
+
+// min(path) returns the lowest numeric value, or nil if there are none.
+func fnMin(values []interface{}) (interface{}, error) {
+	return extreme(values, '<')
+}
+
+// max(path) returns the highest numeric value, or nil if there are none.
+func fnMax(values []interface{}) (interface{}, error) {
+	return extreme(values, '>')
+}
+
+func extreme(values []interface{}, op int) (interface{}, error) {
+	nn, _ := numbers(values)
+	if len(nn) == 0 {
+		return nil, nil
+	}
+	r := nn[0]
+	for _, n := range nn[1:] {
+		if compare(n, r, op) {
+			r = n
+		}
+	}
+	return r, nil
+}
+
+// count(path) returns the number of values found, numeric or not.
+func fnCount(values []interface{}) (interface{}, error) {
+	return int64(len(values)), nil
+}
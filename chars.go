@@ -61,3 +61,19 @@ func isDigit(c int) bool {
 func isTokenChar(c int) bool {
 	return unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) || c == '_'
 }
+
+// isHexDigit returns true for 0-9, a-f and A-F.
+func isHexDigit(c int) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// hexValue returns the value of a hexadecimal digit.
+func hexValue(c int) int {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
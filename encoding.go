@@ -5,19 +5,105 @@
 package ogdl
 
 import (
+	"bytes"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// Load reads a file and converts it into a Graph, choosing the format from
+// the file extension: .json, .xml or .ogdl. Files with any other extension
+// are parsed as OGDL. YAML (.yaml, .yml) is recognized but not supported, and
+// returns an error.
+func Load(path string) (*Graph, error) {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FromJSON(b)
+	case ".xml":
+		return FromXML(b)
+	case ".yaml", ".yml":
+		return nil, errors.New("ogdl: YAML is not supported: " + path)
+	}
+
+	return FromBytes(b), nil
+}
+
+// FromXML converts an XML document into OGDL
+//
+// Each element becomes a node with the element name, and its attributes
+// are added as subnodes (name value) before the element content. Character
+// data that is not only white space is added as a string subnode.
+func FromXML(buf []byte) (*Graph, error) {
+
+	decoder := xml.NewDecoder(bytes.NewReader(buf))
+
+	g := New()
+	stack := []*Graph{g}
+
+	for {
+		t, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		top := stack[len(stack)-1]
+
+		switch e := t.(type) {
+		case xml.StartElement:
+			n := top.Add(e.Name.Local)
+			for _, a := range e.Attr {
+				n.Add(a.Name.Local).Add(a.Value)
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			s := strings.TrimSpace(string(e))
+			if len(s) != 0 {
+				top.Add(s)
+			}
+		}
+	}
+
+	return g, nil
+}
+
 // FromJSON converts a JSON text stream into OGDL
 //
-// Json types returned by Unmashal:
+// Object members become named nodes, with their value below them, and the
+// items of an array become subnodes of the array node, in order. Items that
+// are objects or arrays themselves are added as anonymous (transparent)
+// nodes, so that each one is kept apart. Scalars become leaf nodes with the
+// types returned by json.Unmarshal:
+//
 // bool, for JSON booleans
 // float64, for JSON numbers
 // string, for JSON strings
-// []interface{}, for JSON arrays
-// map[string]interface{}, for JSON objects
 // nil for JSON null
 //
+// JSON does not define an order for the members of an object, and the one in
+// the input is not preserved: they are added sorted by name.
+//
+//    {"a": {"b": [1, {"c": null}]}}
+//
+// gives a node a, with a subnode b that has two subnodes: the leaf 1 and an
+// anonymous node that contains c. The null value is a leaf with nil content
+// below c. Get("a.b[1].c") returns the c node.
 func FromJSON(buf []byte) (*Graph, error) {
 
 	var v interface{}
@@ -30,21 +116,284 @@ func FromJSON(buf []byte) (*Graph, error) {
 }
 
 func toGraph(v interface{}) *Graph {
-
 	g := New()
+	g.addJSON(v)
+	return g
+}
 
-	switch v.(type) {
+// addJSON adds the value given, as returned by json.Unmarshal, to g.
+func (g *Graph) addJSON(v interface{}) {
+
+	switch v := v.(type) {
 
 	case []interface{}:
-		for _, i := range v.([]interface{}) {
-			g.Add(toGraph(i))
+		for _, i := range v {
+			switch i.(type) {
+			case []interface{}, map[string]interface{}:
+				g.Add(New()).addJSON(i)
+			default:
+				g.Add(i)
+			}
 		}
 	case map[string]interface{}:
-		for k, i := range v.(map[string]interface{}) {
-			g.Add(k).Add(toGraph(i))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			g.Add(k).addJSON(v[k])
 		}
 	default:
 		g.Add(v)
 	}
-	return g
+}
+
+// ToJSON converts the graph into JSON. The root node is not included, as in
+// Text(): its subnodes are converted as follows, and so are the subnodes of
+// each node below.
+//
+// A node without subnodes is null, and one with a single leaf subnode, as in
+// 'port 80', is that value. Subnodes that are all leaves or anonymous nodes
+// (a list, see Kind) become an array, where anonymous nodes are converted
+// recursively. Any other node becomes an object, with a member for each
+// named subnode and the members of anonymous subnodes merged in. Named leaf
+// subnodes of an object, as 'b' in:
+//
+//    a
+//      b
+//      c 1
+//
+// are members with a null value. When a name is repeated, its values are
+// collected in an array.
+//
+// Leaf values are encoded with their native type, so that an int64 becomes a
+// JSON number and a string a JSON string. Text parsed as OGDL has only
+// strings. A []byte is encoded as a string.
+//
+// Note that an array with only one item, or an empty array or object, cannot
+// be told apart from a single value or null in a Graph, so converting JSON
+// to a Graph and back may not give the same document.
+func (g *Graph) ToJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := g.jsonValue(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonValue writes the subnodes of g as a JSON value.
+func (g *Graph) jsonValue(buf *bytes.Buffer) error {
+
+	if g == nil || len(g.Out) == 0 {
+		buf.WriteString("null")
+		return nil
+	}
+
+	if g.Kind() == KindList {
+		if len(g.Out) == 1 && g.Out[0].Len() == 0 {
+			return jsonScalar(buf, g.Out[0].This)
+		}
+
+		buf.WriteByte('[')
+		for i, n := range g.Out {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			var err error
+			if n.Len() == 0 {
+				err = jsonScalar(buf, n.This)
+			} else {
+				err = n.jsonValue(buf)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+
+	// An object: collect the nodes of each name, in order of appearance.
+	var keys []string
+	members := make(map[string][]*Graph)
+	g.jsonMembers(&keys, members)
+
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		jsonScalar(buf, k)
+		buf.WriteByte(':')
+
+		nn := members[k]
+		if len(nn) > 1 {
+			buf.WriteByte('[')
+		}
+		for j, n := range nn {
+			if j != 0 {
+				buf.WriteByte(',')
+			}
+			if err := n.jsonValue(buf); err != nil {
+				return err
+			}
+		}
+		if len(nn) > 1 {
+			buf.WriteByte(']')
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// jsonMembers collects the named subnodes of g, looking into anonymous ones.
+func (g *Graph) jsonMembers(keys *[]string, members map[string][]*Graph) {
+	for _, n := range g.Out {
+		if n == nil {
+			continue
+		}
+		if n.This == nil {
+			n.jsonMembers(keys, members)
+			continue
+		}
+		k := _string(n.This)
+		if _, ok := members[k]; !ok {
+			*keys = append(*keys, k)
+		}
+		members[k] = append(members[k], n)
+	}
+}
+
+// jsonScalar writes a leaf value as JSON.
+func jsonScalar(buf *bytes.Buffer, v interface{}) error {
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
+
+// ToMap converts the graph into a map, with an entry for each named subnode
+// of g (those of anonymous subnodes included). The value of each entry
+// follows the rules of ToJSON: nil for a node without subnodes, the content
+// of its only subnode for a single value, as in 'port 80', a
+// []interface{} for a list, and a map[string]interface{} for anything else.
+// Leaf values are given with their native type.
+//
+// Repeated keys are collected in a []interface{} with the value of each
+// occurrence, in order, so that no data is lost. This is also what ToJSON
+// does, so encoding the map as JSON gives the same result (except for the
+// order of the keys).
+func (g *Graph) ToMap() map[string]interface{} {
+	m := make(map[string]interface{})
+	if g == nil {
+		return m
+	}
+
+	var keys []string
+	members := make(map[string][]*Graph)
+	g.jsonMembers(&keys, members)
+
+	for _, k := range keys {
+		nn := members[k]
+		if len(nn) == 1 {
+			m[k] = nn[0].mapValue()
+			continue
+		}
+		var values []interface{}
+		for _, n := range nn {
+			values = append(values, n.mapValue())
+		}
+		m[k] = values
+	}
+	return m
+}
+
+// mapValue returns the subnodes of g as a Go value, as described in ToMap.
+func (g *Graph) mapValue() interface{} {
+
+	if len(g.Out) == 0 {
+		return nil
+	}
+
+	if g.Kind() != KindList {
+		return g.ToMap()
+	}
+
+	if len(g.Out) == 1 && g.Out[0].Len() == 0 {
+		return g.Out[0].This
+	}
+
+	var values []interface{}
+	for _, n := range g.Out {
+		if n.Len() == 0 {
+			values = append(values, n.This)
+		} else {
+			values = append(values, n.mapValue())
+		}
+	}
+	return values
+}
+
+// Flatten returns the content of the leaf nodes (those without subnodes),
+// keyed by their path, so that g.Get(path).String() gives each value back as
+// text:
+//
+//    server
+//      host localhost
+//      port 80
+//      port 81
+//
+// gives server.host: "localhost", server.port: "80" and server.port{1}: "81".
+// A key repeated among its siblings gets the selector {i} from its second
+// occurrence on, as in Diff. The leaves of a node that has several
+// subnodes, and those at the top level, are addressed by index, as in
+// list[2]. Keys that are not tokens are quoted. The values are given with
+// their native type.
+func (g *Graph) Flatten() map[string]interface{} {
+	m := make(map[string]interface{})
+	g.flatten("", m)
+	return m
+}
+
+func (g *Graph) flatten(path string, m map[string]interface{}) {
+	if g == nil {
+		return
+	}
+
+	seen := make(map[string]int)
+
+	for i, n := range g.Out {
+		if n == nil {
+			continue
+		}
+
+		key := _string(n.This)
+		k := seen[key]
+		seen[key]++
+
+		if n.Len() == 0 {
+			if len(path) != 0 && len(g.Out) == 1 {
+				m[path] = n.This
+			} else {
+				m[path+"["+strconv.Itoa(i)+"]"] = n.This
+			}
+			continue
+		}
+
+		p := pathQuote(key)
+		if k > 0 {
+			p += "{" + strconv.Itoa(k) + "}"
+		}
+		if len(path) != 0 {
+			p = path + "." + p
+		}
+		n.flatten(p, m)
+	}
 }
@@ -0,0 +1,109 @@
+// Copyright 2012-2017, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// EnvFile converts the graph into a list of KEY=value lines, as used in
+// environment files and shell scripts.
+//
+// Each leaf node is a value, and its key is the path to it, in upper case,
+// with the '.' separators (and any other character not allowed in variable
+// names) replaced by '_':
+//
+//    db
+//      host localhost
+//
+// gives DB_HOST=localhost. If a node has several leaf subnodes, the keys are
+// suffixed with their position (KEY_0, KEY_1, ...). Values that contain
+// characters with a special meaning for the shell are single quoted.
+func (g *Graph) EnvFile() string {
+	if g == nil {
+		return ""
+	}
+
+	buffer := &bytes.Buffer{}
+
+	// Do not print the 'root' node
+	g.env("", buffer)
+
+	return buffer.String()
+}
+
+func (g *Graph) env(key string, buffer *bytes.Buffer) {
+
+	leaves := 0
+	for _, n := range g.Out {
+		if n.Len() == 0 && n.This != nil {
+			leaves++
+		}
+	}
+
+	i := 0
+	for _, n := range g.Out {
+		if n.This == nil {
+			n.env(key, buffer)
+			continue
+		}
+
+		if n.Len() != 0 {
+			k := envKey(n.ThisString())
+			if len(key) != 0 {
+				k = key + "_" + k
+			}
+			n.env(k, buffer)
+			continue
+		}
+
+		// Leaf nodes at the top level have no key: they are the key.
+		if len(key) == 0 {
+			buffer.WriteString(envKey(n.ThisString()))
+			buffer.WriteString("=\n")
+			continue
+		}
+
+		k := key
+		if leaves > 1 {
+			k += "_" + strconv.Itoa(i)
+		}
+		i++
+
+		buffer.WriteString(k)
+		buffer.WriteByte('=')
+		buffer.WriteString(envQuote(n.ThisString()))
+		buffer.WriteByte('\n')
+	}
+}
+
+// envKey converts a string into a valid environment variable name.
+func envKey(s string) string {
+	b := []byte(strings.ToUpper(s))
+	for i, c := range b {
+		if !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '_' {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// envQuote returns the string given single quoted if it contains characters
+// that are special to the shell.
+func envQuote(s string) string {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			continue
+		}
+		if strings.IndexByte("_-.,:/@%+=", c) != -1 {
+			continue
+		}
+		return "'" + strings.Replace(s, "'", "'\\''", -1) + "'"
+	}
+	return s
+}
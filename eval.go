@@ -5,7 +5,8 @@
 package ogdl
 
 import (
-	"strconv"
+	"math"
+	"regexp"
 )
 
 // evalGraph
@@ -72,6 +73,9 @@ func (g *Graph) evalPath(p *Graph) interface{} {
 
 	iknow := false
 
+	// safe is set after a null-safe separator (?.)
+	safe := false
+
 	for i := 0; i < len(p.Out); i++ {
 		n := p.Out[i]
 
@@ -91,13 +95,14 @@ func (g *Graph) evalPath(p *Graph) interface{} {
 
 			itf := g.evalExpression(n.Out[0])
 			ix, ok := _int64(itf)
-			if !ok || ix < 0 {
+			if !ok {
 				return "[] does not evaluate to a valid integer"
 			}
 
+			// Negative indexes count from the end
 			iknow = true
 			nodePrev = node
-			node = node.GetAt(int(ix))
+			node = node.index(int(ix))
 
 		case TypeSelector:
 			if nodePrev == nil || nodePrev.Len() == 0 || i < 1 {
@@ -123,13 +128,14 @@ func (g *Graph) evalPath(p *Graph) interface{} {
 				}
 				node = r
 			} else {
-				i, err := strconv.Atoi(n.Out[0].ThisString())
-				if err != nil || i < 0 {
+				// The selector can be an expression, as in a{i}
+				ix, ok := _int64f(argValue(g.evalExpression(n.Out[0])))
+				if !ok || ix < 0 {
 					return nil
 				}
 
 				// {0} must still be handled: add it to r
-				i++
+				i := int(ix) + 1
 				// of all the nodes with name elemPrev, select the ith.
 				for _, nn := range nodePrev.Out {
 					if nn.ThisString() == elemPrev {
@@ -148,9 +154,28 @@ func (g *Graph) evalPath(p *Graph) interface{} {
 				}
 			}
 
+		case TypeNullSafe:
+			if node == nil {
+				return nil
+			}
+			safe = true
+
 		case "_len":
 			return node.Len()
 
+		case TypeCount:
+			if nodePrev == nil || i < 1 {
+				return nil
+			}
+			elemPrev := p.Out[i-1].ThisString()
+			c := 0
+			for _, nn := range nodePrev.Out {
+				if _string(nn.This) == elemPrev {
+					c++
+				}
+			}
+			return c
+
 		case "_this":
 			return node
 
@@ -187,6 +212,21 @@ func (g *Graph) evalPath(p *Graph) interface{} {
 			nn := node.Node(s)
 
 			if nn == nil {
+				if safe {
+					return nil
+				}
+
+				// Built-in function: name(args)
+				if i == 0 && i+1 < len(p.Out) && p.Out[i+1].ThisString() == TypeGroup {
+					itf, ok, err := g.builtin(s, p.Out[i+1])
+					if err != nil {
+						return err.Error()
+					}
+					if ok {
+						return itf
+					}
+				}
+
 				if node.Len() != 0 {
 					itf, err := g.function(p, node.Out[0].This)
 					if err != nil {
@@ -250,6 +290,16 @@ func (g *Graph) evalExpression(p *Graph) interface{} {
 	case "!":
 		// Unary expression !expr
 		return !g.evalBool(p.Out[0])
+	case "?":
+		// Conditional expression: condition, then, else. Only the branch
+		// taken is evaluated.
+		if p.Len() != 3 {
+			return nil
+		}
+		if g.evalBool(p.Out[0]) {
+			return g.evalExpression(p.Out[1])
+		}
+		return g.evalExpression(p.Out[2])
 	case TypeExpression:
 		return g.evalExpression(p.GetAt(0))
 	case TypePath:
@@ -315,6 +365,8 @@ func (g *Graph) evalBinary(p *Graph) interface{} {
 		return calc(g.evalExpression(n1), i2, '/')
 	case "%":
 		return calc(g.evalExpression(n1), i2, '%')
+	case "**":
+		return calc(g.evalExpression(n1), i2, '^')
 
 	case "=":
 		return g.assign(n1, i2, '=')
@@ -342,6 +394,11 @@ func (g *Graph) evalBinary(p *Graph) interface{} {
 	case "<":
 		return compare(g.evalExpression(n1), i2, '<')
 
+	case "=~":
+		return match(g.evalExpression(n1), i2, false)
+	case "!~":
+		return match(g.evalExpression(n1), i2, true)
+
 	case "&&":
 		return logic(g.evalExpression(n1), i2, '&')
 	case "||":
@@ -352,6 +409,41 @@ func (g *Graph) evalBinary(p *Graph) interface{} {
 	return nil
 }
 
+// comparisons maps the comparison operators of expressions to the operation
+// codes of compare.
+var comparisons = map[string]int{"==": '=', ">=": '+', "<=": '-', "!=": '!', ">": '>', "<": '<'}
+
+// evalFilter evaluates the expression of a filter, as in [?price > 10], with
+// g as context. It is like evalExpression, except that paths that are
+// compared stand for their value (see pathValue), so that price > 10 compares
+// the numbers.
+func (g *Graph) evalFilter(p *Graph) interface{} {
+
+	switch s := p.ThisString(); s {
+	case TypeExpression:
+		return g.evalFilter(p.GetAt(0))
+	case "&&", "||":
+		if p.Len() == 2 {
+			return logic(g.evalFilter(p.Out[0]), g.evalFilter(p.Out[1]), int(s[0]))
+		}
+	case "?":
+		if p.Len() == 3 {
+			if b, _ := _boolf(g.evalFilter(p.Out[0])); b {
+				return g.evalFilter(p.Out[1])
+			}
+			return g.evalFilter(p.Out[2])
+		}
+	}
+
+	if op, ok := comparisons[p.ThisString()]; ok && p.Len() == 2 {
+		v1 := pathValue(g.evalExpression(p.Out[0]))
+		v2 := pathValue(g.evalExpression(p.Out[1]))
+		return compare(v1, v2, op)
+	}
+
+	return g.evalExpression(p)
+}
+
 // int* | float* | string
 // first element determines type
 func compare(v1, v2 interface{}, op int) bool {
@@ -404,18 +496,54 @@ func compare(v1, v2 interface{}, op int) bool {
 		return false
 	}
 
+	// Strings are ordered lexicographically (byte-wise)
 	s1 := _string(v1)
 	s2 := _string(v2)
 
 	switch op {
 	case '=':
 		return s1 == s2
+	case '+':
+		return s1 >= s2
+	case '-':
+		return s1 <= s2
+	case '>':
+		return s1 > s2
+	case '<':
+		return s1 < s2
 	case '!':
 		return s1 != s2
 	}
 	return false
 }
 
+// pathValue reduces the result of a path that points to a single leaf to the
+// value of that leaf, converted to a number if it is one. Other values are
+// returned as is.
+func pathValue(v interface{}) interface{} {
+	if _, ok := v.(*Graph); !ok {
+		return v
+	}
+	v = argValue(v)
+	if n := number(v); n != nil {
+		return n
+	}
+	return v
+}
+
+// match returns true if the string value of v1 matches the regular
+// expression given in v2 (or false, if not is set). An invalid regular
+// expression returns an error.
+func match(v1, v2 interface{}, not bool) interface{} {
+
+	re, err := regexp.Compile(_string(v2))
+	if err != nil {
+		return err
+	}
+
+	return re.MatchString(_string(argValue(v1))) != not
+}
+
 func logic(i1, i2 interface{}, op int) bool {
 
 	b1, ok1 := _boolf(i1)
@@ -435,36 +563,36 @@ func logic(i1, i2 interface{}, op int) bool {
 	return false
 }
 
-// assign modifies the context graph
+// assign modifies the context graph. For compound assignments (op being
+// one of + - * / %), the current value at p is combined with v as in calc,
+// a missing or empty value being taken as 0. If the result is undefined, as
+// for an integer division by zero, the graph is left as is and nil returned.
 func (g *Graph) assign(p *Graph, v interface{}, op int) interface{} {
 
 	if op == '=' {
 		return g.set(p, v)
 	}
 
-	// if p doesn't exist, just set it to the value given
-	left := g.get(p)
-	if left != nil {
-		return g.set(p, calc(left.Out[0].This, v, op))
-	}
+	var left interface{} = int64(0)
 
-	switch op {
-	case '+':
-		return g.set(p, v)
-	case '-':
-		return g.set(p, calc(0, v, '-'))
-	case '*':
-		return g.set(p, 0)
-	case '/':
-		return g.set(p, "infinity")
-	case '%':
-		return g.set(p, "undefined")
+	if n := g.get(p); n != nil && n.Len() != 0 {
+		left = n.Out[0].This
+		if nn := number(left); nn != nil {
+			left = nn
+		}
 	}
 
-	return nil
+	r := calc(left, v, op)
+	if r == nil {
+		return nil
+	}
+	return g.set(p, r)
 }
 
 // calc: int64 | float64 | string
+//
+// The operator '^' is the power (** in expressions). An integer division or
+// modulo by zero returns nil.
 func calc(v1, v2 interface{}, op int) interface{} {
 
 	i1, ok := _int64(v1)
@@ -489,9 +617,20 @@ func calc(v1, v2 interface{}, op int) interface{} {
 		case '*':
 			return i1 * i2
 		case '/':
+			if i2 == 0 {
+				return nil
+			}
 			return i1 / i2
 		case '%':
+			if i2 == 0 {
+				return nil
+			}
 			return i1 % i2
+		case '^':
+			if i2 < 0 {
+				return math.Pow(float64(i1), float64(i2))
+			}
+			return ipow(i1, i2)
 		}
 	}
 	if ok3 && ok4 {
@@ -505,7 +644,9 @@ func calc(v1, v2 interface{}, op int) interface{} {
 		case '/':
 			return i3 / i4
 		case '%':
-			return int(i3) % int(i4)
+			return math.Mod(i3, i4)
+		case '^':
+			return math.Pow(i3, i4)
 		}
 	}
 	if ok && ok4 {
@@ -520,7 +661,9 @@ func calc(v1, v2 interface{}, op int) interface{} {
 		case '/':
 			return i3 / i4
 		case '%':
-			return i1 % int64(i4)
+			return math.Mod(i3, i4)
+		case '^':
+			return math.Pow(i3, i4)
 		}
 	}
 	if ok3 && ok2 {
@@ -535,7 +678,9 @@ func calc(v1, v2 interface{}, op int) interface{} {
 		case '/':
 			return i3 / i4
 		case '%':
-			return int64(i3) % i2
+			return math.Mod(i3, i4)
+		case '^':
+			return math.Pow(i3, i4)
 		}
 	}
 
@@ -545,3 +690,16 @@ func calc(v1, v2 interface{}, op int) interface{} {
 
 	return _string(v1) + _string(v2)
 }
+
+// ipow returns base**exp for a non-negative exp, by repeated squaring.
+func ipow(base, exp int64) int64 {
+	r := int64(1)
+	for exp > 0 {
+		if exp&1 == 1 {
+			r *= base
+		}
+		base *= base
+		exp >>= 1
+	}
+	return r
+}
@@ -62,6 +62,25 @@ func (e *eventHandler) Add(s string) bool {
 	return true
 }
 
+// AddNull creates a node without content (nil) at the current level.
+func (e *eventHandler) AddNull() bool {
+
+	if len(e.gl) == 0 {
+		e.gl = append(e.gl, New())
+	}
+
+	for len(e.gl) < e.level+2 {
+		e.gl = append(e.gl, nil)
+	}
+
+	if e.gl[e.level] == nil {
+		return false
+	}
+
+	e.gl[e.level+1] = e.gl[e.level].Add(nil)
+	return true
+}
+
 // Delete removes the last event added
 func (e *eventHandler) Delete() {
 	g := e.gl[e.level]
@@ -71,6 +90,14 @@ func (e *eventHandler) Delete() {
 	e.gl[e.level+1] = g.Out[n-2]
 }
 
+// Last returns the last node created at the specified level, or nil.
+func (e *eventHandler) Last(l int) *Graph {
+	if l < 0 || l+1 >= len(e.gl) {
+		return nil
+	}
+	return e.gl[l+1]
+}
+
 // AddAt creates a node at the specified level
 func (e *eventHandler) AddAt(s string, l int) {
 	e.level = l - 1
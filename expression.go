@@ -19,6 +19,28 @@ func NewExpression(s string) *Graph {
 	return g
 }
 
+// Operator returns the operator of an expression node, as in + or ==, and
+// true, or false if the node is not an operator. In a binary expression the
+// operator node has the two operands as subnodes. A unary operator, as in
+// !a, precedes its operand.
+func (g *Graph) Operator() (string, bool) {
+	if g == nil {
+		return "", false
+	}
+
+	s, ok := g.This.(string)
+	if !ok || len(s) == 0 || len(s) > 2 {
+		return "", false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !isOperatorChar(int(s[i])) {
+			return "", false
+		}
+	}
+	return s, true
+}
+
 // Ast reorganizes the expression graph in the form of an abstract syntax tree.
 func (g *Graph) ast() {
 
@@ -37,17 +59,38 @@ func (g *Graph) ast() {
 
 func (g *Graph) _ast() {
 
-	if g.Len() < 3 {
-		return
+	// Subexpressions (in parentheses) are reorganized first
+	for _, node := range g.Out {
+		if node.ThisString() == TypeExpression {
+			node._ast()
+		} else {
+			node.ast()
+		}
 	}
 
-	for _, node := range g.Out {
-		node.ast()
+	g.conditional()
+
+	if g.Len() < 3 {
+		return
 	}
 
 	var e1, e2 *Graph
 
-	for j := 6; j >= 0; j-- {
+	// The power operator is right associative: 2**3**2 is 2**(3**2)
+	for i := len(g.Out) - 2; i > 0; i-- {
+		node := g.Out[i]
+		if precedence(node.ThisString()) == 6 {
+			e1 = g.Out[i-1]
+			e2 = g.Out[i+1]
+			g.Out = append(g.Out[:i-1], g.Out[i:]...)
+			g.Out = append(g.Out[:i], g.Out[i+1:]...)
+			node.Add(e1)
+			node.Add(e2)
+			i--
+		}
+	}
+
+	for j := 5; j >= 0; j-- {
 
 		for i := 0; i < len(g.Out); i++ {
 
@@ -66,8 +109,12 @@ func (g *Graph) _ast() {
 }
 
 // Precedence is same as in Go, except for the missing operators (| << >> & ^ &^)
+// and the power operator (**), which Go does not have and which binds more
+// tightly than * and /.
 //
-// Assignment operators are given the lowest precedence.
+// Assignment operators are given the lowest precedence. The conditional
+// expression (a ? b : c) is not a binary operator and is handled apart, but
+// it binds between assignments and ||.
 func precedence(s string) int {
 
 	switch s {
@@ -82,6 +129,8 @@ func precedence(s string) int {
 		return 5
 	case "%":
 		return 5
+	case "**":
+		return 6
 
 	case "=":
 		return 0
@@ -108,6 +157,10 @@ func precedence(s string) int {
 		return 3
 	case "<":
 		return 3
+	case "=~":
+		return 3
+	case "!~":
+		return 3
 
 	case "||":
 		return 1
@@ -117,3 +170,30 @@ func precedence(s string) int {
 
 	return -1
 }
+
+// conditional completes a conditional expression (a ? b : c), whose ? node
+// holds only the two branches after parsing, by moving the condition into it
+// as its first subnode. The condition is everything before the ? node up to
+// an assignment operator, since the conditional has a lower precedence than
+// any other operator except assignments.
+func (g *Graph) conditional() {
+
+	q := len(g.Out) - 1
+	if q < 1 || g.Out[q].ThisString() != "?" || g.Out[q].Len() != 2 {
+		return
+	}
+
+	k := q - 1
+	for k >= 0 && precedence(g.Out[k].ThisString()) != 0 {
+		k--
+	}
+
+	cond := New(TypeExpression)
+	cond.Out = append(cond.Out, g.Out[k+1:q]...)
+	cond._ast()
+
+	node := g.Out[q]
+	node.Out = append([]*Graph{cond}, node.Out...)
+
+	g.Out = append(g.Out[:k+1], node)
+}
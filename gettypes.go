@@ -11,6 +11,7 @@ import (
 	"reflect"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -41,7 +42,8 @@ func (g *Graph) Find(re string) (*Graph, error) {
 }
 
 // Int64 returns the node as an int64. If the node is not a number, it
-// returns 0, or the default value if given.
+// returns 0, or the default value if given. Surrounding white space and a
+// leading + sign are accepted.
 func (g *Graph) Int64(def ...int64) int64 {
 	n, ok := _int64f(g.String())
 	if !ok {
@@ -86,11 +88,17 @@ func (g *Graph) Value() reflect.Value {
 	return reflect.ValueOf(g.Interface())
 }
 
-// String returns a string representation of this node, or an empty string.
+// String returns the content of the first subnode as a string, that is, the
+// value of a node such as 'port 80', or an empty string if there is no
+// subnode. Use ThisString for the content of the node itself.
+//
+// Contents other than strings are given in their canonical text form: []byte
+// as is, int64(80) as "80", float64(1.5) as "1.5", true as "true", and nil as
+// an empty string. Other types are formatted with fmt.Sprint.
+//
 // This function doesn't return an error, because it is mostly used in single
-// variable return situations.
-// String accepts one default value, which will be returned instead of an
-// empty string.
+// variable return situations. String accepts one default value, which is
+// returned instead of an empty string if g is nil.
 func (g *Graph) String(def ...string) string {
 
 	// If g is nil, return default or nothing
@@ -104,7 +112,9 @@ func (g *Graph) String(def ...string) string {
 	return _string(g.Interface())
 }
 
-// ThisString returns the current node content as a string
+// ThisString returns the content of this node as a string, following the
+// same rules as String, which looks at the first subnode instead. A default
+// value can be given for when g is nil.
 func (g *Graph) ThisString(def ...string) string {
 
 	// If g is nil, return default or nothing
@@ -125,6 +135,9 @@ func (g *Graph) Bytes() []byte {
 
 // ThisBytes returns the node as []byte, or nil if not possble.
 func (g *Graph) ThisBytes() []byte {
+	if g == nil {
+		return nil
+	}
 	return _bytes(g.This)
 }
 
@@ -138,55 +151,82 @@ func (g *Graph) ThisNumber() interface{} {
 	return number(g.This)
 }
 
-// ThisInt64 returns a int64 or nil
+// ThisInt64 returns the content of this node as an int64, converting it if
+// it is a string or []byte that represents an integer, as parsed text is.
+// The boolean returned is false if that is not possible.
 func (g *Graph) ThisInt64() (int64, bool) {
+	if g == nil {
+		return 0, false
+	}
 	return _int64f(g.This)
 }
 
-// Scalar returns the current node content, reducing the number of types
-// following these rules:
-//
-//     uint* -> int64
-//     int*  -> int64
-//     float* -> float64
-//     byte -> int64
-//     rune -> int64
-//     bool -> bool
-//     string, []byte: if it represents an int or float or bool,
-//       convert to int64, float64 or bool
-//
-// Any other type is returned as is.
-//
-func (g *Graph) Scalar() interface{} {
-
-	itf := g.Interface()
-	if itf == nil && g.Out != nil {
-		itf = g.Out[0].This
+// ThisFloat64 returns the content of this node as a float64, converting it
+// if it is an integer, or a string or []byte that represents a number. The
+// boolean returned is false if that is not possible.
+func (g *Graph) ThisFloat64() (float64, bool) {
+	if g == nil {
+		return 0, false
 	}
+	return _float64f(g.This)
+}
 
-	// If it ca be parsed as a number, return it.
-	n := number(itf)
-	if n != nil {
-		return n
+// ThisBool returns the content of this node as a bool, converting it if it
+// is the string "true" or "false". The boolean returned is false if that is
+// not possible.
+func (g *Graph) ThisBool() (bool, bool) {
+	if g == nil {
+		return false, false
 	}
+	return _boolf(g.This)
+}
 
-	// If it can be parsed as a bool, return it.
-	b, ok := _boolf(itf)
-	if ok {
-		return b
+// Scalar returns the value of this node (its first subnode, as String()
+// does), reduced to a few types by Normalize, or nil if there is no value.
+// Use ThisScalar for the content of the node itself.
+//
+func (g *Graph) Scalar() interface{} {
+	if g == nil {
+		return nil
 	}
+	return Normalize(g.Interface())
+}
 
-	// Else return as is.
-	return itf
+// ScalarString returns the value returned by Scalar() converted to a string.
+// This gives numbers and booleans in their canonical form: a value of 1.50
+// is returned as "1.5".
+func (g *Graph) ScalarString() string {
+	return _string(g.Scalar())
 }
 
-// ThisScalar returns this node's content as an interface
+// ThisScalar returns this node's content following the same rules as
+// Scalar(). If the content is nil, that of the first subnode is used.
 func (g *Graph) ThisScalar() interface{} {
+	if g == nil {
+		return nil
+	}
 
 	itf := g.This
-	if itf == nil && g.Out != nil {
+	if itf == nil && len(g.Out) != 0 {
 		itf = g.Out[0].This
 	}
+	return Normalize(itf)
+}
+
+// Normalize reduces a value to a few native types, following these rules:
+//
+//     uint* -> int64
+//     int*  -> int64
+//     float* -> float64
+//     byte -> int64
+//     rune -> int64
+//     bool -> bool
+//     string, []byte: if it represents an int or float or bool,
+//       convert to int64, float64 or bool, else return it as is
+//
+// Any other type is returned as is. This is how Scalar and ThisScalar read
+// node values, and how Eval reads constants in expressions.
+func Normalize(itf interface{}) interface{} {
 
 	// If it ca be parsed as a number, return it.
 	n := number(itf)
@@ -206,7 +246,7 @@ func (g *Graph) ThisScalar() interface{} {
 
 // Interface returns the first child of this node as an interface
 func (g *Graph) Interface() interface{} {
-	if g.Out != nil && len(g.Out) != 0 {
+	if g != nil && len(g.Out) != 0 {
 		return g.Out[0].This
 	}
 	return nil
@@ -250,6 +290,23 @@ func number(itf interface{}) interface{} {
 	return n
 }
 
+// GetValue resolves a path and returns the value found there, reduced as in
+// Scalar(). If the node found has exactly one subnode, and that is a leaf,
+// as in 'port 8080', its value is returned (8080). Otherwise the content of
+// the node itself is returned. It returns nil if the path is not found.
+//
+// (Value() returns the reflect.Value of the first subnode.)
+func (g *Graph) GetValue(path string) interface{} {
+	n := g.Get(path)
+	if n == nil {
+		return nil
+	}
+	if len(n.Out) == 1 && n.Out[0].Len() == 0 {
+		return Normalize(n.Out[0].This)
+	}
+	return Normalize(n.This)
+}
+
 // GetString returns the result of applying a path to the given Graph.
 // The result is returned as a string.
 // If the error information is not used, then this method is equivalent
@@ -269,6 +326,23 @@ func (g *Graph) GetString(path string) (string, error) {
 	return _string(i.Out[0].This), nil
 }
 
+// Lines returns the result of applying a path to the given Graph, split
+// into lines. It is meant for reading block text values line by line.
+// An empty slice is returned if the path is not found or the value is empty.
+func (g *Graph) Lines(path string) []string {
+
+	s, err := g.GetString(path)
+	if err != nil || len(s) == 0 {
+		return []string{}
+	}
+
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSuffix(l, "\r")
+	}
+	return lines
+}
+
 // GetBytes returns the result of applying a path to the given Graph.
 // The result is returned as a byte slice.
 func (g *Graph) GetBytes(path string) ([]byte, error) {
@@ -404,12 +478,12 @@ func _int64f(i interface{}) (int64, bool) {
 
 	switch v := i.(type) {
 	case []byte:
-		n, error := strconv.ParseInt(string(v), 10, 64)
+		n, error := strconv.ParseInt(strings.TrimSpace(string(v)), 10, 64)
 		if error == nil {
 			return n, true
 		}
 	case string:
-		n, error := strconv.ParseInt(v, 10, 64)
+		n, error := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
 		if error == nil {
 			return n, true
 		}
@@ -486,6 +560,7 @@ func _boolf(i interface{}) (bool, bool) {
 	return false, false
 }
 
+// _string converts a node content to its canonical text form (see String).
 func _string(i interface{}) string {
 	if i == nil {
 		return ""
@@ -551,7 +626,7 @@ func _show(i interface{}) string {
 	return fmt.Sprint(i)
 }
 
-// _typeOf: this function is used in tests
+// _typeOf returns the name of the type of i, or "" if it is nil.
 func _typeOf(i interface{}) string {
 	if i == nil {
 		return ""
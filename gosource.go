@@ -0,0 +1,100 @@
+// Copyright 2012-2017, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// GoSource returns Go code that rebuilds the graph with New and Add, and
+// assigns it to a variable with the name given. For example, a graph with
+// the text 'a 1' is converted to:
+//
+//    g := ogdl.New()
+//    g1 := g.Add("a")
+//    g1.Add("1")
+//
+// Values keep their type: strings are quoted, int64 values are written as
+// int64(N), and so on. Infinite and NaN floats are written as math.Inf(1) and
+// math.NaN(), which need the math package. Nodes with subnodes are assigned
+// to variables named as the graph with a number appended. The code is meant
+// for tests and fixtures, and uses the ogdl package prefix.
+func (g *Graph) GoSource(varName string) string {
+
+	buffer := &bytes.Buffer{}
+
+	buffer.WriteString(varName)
+	buffer.WriteString(" := ogdl.New()\n")
+
+	if g != nil {
+		if g.This != nil {
+			buffer.WriteString(varName + ".This = " + goLiteral(g.This) + "\n")
+		}
+		n := 0
+		g.goSource(varName, varName, &n, buffer)
+	}
+
+	return buffer.String()
+}
+
+func (g *Graph) goSource(name, varName string, n *int, buffer *bytes.Buffer) {
+	for _, node := range g.Out {
+		if node.Len() == 0 {
+			buffer.WriteString(name + ".Add(" + goLiteral(node.This) + ")\n")
+			continue
+		}
+
+		*n++
+		v := varName + strconv.Itoa(*n)
+		buffer.WriteString(v + " := " + name + ".Add(" + goLiteral(node.This) + ")\n")
+		node.goSource(v, varName, n, buffer)
+	}
+}
+
+// goLiteral returns the Go literal for a value.
+func goLiteral(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return strconv.Quote(v)
+	case []byte:
+		return "[]byte(" + strconv.Quote(string(v)) + ")"
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return goFloat(v, 64)
+	case float32:
+		return goFloat(float64(v), 32)
+	case int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%T(%d)", v, v)
+	}
+	return fmt.Sprintf("%#v", v)
+}
+
+// goFloat returns the Go expression for a float of the given size, as in
+// float64(1.5), float32(math.Inf(-1)) or math.NaN().
+func goFloat(f float64, bits int) string {
+	var s string
+	switch {
+	case math.IsNaN(f):
+		s = "math.NaN()"
+	case math.IsInf(f, 1):
+		s = "math.Inf(1)"
+	case math.IsInf(f, -1):
+		s = "math.Inf(-1)"
+	default:
+		return "float" + strconv.Itoa(bits) + "(" + strconv.FormatFloat(f, 'g', -1, bits) + ")"
+	}
+	if bits == 32 {
+		return "float32(" + s + ")"
+	}
+	return s
+}
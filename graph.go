@@ -6,7 +6,12 @@ package ogdl
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -29,7 +34,7 @@ func New(n ...interface{}) *Graph {
 
 // IsNil returns true is this node has no content.
 func (g *Graph) IsNil() bool {
-	return g.This == nil
+	return g == nil || g.This == nil
 }
 
 // Len returns the number of subnodes (outgoing edges, out degree) of this node.
@@ -48,32 +53,68 @@ func (g *Graph) ThisType() string {
 // Depth returns the depth of the graph if it is a tree, or -1 if it has
 // cycles.
 //
-// TODO: Cycles are inferred if level>100, but nodes traversed are not
-// remembered (they should if cycles need to be detected).
+// The nodes on the path being traversed are remembered, so that a cycle is
+// detected as soon as a node is found again below itself. Nodes shared by
+// several parents (but not cyclic) are not a cycle.
 func (g *Graph) Depth() int {
+	return g.depth(make(map[*Graph]bool))
+}
+
+func (g *Graph) depth(path map[*Graph]bool) int {
 
 	if g == nil || g.Len() == 0 {
 		return 0
 	}
 
+	if path[g] {
+		return -1
+	}
+	path[g] = true
+	defer delete(path, g)
+
 	i := 0
 	for _, n := range g.Out {
-		j := n.Depth()
+		j := n.depth(path)
+		if j < 0 {
+			return -1
+		}
 		if j > i {
 			i = j
 		}
 	}
 
-	if i > 100 {
-		return -1
-	}
 	return i + 1
 }
 
 // Equals returns true if the given graph and the receiver graph are equal.
+// It can be called with nil graphs: two nil graphs are equal, and a nil graph
+// is not equal to one that is not nil.
+//
+// Pairs of nodes already compared are remembered, so that subgraphs shared
+// between several nodes are compared only once, and graphs with cycles
+// don't cause an endless recursion.
 func (g *Graph) Equals(c *Graph) bool {
+	return g.equals(c, make(map[[2]*Graph]bool))
+}
+
+func (g *Graph) equals(c *Graph, visited map[[2]*Graph]bool) bool {
+
+	if g == c {
+		return true
+	}
+	if g == nil || c == nil {
+		return false
+	}
+
+	// A pair already visited is either equal or still being compared
+	// further up (a cycle), in which case the answer is given there.
+	key := [2]*Graph{g, c}
+	if visited[key] {
+		return true
+	}
+	visited[key] = true
 
-	if c.This != g.This {
+	if !equalValues(c.This, g.This) {
 		return false
 	}
 	if g.Len() != c.Len() {
@@ -81,7 +122,59 @@ func (g *Graph) Equals(c *Graph) bool {
 	}
 
 	for i := 0; i < g.Len(); i++ {
-		if !g.Out[i].Equals(c.Out[i]) {
+		if !g.Out[i].equals(c.Out[i], visited) {
+			return false
+		}
+	}
+	return true
+}
+
+// EqualsUnordered is like Equals, but the order of the subnodes does not
+// matter, as for documents that represent sets: two nodes are equal if they
+// have the same content and their subnodes can be paired so that the nodes
+// in each pair are equal in turn. Repeated subnodes must appear the same
+// number of times in both graphs.
+func (g *Graph) EqualsUnordered(c *Graph) bool {
+	return g.equalsUnordered(c, make(map[[2]*Graph]bool))
+}
+
+// equalsUnordered keeps the pairs of nodes being compared in path, not all
+// those visited as equals does, because a pair that does not match may be
+// compared again while looking for another one that does.
+func (g *Graph) equalsUnordered(c *Graph, path map[[2]*Graph]bool) bool {
+
+	if g == c {
+		return true
+	}
+	if g == nil || c == nil {
+		return false
+	}
+
+	// A cycle: the answer is given further up
+	key := [2]*Graph{g, c}
+	if path[key] {
+		return true
+	}
+
+	if !equalValues(c.This, g.This) || g.Len() != c.Len() {
+		return false
+	}
+
+	path[key] = true
+	defer delete(path, key)
+
+	// Equality is an equivalence, so any subnode that matches will do.
+	used := make([]bool, c.Len())
+	for _, n := range g.Out {
+		found := false
+		for j, m := range c.Out {
+			if !used[j] && n.equalsUnordered(m, path) {
+				used[j] = true
+				found = true
+				break
+			}
+		}
+		if !found {
 			return false
 		}
 	}
@@ -107,6 +200,43 @@ func (g *Graph) Add(n interface{}) *Graph {
 	return &gg
 }
 
+// Addf formats its arguments with fmt.Sprintf and adds the resulting string
+// as a subnode. It returns the node added.
+func (g *Graph) Addf(format string, args ...interface{}) *Graph {
+	if g == nil {
+		return nil
+	}
+	return g.Add(fmt.Sprintf(format, args...))
+}
+
+// InsertAt is like Add, but inserts the subnode at position i, moving the
+// subnodes from there on one place to the right. An i that is out of range
+// is clamped: a negative one inserts at the front, and one higher than Len()
+// at the end, as Add does. It returns the node inserted.
+func (g *Graph) InsertAt(i int, n interface{}) *Graph {
+
+	if g == nil {
+		return nil
+	}
+
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(g.Out) {
+		return g.Add(n)
+	}
+
+	node, ok := n.(*Graph)
+	if !ok || node == nil {
+		node = &Graph{n, nil}
+	}
+
+	g.Out = append(g.Out, nil)
+	copy(g.Out[i+1:], g.Out[i:])
+	g.Out[i] = node
+	return node
+}
+
 // AddNodes adds subnodes of the given Graph to the current node.
 func (g *Graph) AddNodes(g2 *Graph) *Graph {
 
@@ -162,6 +292,14 @@ func (g *Graph) Copy(c *Graph) {
 // copying the interface value makes a copy of the struct. If the interface
 // value holds a pointer, copying the interface value makes a copy of the
 // pointer, but not the data it points to.
+//
+// So the structure of the clone is independent of the original, and values
+// such as strings, numbers and structs are copied, but values that are
+// pointers (or slices or maps, including []byte) are shared: modifying the
+// data they point to affects both graphs. Clone on a nil Graph returns nil.
+//
+// A transparent (nil) root, as returned by New() or the parser, is cloned as
+// a transparent root, so that the clone emits and evaluates the same way.
 func (g *Graph) Clone() *Graph {
 	if g == nil {
 		return nil
@@ -192,6 +330,44 @@ func (g *Graph) Node(s string) *Graph {
 	return nil
 }
 
+// NodeScalar returns the first subnode whose value equals v, when both are
+// reduced as in Scalar(): numbers are compared by value regardless of their
+// type or representation, so that an int64 2, a float64 2.0 and the strings
+// "2" and "2.0" match each other. Other values are compared as strings. It
+// returns nil if not found.
+func (g *Graph) NodeScalar(v interface{}) *Graph {
+
+	if g == nil {
+		return nil
+	}
+	for _, node := range g.Out {
+		if node != nil && scalarEquals(node.This, v) {
+			return node
+		}
+	}
+
+	return nil
+}
+
+// scalarEquals compares two values as NodeScalar does.
+func scalarEquals(a, b interface{}) bool {
+	na := number(a)
+	nb := number(b)
+
+	if na != nil && nb != nil {
+		i1, ok1 := na.(int64)
+		i2, ok2 := nb.(int64)
+		if ok1 && ok2 {
+			return i1 == i2
+		}
+		f1, _ := _float64f(na)
+		f2, _ := _float64f(nb)
+		return f1 == f2
+	}
+
+	return _string(Normalize(a)) == _string(Normalize(b))
+}
+
 // Create returns the first subnode whose string value is equal to the given string,
 // with its subnodes deleted. If not found, the node is created and returned.
 func (g *Graph) Create(s string) *Graph {
@@ -205,13 +381,71 @@ func (g *Graph) Create(s string) *Graph {
 
 // GetAt returns a subnode by index, or nil if the index is out of range.
 func (g *Graph) GetAt(i int) *Graph {
-	if i >= len(g.Out) || i < 0 {
+	if g == nil || i >= len(g.Out) || i < 0 {
 		return nil
 	}
 
 	return g.Out[i]
 }
 
+// index returns the subnode at position i, as GetAt, but a negative i counts
+// from the end, as used in path indexes: -1 is the last subnode. It returns
+// nil if i is out of range.
+func (g *Graph) index(i int) *Graph {
+	if i < 0 {
+		i += g.Len()
+	}
+	return g.GetAt(i)
+}
+
+// First returns the first subnode, or nil if there are none.
+func (g *Graph) First() *Graph {
+	if g.Len() == 0 {
+		return nil
+	}
+	return g.Out[0]
+}
+
+// Last returns the last subnode, or nil if there are none.
+func (g *Graph) Last() *Graph {
+	if g.Len() == 0 {
+		return nil
+	}
+	return g.Out[len(g.Out)-1]
+}
+
+// Keys returns the content of the subnodes, as strings, in order and with
+// repetitions. The slice returned is empty, not nil, if there are no
+// subnodes.
+func (g *Graph) Keys() []string {
+	keys := make([]string, 0, g.Len())
+	if g == nil {
+		return keys
+	}
+	for _, n := range g.Out {
+		if n != nil {
+			keys = append(keys, _string(n.This))
+		}
+	}
+	return keys
+}
+
+// UniqueKeys is like Keys, but returns each key only once, in order of first
+// appearance.
+func (g *Graph) UniqueKeys() []string {
+	keys := g.Keys()
+	seen := make(map[string]bool)
+
+	r := keys[:0]
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			r = append(r, key)
+		}
+	}
+	return r
+}
+
 // Get recurses a Graph following a given path and returns the result.
 //
 // This function returns a *Graph in any condition. When there is nothing to
@@ -221,16 +455,57 @@ func (g *Graph) GetAt(i int) *Graph {
 //
 // OGDL Path:
 // elements are separated by '.' or [] or {}
-// index := [N]
+// index := [N] | [N,M,...] | [N:M]
 // selector := {N}
+// count := # (only as the last element)
+// wildcard := *
+// filter := [?expression]
 // tokens can be quoted
 //
+// A trailing # returns the number of occurrences of the preceding element
+// among its siblings, so that a.b# counts the b nodes under a (while a._len
+// counts all subnodes of a).
+//
+// An index list, as in a.b[0,2,4], returns a transparent Graph with the
+// subnodes at those positions. Indexes that are out of range are skipped.
+// Negative indexes count from the end: a[-1] is the last subnode of a.
+//
+// A wildcard, as in a.*.b, stands for all the subnodes of the node reached,
+// and the rest of the path is followed from each of them. The result is a
+// transparent Graph with all the matches, or nil if there are none.
+//
+// A slice, as in a[1:3], returns a transparent Graph with the subnodes from
+// the first position up to, but not including, the second one. Any of them
+// can be omitted, as in a[2:] or a[:3], and they can be negative. Positions
+// out of range are clamped, and nil is returned if the slice is empty.
+//
+// A filter, as in a.b[?price > 10], returns a transparent Graph with the
+// occurrences of the preceding token (all the b nodes under a) for which the
+// expression is true, evaluated with each of them as context. In the
+// comparisons of a filter, a path to a single value stands for that value,
+// so that price > 10 compares numbers. After any
+// other element the node reached is kept if the expression is true for it,
+// so that the path can go on, as in a.*[?price > 10].name. It returns nil if
+// nothing matches.
+//
+// When the path ends in a token, as in a.b, the node b itself is returned.
+// When it ends in an index or selector, as in a[0] or a{0}, the node found is
+// returned wrapped in a transparent node (one with nil content), as is the
+// result of a trailing #. Use Unwrap to remove such a wrapper.
+//
 func (g *Graph) Get(s string) *Graph {
+	return g.GetSep(s, '.')
+}
+
+// GetSep is like Get, but with path elements separated by the given rune
+// instead of '.'. This is useful when keys contain dots, as in
+// GetSep("hosts/example.com/port", '/').
+func (g *Graph) GetSep(s string, sep rune) *Graph {
 	if g == nil {
 		return (*Graph)(nil)
 	}
 	// Parse the input string into a Path graph.
-	path := NewPath(s)
+	path := NewPath(s, sep)
 
 	g = g.get(path)
 	if g == nil {
@@ -253,10 +528,12 @@ func (g *Graph) get(path *Graph) *Graph {
 	// elemPrev = previous path element, used in {}
 	var elemPrev string
 
-	for _, elem := range path.Out {
+	for k, elem := range path.Out {
 
 		p := elem.ThisString()
 
+		// token is set if the previous element was a token
+		token := iknow && k > 0
 		iknow = false
 
 		switch p {
@@ -267,17 +544,90 @@ func (g *Graph) get(path *Graph) *Graph {
 				return nil
 			}
 
+			if elem.Len() > 1 {
+				// List of indexes: [0,2,4]
+				r := New()
+				for _, e := range elem.Out {
+					i, err := strconv.Atoi(e.ThisString())
+					if err != nil {
+						return nil
+					}
+					if n := node.index(i); n != nil {
+						r.Add(n)
+					}
+				}
+				if r.Len() == 0 {
+					return nil
+				}
+				nodePrev = node
+				node = r
+				elemPrev = ""
+				break
+			}
+
 			i, err := strconv.Atoi(elem.Out[0].ThisString())
 			if err != nil {
 				return nil
 			}
 			nodePrev = node
-			node = node.GetAt(i)
+			node = node.index(i)
 			if node == nil {
 				return nil
 			}
 			elemPrev = node.ThisString()
 
+		case TypeSlice:
+
+			if elem.Len() != 2 {
+				return nil
+			}
+
+			from, ok := sliceBound(elem.Out[0], 0, node.Len())
+			if !ok {
+				return nil
+			}
+			to, ok := sliceBound(elem.Out[1], node.Len(), node.Len())
+			if !ok {
+				return nil
+			}
+
+			r := New()
+			for j := from; j < to; j++ {
+				r.Add(node.Out[j])
+			}
+			if r.Len() == 0 {
+				return nil
+			}
+			nodePrev = node
+			node = r
+			elemPrev = ""
+
+		case TypeFilter:
+
+			e := filterExpression(elem)
+
+			if !token {
+				// The node reached is kept if it matches
+				if b, _ := _boolf(node.evalFilter(e)); !b {
+					return nil
+				}
+				break
+			}
+
+			r := New()
+			for _, nn := range nodePrev.Out {
+				if nn != nil && _string(nn.This) == elemPrev {
+					if b, _ := _boolf(nn.evalFilter(e)); b {
+						r.Add(nn)
+					}
+				}
+			}
+			if r.Len() == 0 {
+				return nil
+			}
+			node = r
+			elemPrev = ""
+
 		case TypeSelector:
 
 			if nodePrev == nil || nodePrev.Len() == 0 || len(elemPrev) == 0 {
@@ -327,6 +677,52 @@ func (g *Graph) get(path *Graph) *Graph {
 			nn.Add(node.Len())
 			return nn
 
+		case TypeNullSafe:
+			// Get already returns nil for missing elements
+			continue
+
+		case TypeWildcard:
+			// The rest of the path is followed from each subnode
+			rest := New(path.This)
+			rest.Out = path.Out[k+1:]
+
+			r := New()
+			for _, n := range node.Out {
+				if rest.Len() == 0 {
+					r.Add(n)
+					continue
+				}
+				nn := n.get(rest)
+				if nn == nil {
+					continue
+				}
+				if nn.This == nil {
+					r.AddNodes(nn)
+				} else {
+					r.Add(nn)
+				}
+			}
+			if r.Len() == 0 {
+				return nil
+			}
+			return r
+
+		case TypeCount:
+
+			if nodePrev == nil || len(elemPrev) == 0 {
+				return nil
+			}
+
+			n := 0
+			for _, nn := range nodePrev.Out {
+				if _string(nn.This) == elemPrev {
+					n++
+				}
+			}
+			nn := New()
+			nn.Add(n)
+			return nn
+
 		default:
 
 			iknow = true
@@ -352,232 +748,963 @@ func (g *Graph) get(path *Graph) *Graph {
 	return node
 }
 
-// Delete removes all subnodes with the given content
-func (g *Graph) Delete(n interface{}) {
+// sliceBound returns the position given by one of the ends of a slice, as
+// in [1:3], for a node with n subnodes. An empty expression gives def. A
+// negative position counts from the end, and the result is clamped to the
+// range 0..n.
+func sliceBound(e *Graph, def, n int) (int, bool) {
+	if e.Len() == 0 {
+		return def, true
+	}
 
-	if g == nil {
-		return
+	i, err := strconv.Atoi(e.Out[0].ThisString())
+	if err != nil {
+		return 0, false
 	}
-	for i := 0; i < g.Len(); i++ {
-		if g.Out[i].This == n {
-			if i < (g.Len() - 1) {
-				g.Out = append(g.Out[:i], g.Out[i+1:]...)
-			} else {
-				g.Out = g.Out[:i]
-			}
-			i--
-		}
+	if i < 0 {
+		i += n
 	}
-}
-
-// Clear removes all subnodes
-func (g *Graph) Clear() {
-
-	if g == nil || g.Out == nil {
-		return
+	if i < 0 {
+		i = 0
 	}
-	g.Out = nil
+	if i > n {
+		i = n
+	}
+	return i, true
 }
 
-// DeleteAt removes a subnode by index
-func (g *Graph) DeleteAt(i int) {
-	if i < 0 || i >= g.Len() {
-		return
-	}
-	if i < (g.Len() - 1) {
-		g.Out = append(g.Out[:i], g.Out[i+1:]...)
-	} else {
-		g.Out = g.Out[:i]
+// filterExpression returns the expression of a filter path element, as in
+// [?price > 10], ready to be evaluated.
+func filterExpression(elem *Graph) *Graph {
+	e := New(TypeExpression)
+	for _, n := range elem.Out {
+		e.Add(n.Clone())
 	}
+	e._ast()
+	return e
 }
 
-// Set sets the first occurrence of the given path to the value given.
-//
-// TODO: Support indexes
-func (g *Graph) Set(s string, val interface{}) *Graph {
+// Parent resolves the given path like Get, but returns the node that
+// contains the node found, instead of the node itself. For a path with only
+// one element the receiver is returned. It returns nil if the path cannot be
+// resolved.
+func (g *Graph) Parent(s string) *Graph {
 	if g == nil {
 		return nil
 	}
 
-	// Parse the input string into a Path graph.
 	path := NewPath(s)
-
-	if path == nil {
+	if path == nil || path.Len() == 0 || g.get(path) == nil {
 		return nil
 	}
-	return g.set(path, val)
-}
-
-// TODO: Clean this code:
-func (g *Graph) set(path *Graph, val interface{}) *Graph {
-
-	node := g
-
-	i := 0
-	var prev *Graph
 
-	for ; i < len(path.Out); i++ {
+	if path.Len() == 1 {
+		return g
+	}
 
-		prev = node
+	prefix := New(path.This)
+	prefix.Out = path.Out[:path.Len()-1]
 
-		elem := path.Out[i]
-		if elem.ThisString() == TypeIndex {
-			i := elem.Int64()
-			if len(node.Out) <= int(i) {
-				o := make([]*Graph, i+1)
-				for j, n := range node.Out {
-					o[j] = n
-				}
-				node.Out = o
-			}
-			node.Out[i] = New(val)
-			return node.Out[i]
-		}
-		node = node.Node(elem.ThisString())
+	node := g.get(prefix)
 
-		if node == nil {
-			break
-		}
+	// A path ending in an index or selector returns a wrapped node
+	switch prefix.Out[prefix.Len()-1].ThisString() {
+	case TypeIndex, TypeSelector:
+		node = node.Unwrap()
 	}
 
-	if node == nil {
-		node = prev
+	return node
+}
 
-		for ; i < len(path.Out); i++ {
-			elem := path.Out[i]
+// GetAll resolves the given path like Get, but when it ends in a token
+// returns all the subnodes with that value, instead of only the first one.
+// Intermediate elements of the path follow the first match, as in Get. When
+// the path ends in an index or selector, the nodes found are returned without
+// the transparent wrapper. The slice returned is empty, not nil, if nothing
+// is found.
+func (g *Graph) GetAll(s string) []*Graph {
 
-			if elem.ThisString() == TypeIndex {
-				i := elem.Int64()
-				if len(node.Out) <= int(i) {
-					o := make([]*Graph, i+1)
-					for j, n := range node.Out {
-						o[j] = n
-					}
-					node.Out = o
-				}
-				node.Out[i] = New(val)
-				return node.Out[i]
-			}
+	r := []*Graph{}
 
-			node = node.Add(elem.This)
-		}
+	path := NewPath(s)
+	if g == nil || path == nil || path.Len() == 0 {
+		return r
 	}
 
-	node.Out = nil
+	last := path.Out[path.Len()-1]
 
-	return node.Add(val)
-}
+	// A wildcard already collects the matches from all subnodes
+	all := path.Node(TypeWildcard) != nil
 
-// Text is the OGDL text emitter. It converts a Graph into OGDL text.
-//
-// Strings are quoted if they contain spaces, newlines or special
-// characters. Null elements are not printed, and act as transparent nodes.
-//
-// BUG():Handle comments correctly.
-// BUG(): 2 times almost the same code:
-func (g *Graph) Text() string {
-	if g == nil {
-		return ""
+	switch last.ThisString() {
+	case TypeIndex, TypeSlice, TypeFilter, TypeSelector, TypeCount, TypeNullSafe, "_len":
+		all = true
 	}
 
-	buffer := &bytes.Buffer{}
-
-	// Do not print the 'root' node
-	for _, node := range g.Out {
-		node._text(0, buffer, false)
+	if all {
+		n := g.get(path)
+		if n == nil {
+			return r
+		}
+		if n.This != nil {
+			return append(r, n)
+		}
+		for _, nn := range n.Out {
+			r = append(r, nn)
+		}
+		return r
 	}
 
-	// remove trailing \n
+	node := g
+	if path.Len() > 1 {
+		prefix := New(path.This)
+		prefix.Out = path.Out[:path.Len()-1]
 
-	s := buffer.String()
+		node = g.get(prefix)
 
-	if len(s) == 0 {
-		return ""
+		// A path ending in an index returns a wrapped node. A selector
+		// already returns the subnodes of the nodes selected.
+		if prefix.Out[prefix.Len()-1].ThisString() == TypeIndex {
+			node = node.Unwrap()
+		}
 	}
 
-	if s[len(s)-1] == '\n' {
-		s = s[0 : len(s)-1]
+	if node == nil {
+		return r
 	}
 
-	// unquote
-
-	if s[0] == '"' {
-		s = s[1 : len(s)-1]
-		// But then also replace \"
-		s = strings.Replace(s, "\\\"", "\"", -1)
+	key := last.ThisString()
+	for _, n := range node.Out {
+		if _string(n.This) == key {
+			r = append(r, n)
+		}
 	}
+	return r
+}
 
-	return s
+// ParentOf searches the graph below g (g included) for the node that has
+// child as a direct subnode, and returns it. It returns nil if child is not
+// found, as is the case for g itself (unless the graph has a cycle through
+// g). Nodes do not keep a reference to their parent, so this is a search
+// through the whole graph, depth first. A node that appears in several places
+// (as when subgraphs are shared) has several parents: the first one found is
+// returned.
+func (g *Graph) ParentOf(child *Graph) *Graph {
+	if child == nil {
+		return nil
+	}
+	return g.parentOf(child, make(map[*Graph]bool))
 }
 
-// Show prints the Graph as text including this (the top) node.
-func (g *Graph) Show() string {
-	if g == nil {
-		return ""
+func (g *Graph) parentOf(child *Graph, visited map[*Graph]bool) *Graph {
+	if g == nil || visited[g] {
+		return nil
 	}
+	visited[g] = true
 
+	for _, n := range g.Out {
+		if n == child {
+			return g
+		}
+	}
+	for _, n := range g.Out {
+		if p := n.parentOf(child, visited); p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// Unwrap returns the only subnode of a transparent node (one with nil
+// content), as those returned by Get for paths ending in an index. Any other
+// node, including a transparent node with several subnodes, is returned as
+// is.
+func (g *Graph) Unwrap() *Graph {
+	if g == nil || g.This != nil || len(g.Out) != 1 {
+		return g
+	}
+	return g.Out[0]
+}
+
+// Delete removes all subnodes with the given content
+func (g *Graph) Delete(n interface{}) {
+
+	if g == nil {
+		return
+	}
+	for i := 0; i < g.Len(); i++ {
+		if g.Out[i].This == n {
+			if i < (g.Len() - 1) {
+				g.Out = append(g.Out[:i], g.Out[i+1:]...)
+			} else {
+				g.Out = g.Out[:i]
+			}
+			i--
+		}
+	}
+}
+
+// Clear removes all subnodes
+func (g *Graph) Clear() {
+
+	if g == nil || g.Out == nil {
+		return
+	}
+	g.Out = nil
+}
+
+// Truncate keeps only the first n subnodes, removing the rest. If n <= 0 all
+// subnodes are removed. Nothing is done if n >= Len().
+func (g *Graph) Truncate(n int) {
+	if g == nil || n >= g.Len() {
+		return
+	}
+	if n <= 0 {
+		g.Out = nil
+		return
+	}
+	g.Out = g.Out[:n]
+}
+
+// DeleteAt removes a subnode by index
+func (g *Graph) DeleteAt(i int) {
+	if i < 0 || i >= g.Len() {
+		return
+	}
+	if i < (g.Len() - 1) {
+		g.Out = append(g.Out[:i], g.Out[i+1:]...)
+	} else {
+		g.Out = g.Out[:i]
+	}
+}
+
+// DeleteByPath removes the node found at the given path from its parent, and
+// returns true if it was found. The path can end in a token, in which case
+// the first subnode with that content is removed (the one Get returns), or
+// in an index, as in a.b[2] or a.b[-1].
+func (g *Graph) DeleteByPath(s string) bool {
+
+	parent, i := g.locate(s)
+	if parent == nil {
+		return false
+	}
+	parent.DeleteAt(i)
+	return true
+}
+
+// Replace puts repl in the place of the node found at the given path, in
+// the same position among its siblings, and returns true if it was found.
+// The path is resolved as in DeleteByPath. The replacement is not copied.
+func (g *Graph) Replace(s string, repl *Graph) bool {
+
+	if repl == nil {
+		return false
+	}
+
+	parent, i := g.locate(s)
+	if parent == nil {
+		return false
+	}
+	parent.Out[i] = repl
+	return true
+}
+
+// locate returns the parent of the node found at the given path and the
+// position of the node in it, as needed by DeleteByPath and Replace. The
+// parent is nil if the path cannot be resolved or does not end in a token or
+// an index.
+func (g *Graph) locate(s string) (*Graph, int) {
+
+	parent := g.Parent(s)
+	if parent == nil {
+		return nil, 0
+	}
+
+	path := NewPath(s)
+	last := path.Out[path.Len()-1]
+
+	i := -1
+
+	switch last.ThisString() {
+	case TypeIndex:
+		if last.Len() != 1 {
+			return nil, 0
+		}
+		ix, err := strconv.Atoi(last.Out[0].ThisString())
+		if err != nil {
+			return nil, 0
+		}
+		if ix < 0 {
+			ix += parent.Len()
+		}
+		i = ix
+	case TypeSlice, TypeFilter, TypeSelector, TypeCount, TypeNullSafe, TypeWildcard, "_len":
+		return nil, 0
+	default:
+		key := last.ThisString()
+		for j, n := range parent.Out {
+			if n != nil && _string(n.This) == key {
+				i = j
+				break
+			}
+		}
+	}
+
+	if i < 0 || i >= parent.Len() {
+		return nil, 0
+	}
+	return parent, i
+}
+
+// MaxIndex is the highest index that Set and EnsurePath accept in a path.
+// Nodes are created up to the index given, so this limits the memory that
+// a path such as a[1000000000] could take, which matters when paths come
+// from untrusted sources.
+var MaxIndex = 1 << 20
+
+// Set sets the first occurrence of the given path to the value given,
+// creating the nodes in the path that do not exist. Indexes in the path, as
+// in a[1].b, refer to the Nth subnode, which is created (empty) if there are
+// not so many, as are the subnodes before it. If an index is negative, not an
+// integer, as in a[x], or higher than MaxIndex, nothing is set and nil is
+// returned.
+func (g *Graph) Set(s string, val interface{}) *Graph {
+	if g == nil {
+		return nil
+	}
+
+	// Parse the input string into a Path graph.
+	path := NewPath(s)
+
+	if path == nil {
+		return nil
+	}
+	return g.set(path, val)
+}
+
+func (g *Graph) set(path *Graph, val interface{}) *Graph {
+
+	n := path.Len()
+
+	// The last element of the path is an index: set the value here.
+	if n != 0 && path.Out[n-1].ThisString() == TypeIndex {
+		ix, ok := indexOf(path.Out[n-1])
+		if !ok {
+			return nil
+		}
+		node := g.ensure(path.Out[:n-1])
+		if node == nil {
+			return nil
+		}
+		node.grow(ix)
+		node.Out[ix] = New(val)
+		return node.Out[ix]
+	}
+
+	node := g.ensure(path.Out)
+	if node == nil {
+		return nil
+	}
+
+	node.Out = nil
+
+	return node.Add(val)
+}
+
+// EnsurePath returns the node found at the given path, creating the nodes
+// in the path that do not exist, as Set does, but without changing the
+// subnodes of the nodes already there. Indexes in the path, as in a[2].b,
+// refer to the Nth subnode, which is created (empty) if there are not so
+// many, as in Set.
+func (g *Graph) EnsurePath(s string) *Graph {
+	if g == nil {
+		return nil
+	}
+
+	path := NewPath(s)
+	if path == nil {
+		return nil
+	}
+	return g.ensure(path.Out)
+}
+
+// ensure follows the path elements given from g, creating the nodes that
+// do not exist, and returns the last one. It returns nil for indexes not
+// accepted by indexOf.
+func (g *Graph) ensure(elems []*Graph) *Graph {
+
+	// Check the indexes before changing anything
+	for _, elem := range elems {
+		if elem.ThisString() == TypeIndex {
+			if _, ok := indexOf(elem); !ok {
+				return nil
+			}
+		}
+	}
+
+	node := g
+
+	for _, elem := range elems {
+
+		if elem.ThisString() == TypeIndex {
+			ix, _ := indexOf(elem)
+			node.grow(ix)
+			if node.Out[ix] == nil {
+				node.Out[ix] = New()
+			}
+			node = node.Out[ix]
+			continue
+		}
+
+		nn := node.Node(elem.ThisString())
+		if nn == nil {
+			nn = node.Add(elem.This)
+		}
+		node = nn
+	}
+
+	return node
+}
+
+// indexOf returns the position given by an index path element, as in [2],
+// for Set and EnsurePath. It returns false if the index is not a single
+// integer, as in [x] or [1,2], or if it is negative or higher than MaxIndex.
+func indexOf(elem *Graph) (int, bool) {
+	if elem.Len() != 1 {
+		return 0, false
+	}
+	i, ok := _int64f(elem.Out[0].ThisString())
+	if !ok || i < 0 || i > int64(MaxIndex) {
+		return 0, false
+	}
+	return int(i), true
+}
+
+// grow extends the subnode slice so that index i exists. The new positions
+// are filled with empty nodes.
+func (g *Graph) grow(i int) {
+	for len(g.Out) <= i {
+		g.Out = append(g.Out, New())
+	}
+}
+
+// SetTyped is like Set, but the value is given as text and stored with the
+// type it represents, following the rules of Scalar(): "42" is stored as an
+// int64, "1.5" as a float64, "true" as a bool, and anything else as a
+// string.
+func (g *Graph) SetTyped(path, valueText string) *Graph {
+	return g.Set(path, Normalize(valueText))
+}
+
+// SetStrict is like Set, but returns an error instead of overwriting a leaf
+// value with a value of an incompatible type. The compatible function
+// decides if the old value can be replaced by the new one; if nil,
+// CompatibleTypes is used. Paths that do not exist yet, or that point to a
+// node that is not a single leaf, are set without checks.
+func (g *Graph) SetStrict(s string, val interface{}, compatible func(old, val interface{}) bool) (*Graph, error) {
+	if g == nil {
+		return nil, errors.New("nil graph")
+	}
+
+	path := NewPath(s)
+	if path == nil {
+		return nil, errors.New("invalid path: " + s)
+	}
+
+	if compatible == nil {
+		compatible = CompatibleTypes
+	}
+
+	n := g.get(path)
+	if n != nil && n.Len() == 1 && n.Out[0].Len() == 0 && n.Out[0].This != nil {
+		if !compatible(n.Out[0].This, val) {
+			return nil, errors.New("incompatible type for " + s + ": " + _typeOf(n.Out[0].This) + " <- " + _typeOf(val))
+		}
+	}
+
+	return g.set(path, val), nil
+}
+
+// CompatibleTypes is the default type rule of SetStrict. Two values are
+// compatible if they are both numbers, both booleans or both strings, where
+// strings (and byte slices) that represent a number or a boolean count as
+// such. Values of other types are compatible only if they have the same
+// type.
+func CompatibleTypes(old, val interface{}) bool {
+	return scalarKind(old) == scalarKind(val)
+}
+
+// scalarKind classifies a value for CompatibleTypes.
+func scalarKind(v interface{}) string {
+	switch v.(type) {
+	case string, []byte:
+		if number(v) != nil {
+			return "number"
+		}
+		if _, ok := _boolf(v); ok {
+			return "bool"
+		}
+		return "string"
+	case bool:
+		return "bool"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return "number"
+	}
+	return _typeOf(v)
+}
+
+// Text is the OGDL text emitter. It converts a Graph into OGDL text.
+//
+// Strings are quoted if they contain spaces, newlines or special
+// characters, except that strings with newlines in leaf nodes are printed as
+// blocks when they can be read back unchanged:
+//
+//    a
+//      \
+//        line 1
+//        line 2
+//
+// Null elements are not printed, and act as transparent nodes.
+//
+// Comment nodes, with TypeComment content, are written as lines starting with
+// '#' followed by the text of their subnode, as read by the parser with the
+// Comments option. Strings that start with '#' are quoted, so that they are
+// not taken as comments.
+//
+// It is equivalent to MarshalOGDL(EmitOptions{}).
+func (g *Graph) Text() string {
+	return g.MarshalOGDL(EmitOptions{})
+}
+
+// Show prints the Graph as text including this (the top) node.
+//
+// It is equivalent to MarshalOGDL(EmitOptions{IncludeRoot: true}).
+func (g *Graph) Show() string {
+	return g.MarshalOGDL(EmitOptions{IncludeRoot: true})
+}
+
+// Dump returns a listing of the graph for debugging, including the top node.
+// Each node is printed on its own line, indented two spaces per level, with
+// the Go type of its content followed by the content itself:
+//
+//    <nil>
+//      string "port"
+//        int64 80
+//
+// Strings and byte slices are quoted, so that spaces and special characters
+// can be seen. Nodes with nil content (transparent nodes) are shown as <nil>,
+// and nil subnodes as <nil node>. A node that appears again below itself (a
+// cycle) is marked and not followed. The result is not OGDL: use Show for
+// that.
+func (g *Graph) Dump() string {
+	if g == nil {
+		return ""
+	}
+	buffer := &bytes.Buffer{}
+	g.dump(buffer, 0, make(map[*Graph]bool))
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+func (g *Graph) dump(buffer *bytes.Buffer, n int, path map[*Graph]bool) {
+
+	buffer.WriteString(strings.Repeat("  ", n))
+
+	if g == nil {
+		buffer.WriteString("<nil node>\n")
+		return
+	}
+
+	switch v := g.This.(type) {
+	case nil:
+		buffer.WriteString("<nil>")
+	case string:
+		fmt.Fprintf(buffer, "string %q", v)
+	case []byte:
+		fmt.Fprintf(buffer, "[]byte %q", v)
+	default:
+		fmt.Fprintf(buffer, "%T %v", v, v)
+	}
+
+	if path[g] {
+		buffer.WriteString(" (cycle)\n")
+		return
+	}
+	buffer.WriteByte('\n')
+
+	path[g] = true
+	defer delete(path, g)
+
+	for _, node := range g.Out {
+		node.dump(buffer, n+1, path)
+	}
+}
+
+// EmitOptions modify the behavior of the text emitter. The zero value gives
+// the output of Text().
+type EmitOptions struct {
+	// IndentString is the indentation added for each level. The default is
+	// two spaces. Quoted strings start where other nodes at the same level
+	// do, except that the quote takes the place of a trailing space, and
+	// their continuation lines line up with the first character after the
+	// quote. Text indented with tabs can be read back by the parser if its
+	// TabWidth matches the one used to display it (8 by default).
+	IndentString string
+
+	// RawQuotes makes the emitter quote strings that contain both single and
+	// double quotes with backticks, so that they need no escaping. Such text
+	// should be parsed with the RawQuotes parser option.
+	RawQuotes bool
+
+	// Null, if not empty, is printed for leaf nodes with nil content, which
+	// otherwise are not printed. See ParserOptions.Null.
+	Null string
+
+	// SortKeys emits the subnodes of each node sorted by their content, as
+	// strings. The graph is not modified.
+	SortKeys bool
+
+	// IncludeRoot emits the receiver node too, as Show() does. Empty nodes
+	// are then printed as '_'.
+	IncludeRoot bool
+
+	// MaxDepth, if not 0, is the number of levels emitted.
+	MaxDepth int
+
+	// Width, if not 0, is the maximum line length up to which a chain of
+	// nodes with only one subnode each is written on one line, as in 'a b c'
+	// instead of one node per line.
+	Width int
+
+	// StripComments omits comment nodes (see ParserOptions.Comments), which
+	// are otherwise written as lines starting with '#'.
+	StripComments bool
+}
+
+// MarshalOGDL is the OGDL text emitter, with options. See EmitOptions.
+func (g *Graph) MarshalOGDL(opts EmitOptions) string {
 	buffer := &bytes.Buffer{}
+	g.writeOGDL(context.Background(), buffer, opts)
+	return buffer.String()
+}
+
+// WriteText writes the Graph as OGDL text to w, as it is returned by Text(),
+// but without building the whole text in memory: each line is written as it
+// is produced. The first error returned by w stops the output and is
+// returned.
+func (g *Graph) WriteText(w io.Writer) error {
+	return g.writeOGDL(context.Background(), w, EmitOptions{})
+}
+
+// WriteShow is like WriteText, but includes this (the top) node, as Show()
+// does.
+func (g *Graph) WriteShow(w io.Writer) error {
+	return g.writeOGDL(context.Background(), w, EmitOptions{IncludeRoot: true})
+}
+
+// writeOGDL writes the Graph as OGDL text to w, with the given options and
+// without a trailing newline. The context is checked before each node.
+func (g *Graph) writeOGDL(ctx context.Context, w io.Writer, opts EmitOptions) error {
+	if g == nil {
+		return nil
+	}
+
+	if len(opts.IndentString) == 0 {
+		opts.IndentString = "  "
+	}
+
+	lw := &lineWriter{ctx: ctx, w: w}
+
+	if opts.IncludeRoot {
+		g._text(0, lw, true, &opts)
+	} else {
+		// Do not print the 'root' node
+		for _, node := range opts.sorted(g.Out) {
+			node._text(0, lw, false, &opts)
+		}
+	}
+
+	return lw.err
+}
 
-	g._text(0, buffer, true)
+// lineWriter writes the lines produced by _text to w, holding back the
+// newline at the end of each one until the next is written, so that the
+// output has no trailing newline. After a write error, or once the context
+// is done, nothing more is written.
+type lineWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	buf     bytes.Buffer
+	newline bool
+	err     error
+}
 
-	// remove trailing \n
+// flush writes the content of the buffer, which ends in a newline (or is
+// empty), and resets it.
+func (lw *lineWriter) flush() {
+	b := lw.buf.Bytes()
+	if len(b) == 0 || lw.err != nil {
+		lw.buf.Reset()
+		return
+	}
 
-	s := buffer.String()
+	if lw.newline {
+		if _, lw.err = lw.w.Write([]byte{'\n'}); lw.err != nil {
+			return
+		}
+	}
+
+	lw.newline = b[len(b)-1] == '\n'
+	if lw.newline {
+		b = b[:len(b)-1]
+	}
+
+	_, lw.err = lw.w.Write(b)
+	lw.buf.Reset()
+}
+
+// sorted returns the nodes given, sorted if the SortKeys option is set.
+func (opts *EmitOptions) sorted(nodes []*Graph) []*Graph {
+	if !opts.SortKeys {
+		return nodes
+	}
+	r := make([]*Graph, len(nodes))
+	copy(r, nodes)
+	sort.SliceStable(r, func(i, j int) bool {
+		return _string(r[i].This) < _string(r[j].This)
+	})
+	return r
+}
 
-	if len(s) == 0 {
+// Compact1 converts the Graph into OGDL text on a single line, useful for logs.
+// Subnodes are enclosed in braces and separated by commas, except that a node
+// with only one subnode is followed by it, as in OGDL text:
+//
+//    a { b 1, c 2 }
+//
+// Strings are quoted if needed, but newlines within them are kept. The result
+// can be parsed back with FromCompact.
+func (g *Graph) Compact1() string {
+	if g == nil {
 		return ""
 	}
 
-	if s[len(s)-1] == '\n' {
-		s = s[0 : len(s)-1]
+	buffer := &bytes.Buffer{}
+
+	// Do not print the 'root' node
+	g.compactList(buffer)
+
+	return buffer.String()
+}
+
+func (g *Graph) compactList(buffer *bytes.Buffer) {
+	for i, node := range g.Out {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		node._compact(buffer)
 	}
+}
 
-	// unquote
+func (g *Graph) _compact(buffer *bytes.Buffer) {
 
-	if s[0] == '"' {
-		s = s[1 : len(s)-1]
-		// But then also replace \"
-		s = strings.Replace(s, "\\\"", "\"", -1)
+	if g.This == nil {
+		g.compactList(buffer)
+		return
 	}
 
-	return s
+	s := _string(g.This)
+
+	if len(s) == 0 || strings.ContainsAny(s, "\n\r \t'\",(){}#") {
+		buffer.WriteByte('"')
+		buffer.WriteString(strings.Replace(s, "\"", "\\\"", -1))
+		buffer.WriteByte('"')
+	} else {
+		buffer.WriteString(s)
+	}
+
+	switch g.Len() {
+	case 0:
+	case 1:
+		buffer.WriteByte(' ')
+		g.Out[0]._compact(buffer)
+	default:
+		buffer.WriteString(" { ")
+		g.compactList(buffer)
+		buffer.WriteString(" }")
+	}
+}
+
+// WriteTextContext writes the Graph as OGDL text to w, as WriteText does.
+// The context is checked before each node, so that a long emission to a slow
+// writer can be cancelled. In that case the partial output stays written and
+// ctx.Err() is returned.
+func (g *Graph) WriteTextContext(ctx context.Context, w io.Writer) error {
+	return g.writeOGDL(ctx, w, EmitOptions{})
 }
 
 // _text is the private, lower level, implementation of Text().
-// It takes two parameters, the level and a buffer to which the
+// It takes two parameters, the level and a lineWriter to which the
 // result is printed.
-func (g *Graph) _text(n int, buffer *bytes.Buffer, show bool) {
+func (g *Graph) _text(n int, lw *lineWriter, show bool, opts *EmitOptions) {
 
-	sp := ""
-	for i := 0; i < n; i++ {
-		sp += "  "
+	if lw.err != nil {
+		return
+	}
+	if lw.err = lw.ctx.Err(); lw.err != nil {
+		return
 	}
 
+	if opts.MaxDepth > 0 && n >= opts.MaxDepth {
+		return
+	}
+
+	// A chain of single subnodes on one line, if it fits
+	if opts.Width > 0 && g != nil && len(g.Out) == 1 && !g.isComment() {
+		c, ok := g.chain(opts)
+		if ok && n*len(opts.IndentString)+len(c) <= opts.Width && (opts.MaxDepth == 0 || n+strings.Count(c, " ") < opts.MaxDepth) {
+			lw.buf.WriteString(strings.Repeat(opts.IndentString, n))
+			lw.buf.WriteString(c)
+			lw.buf.WriteByte('\n')
+			lw.flush()
+			return
+		}
+	}
+
+	n = g.textLine(n, &lw.buf, show, opts)
+	lw.flush()
+
+	if g != nil && !g.isComment() {
+		for _, node := range opts.sorted(g.Out) {
+			node._text(n+1, lw, show, opts)
+		}
+	}
+}
+
+// chain returns the content of g and its subnodes separated by spaces, if g
+// and each subnode have only one subnode (except the last, which is a leaf)
+// and none of them needs quoting.
+func (g *Graph) chain(opts *EmitOptions) (string, bool) {
+	var parts []string
+	for ; g != nil; g = g.Out[0] {
+		if g.This == nil {
+			return "", false
+		}
+		s := _string(g.This)
+		if len(s) == 0 || s == opts.Null || strings.ContainsAny(s, "\n\r \t'\",()#{}\\") || hasControl(s) {
+			return "", false
+		}
+		parts = append(parts, s)
+		if len(g.Out) == 0 {
+			break
+		}
+		if len(g.Out) != 1 {
+			return "", false
+		}
+	}
+	return strings.Join(parts, " "), true
+}
+
+// textLine prints the content of this node at level n, without its
+// subnodes, and returns the level at which the subnodes should be printed
+// minus one (transparent nodes are not printed and do not add a level).
+func (g *Graph) textLine(n int, buffer *bytes.Buffer, show bool, opts *EmitOptions) int {
+
+	indent := opts.IndentString
+	if len(indent) == 0 {
+		indent = "  "
+	}
+	sp := strings.Repeat(indent, n)
+
 	/*
 	   When printing strings with newlines, there are two possibilities:
 	   block or quoted. Block is cleaner, but limited to leaf nodes. If the node
 	   is not leaf (it has subnodes), then we are forced to print a multiline
 	   quoted string.
 
-	   If the string has no newlines but spaces or special characters, then the
-	   same rule applies: quote those nodes that are non-leaf, print a block
-	   otherways.
+	   Strings without newlines but with spaces or special characters are
+	   always quoted: a block would take more lines.
 
-	   [!] Cannot print blocks at level 0? Or can we?
+	   Strings at level 0 are printed as is, neither quoted nor as blocks,
+	   except those that would be read back differently: as a comment, or
+	   without their control characters.
 	*/
 
+	if g.isComment() {
+		if !opts.StripComments {
+			for _, line := range strings.Split(g.String(), "\n") {
+				buffer.WriteString(sp)
+				buffer.WriteByte('#')
+				buffer.WriteString(line)
+				buffer.WriteByte('\n')
+			}
+		}
+		return n
+	}
+
 	s := "_"
+
+	// quote is set for strings that should be quoted even if they contain
+	// no special characters.
+	quote := false
+
 	if g != nil {
 		s = _string(g.This)
+
+		if len(opts.Null) != 0 {
+			if g.This == nil && len(g.Out) == 0 {
+				s = opts.Null
+			} else if s == opts.Null {
+				quote = true
+			}
+		}
+
+		// Otherwise read as a comment
+		if strings.HasPrefix(s, "#") {
+			quote = true
+		}
 	}
 
-	if strings.ContainsAny(s, "\n\r \t'\",()") {
+	if n > 0 && !quote && g.Len() == 0 && isBlock(s) {
+		// A backslash, and the lines of text one level deeper
+		buffer.WriteString(sp)
+		buffer.WriteString("\\\n")
+		for _, line := range strings.Split(s, "\n") {
+			buffer.WriteString(sp)
+			buffer.WriteString(indent)
+			buffer.WriteString(line)
+			buffer.WriteByte('\n')
+		}
+	} else if quote || strings.ContainsAny(s, "\n\r \t'\",()") || hasControl(s) {
 
-		// print quoted, but not at level 0
-		// Do not convert " to \" below if level==0 !
-		if n > 0 {
-			buffer.WriteString(sp[:len(sp)-1])
-			buffer.WriteByte('"')
+		quoted := n > 0 || quote || hasControl(s)
+
+		// Quote with backticks (no escapes) if there are both types of
+		// quotes and that is allowed.
+		var q byte = '"'
+		if opts.RawQuotes && strings.ContainsRune(s, '"') && strings.ContainsRune(s, '\'') && !strings.ContainsRune(s, '`') && !hasControl(s) {
+			q = '`'
+		}
+
+		// Control characters (other than newline and tab) are escaped as
+		// \xHH within double quotes, and so is a backslash followed by x,
+		// so that the parser gives back the same bytes.
+		escape := quoted && q == '"'
+
+		// Continuation lines of multiline strings are indented so that
+		// they line up with the first character after the quote.
+		cont := sp
+
+		// print quoted, but not at level 0 (see above)
+		// Do not convert " to \" below if not quoted !
+		if quoted {
+			// The quote takes the place of the last space, if there is one
+			if len(sp) != 0 && sp[len(sp)-1] == ' ' {
+				buffer.WriteString(sp[:len(sp)-1])
+			} else {
+				buffer.WriteString(sp)
+				cont = sp + " "
+			}
+			buffer.WriteByte(q)
 		}
 
 		var c, cp byte
@@ -586,12 +1713,14 @@ func (g *Graph) _text(n int, buffer *bytes.Buffer, show bool) {
 
 		for i := 0; i < len(s); i++ {
 			c = s[i] // byte, not rune
-			if c == 13 {
+			if escape && (isControl(c) || (c == '\\' && i+1 < len(s) && s[i+1] == 'x')) {
+				buffer.WriteString(fmt.Sprintf("\\x%02x", c))
+			} else if c == 13 {
 				continue // ignore CR's
 			} else if c == 10 {
 				buffer.WriteByte('\n')
-				buffer.WriteString(sp)
-			} else if c == '"' && n > 0 {
+				buffer.WriteString(cont)
+			} else if c == '"' && quoted && q == '"' {
 				if cp != '\\' {
 					buffer.WriteString("\\\"")
 				}
@@ -601,8 +1730,8 @@ func (g *Graph) _text(n int, buffer *bytes.Buffer, show bool) {
 			cp = c
 		}
 
-		if n > 0 {
-			buffer.WriteString("\"")
+		if quoted {
+			buffer.WriteByte(q)
 		}
 		buffer.WriteString("\n")
 	} else {
@@ -618,12 +1747,7 @@ func (g *Graph) _text(n int, buffer *bytes.Buffer, show bool) {
 		}
 	}
 
-	if g != nil {
-		for i := 0; i < len(g.Out); i++ {
-			node := g.Out[i]
-			node._text(n+1, buffer, show)
-		}
-	}
+	return n
 }
 
 // Substitute traverses the graph substituting all nodes with content
@@ -640,3 +1764,351 @@ func (g *Graph) Substitute(s string, v interface{}) {
 	}
 
 }
+
+// SubstituteAt is like Substitute, but only within the node found at the
+// given path (as with Get). If the path is not found, nothing is done.
+func (g *Graph) SubstituteAt(path string, s string, v interface{}) {
+	g.Get(path).Substitute(s, v)
+}
+
+// Map traverses the graph replacing the content of each node by the value
+// returned by fn for it. All the nodes below g are visited, not only the
+// leaves, and including anonymous nodes (with nil content), but not g itself,
+// as in Substitute. It returns g.
+func (g *Graph) Map(fn func(interface{}) interface{}) *Graph {
+	g.Walk(func(n *Graph, _ int) bool {
+		n.This = fn(n.This)
+		return true
+	})
+	return g
+}
+
+// ReplaceValue traverses the graph replacing the content of all leaf nodes
+// (nodes without subnodes) that is equal to old by v. Nodes with subnodes are
+// left alone, even if their content matches. It returns the number of nodes
+// changed.
+func (g *Graph) ReplaceValue(old, v interface{}) int {
+	if g == nil {
+		return 0
+	}
+
+	i := 0
+	for _, n := range g.Out {
+		if n == nil {
+			continue
+		}
+		if n.Len() == 0 {
+			if equalValues(n.This, old) {
+				n.This = v
+				i++
+			}
+			continue
+		}
+		i += n.ReplaceValue(old, v)
+	}
+	return i
+}
+
+// isComment returns true for comment nodes (see ParserOptions.Comments).
+func (g *Graph) isComment() bool {
+	if g == nil {
+		return false
+	}
+	s, ok := g.This.(string)
+	return ok && s == TypeComment
+}
+
+// isBlock returns true if s can be printed as a block and read back as is:
+// it has several lines, no trailing newline, no control characters (CR
+// included), and no indentation in the first line or tabs in that of the
+// others.
+func isBlock(s string) bool {
+	if !strings.Contains(s, "\n") || strings.HasSuffix(s, "\n") || hasControl(s) || strings.ContainsRune(s, '\r') {
+		return false
+	}
+	if s[0] == ' ' || s[0] == '\t' {
+		return false
+	}
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, " "), "\t") {
+			return false
+		}
+	}
+	return true
+}
+
+// hasControl returns true if s contains control characters other than
+// newline and tab, which the emitter escapes.
+func hasControl(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if isControl(s[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isControl returns true for ASCII control characters other than newline and
+// tab.
+func isControl(c byte) bool {
+	return (c < 32 && c != '\n' && c != '\t') || c == 127
+}
+
+// equalValues compares two node contents, not panicking on non comparable
+// types such as []byte.
+func equalValues(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !reflect.TypeOf(a).Comparable() || !reflect.TypeOf(b).Comparable() {
+		return reflect.DeepEqual(a, b)
+	}
+	return a == b
+}
+
+// Walk traverses the graph depth first (pre-order), calling fn for each
+// subnode with its depth, 0 being the depth of the direct subnodes of g. The
+// receiver node itself is not visited, as it is not printed by Text(). If fn
+// returns false, the subnodes of that node are skipped, but the traversal
+// continues with its siblings.
+func (g *Graph) Walk(fn func(node *Graph, depth int) bool) {
+	g.walk(fn, 0)
+}
+
+func (g *Graph) walk(fn func(node *Graph, depth int) bool, depth int) {
+	if g == nil {
+		return
+	}
+	for _, n := range g.Out {
+		if n == nil {
+			continue
+		}
+		if fn(n, depth) {
+			n.walk(fn, depth+1)
+		}
+	}
+}
+
+// WalkIndexed traverses the graph depth first (pre-order), calling fn for
+// each subnode with its position among its siblings and the number of
+// siblings (including itself). The receiver node itself is not visited.
+func (g *Graph) WalkIndexed(fn func(node *Graph, index int, siblings int)) {
+	if g == nil {
+		return
+	}
+	for i, n := range g.Out {
+		if n == nil {
+			continue
+		}
+		fn(n, i, len(g.Out))
+		n.WalkIndexed(fn)
+	}
+}
+
+// Similarity returns a score between 0 and 1 telling how much of two graphs
+// is the same. Both graphs are reduced to the set of paths from their root
+// to each leaf node (the leaf being the value), and the score is the number
+// of paths they share divided by the number of distinct paths in both
+// (Jaccard index). Identical graphs give 1, graphs with no path in common 0.
+// Two empty graphs are considered identical.
+func (g *Graph) Similarity(other *Graph) float64 {
+
+	a := make(map[string]bool)
+	b := make(map[string]bool)
+	g.leafPaths("", a)
+	other.leafPaths("", b)
+
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+
+	shared := 0
+	for p := range a {
+		if b[p] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// leafPaths adds to set the paths to the leaf nodes below g. Path elements
+// are separated by a NUL character, since they may contain anything.
+func (g *Graph) leafPaths(path string, set map[string]bool) {
+	if g == nil {
+		return
+	}
+	for _, n := range g.Out {
+		if n == nil {
+			continue
+		}
+		if n.This == nil {
+			n.leafPaths(path, set)
+			continue
+		}
+		p := path + "\x00" + _string(n.This)
+		if n.Len() == 0 {
+			set[p] = true
+			continue
+		}
+		n.leafPaths(p, set)
+	}
+}
+
+// Fold calls fn for each node below g, depth first (pre-order), with the
+// value returned by the previous call (init for the first one), and returns
+// the last value. The root node g itself is not visited. For example, the
+// number of nodes in a graph is:
+//
+//    n := Fold(g, 0, func(n int, node *Graph) int { return n + 1 })
+func Fold[T any](g *Graph, init T, fn func(acc T, node *Graph) T) T {
+	acc := init
+	g.WalkIndexed(func(node *Graph, _, _ int) {
+		acc = fn(acc, node)
+	})
+	return acc
+}
+
+// AtDepth returns the nodes at depth d, from left to right, where the
+// receiver is at depth 0, its subnodes at depth 1, and so on. It returns nil
+// if the graph is not that deep. Since the graph is traversed level by level
+// and only up to depth d, shared or cyclic nodes are no problem.
+func (g *Graph) AtDepth(d int) []*Graph {
+	if g == nil || d < 0 {
+		return nil
+	}
+
+	level := []*Graph{g}
+
+	for ; d > 0 && len(level) != 0; d-- {
+		var next []*Graph
+		for _, n := range level {
+			for _, nn := range n.Out {
+				if nn != nil {
+					next = append(next, nn)
+				}
+			}
+		}
+		level = next
+	}
+
+	if len(level) == 0 {
+		return nil
+	}
+	return level
+}
+
+// Partition splits the subnodes of g into those for which pred returns true
+// and the rest, in one pass and keeping their order. If recursive is given
+// and true, all nodes below g are considered (depth first, pre-order), not
+// only the direct subnodes.
+func (g *Graph) Partition(pred func(*Graph) bool, recursive ...bool) (match, rest []*Graph) {
+	if g == nil {
+		return nil, nil
+	}
+
+	split := func(n *Graph) {
+		if pred(n) {
+			match = append(match, n)
+		} else {
+			rest = append(rest, n)
+		}
+	}
+
+	if len(recursive) != 0 && recursive[0] {
+		g.WalkIndexed(func(n *Graph, _, _ int) { split(n) })
+		return
+	}
+
+	for _, n := range g.Out {
+		if n != nil {
+			split(n)
+		}
+	}
+	return
+}
+
+// Filter returns a new graph with a transparent root whose subnodes are the
+// direct subnodes of g for which pred returns true, in the same order. The
+// nodes are not copied, but shared with g. The result is an empty graph (not
+// nil) if there are no matches or g is nil.
+func (g *Graph) Filter(pred func(*Graph) bool) *Graph {
+	r := New()
+	if g == nil {
+		return r
+	}
+
+	for _, n := range g.Out {
+		if n != nil && pred(n) {
+			r.Out = append(r.Out, n)
+		}
+	}
+	return r
+}
+
+// SortChildren sorts the subnodes of g (not those below them) with the
+// given less function, keeping the original order of equal nodes.
+func (g *Graph) SortChildren(less func(a, b *Graph) bool) {
+	if g == nil {
+		return
+	}
+	sort.SliceStable(g.Out, func(i, j int) bool {
+		return less(g.Out[i], g.Out[j])
+	})
+}
+
+// SortChildrenByValue sorts the subnodes of g by their content, as strings,
+// keeping the original order of equal nodes.
+func (g *Graph) SortChildrenByValue() {
+	g.SortChildren(func(a, b *Graph) bool {
+		return _string(a.This) < _string(b.This)
+	})
+}
+
+// SortRecursive is like SortChildren, but sorts the subnodes of every node
+// below g too.
+func (g *Graph) SortRecursive(less func(a, b *Graph) bool) {
+	if g == nil {
+		return
+	}
+	g.SortChildren(less)
+	for _, n := range g.Out {
+		n.SortRecursive(less)
+	}
+}
+
+// FindFunc searches the graph depth first (pre-order) and returns the first
+// node below g for which pred returns true, or nil if there is none. The
+// receiver node itself is not tested, as in Walk. See Find for selecting
+// direct subnodes with a regular expression.
+func (g *Graph) FindFunc(pred func(*Graph) bool) *Graph {
+	if g == nil {
+		return nil
+	}
+
+	for _, n := range g.Out {
+		if n == nil {
+			continue
+		}
+		if pred(n) {
+			return n
+		}
+		if r := n.FindFunc(pred); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// Count returns the number of nodes below g, at any depth, for which pred
+// returns true. The receiver node itself is not counted, as in Walk.
+func (g *Graph) Count(pred func(*Graph) bool) int {
+	i := 0
+	g.Walk(func(n *Graph, _ int) bool {
+		if pred(n) {
+			i++
+		}
+		return true
+	})
+	return i
+}
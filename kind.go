@@ -0,0 +1,63 @@
+// Copyright 2012-2017, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+// Kind is the structural kind of a node, as returned by Graph.Kind().
+type Kind int
+
+// Node kinds
+const (
+	KindEmpty  Kind = iota // nil, or no content and no subnodes
+	KindScalar             // a leaf node: content but no subnodes
+	KindList               // subnodes that are all leaves or anonymous
+	KindMap                // at least one named subnode with subnodes
+)
+
+// String returns the name of the kind.
+func (k Kind) String() string {
+	switch k {
+	case KindScalar:
+		return "scalar"
+	case KindList:
+		return "list"
+	case KindMap:
+		return "map"
+	}
+	return "empty"
+}
+
+// Kind classifies the node by its structure. A node without subnodes is a
+// scalar (or empty, if it has no content either). A node whose subnodes are
+// all leaves or anonymous (transparent) nodes is a list, as in:
+//
+//    hosts
+//      a
+//      b
+//
+// And a node with at least one named subnode that has subnodes itself is a
+// map, as in:
+//
+//    server
+//      host localhost
+//      port 80
+func (g *Graph) Kind() Kind {
+	if g == nil {
+		return KindEmpty
+	}
+
+	if len(g.Out) == 0 {
+		if g.This == nil {
+			return KindEmpty
+		}
+		return KindScalar
+	}
+
+	for _, n := range g.Out {
+		if n != nil && n.This != nil && len(n.Out) != 0 {
+			return KindMap
+		}
+	}
+	return KindList
+}
@@ -0,0 +1,362 @@
+// Copyright 2012-2017, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import "strconv"
+
+// Merge adds the content of c to g, recursively. Each subnode of c is
+// matched with a subnode of g with the same value: if there is one, their
+// subnodes are merged, and if not, a copy of the node of c is added to g.
+// Repeated keys are matched by position among the siblings with the same
+// value: the second 'item' of c is merged with the second 'item' of g.
+//
+// Nothing is removed or replaced, so merging 'port 8080' into 'port 80'
+// gives a port node with both values. Use MergeReplace to replace single
+// values instead. The receiver is modified; c is not.
+func (g *Graph) Merge(c *Graph) {
+	g.mergeNodes(c, false)
+}
+
+// MergeReplace is like Merge, but single values, as in 'port 80', are
+// replaced by the value in c when both graphs have them at the same key.
+func (g *Graph) MergeReplace(c *Graph) {
+	g.mergeNodes(c, true)
+}
+
+func (g *Graph) mergeNodes(c *Graph, replace bool) {
+	if g == nil || c == nil {
+		return
+	}
+
+	// Number of occurrences seen of each key in c
+	seen := make(map[string]int)
+
+	for _, n := range c.Out {
+		if n == nil {
+			continue
+		}
+
+		// Anonymous nodes are transparent
+		if n.This == nil {
+			g.mergeNodes(n, replace)
+			continue
+		}
+
+		key := _string(n.This)
+		nn := g.nthNode(key, seen[key])
+		seen[key]++
+
+		if nn == nil {
+			g.Add(n.Clone())
+			continue
+		}
+
+		if replace && nn.isSingleValue() && n.isSingleValue() {
+			nn.Out = []*Graph{n.Out[0].Clone()}
+			continue
+		}
+
+		nn.mergeNodes(n, replace)
+	}
+}
+
+// nthNode returns the i-th subnode (counting from 0) whose string value is
+// s, or nil if there are not so many.
+func (g *Graph) nthNode(s string, i int) *Graph {
+	if g == nil {
+		return nil
+	}
+	for _, n := range g.Out {
+		if n != nil && _string(n.This) == s {
+			if i == 0 {
+				return n
+			}
+			i--
+		}
+	}
+	return nil
+}
+
+// isSingleValue returns true if g has exactly one subnode, which is a leaf.
+func (g *Graph) isSingleValue() bool {
+	return g.Len() == 1 && g.Out[0].Len() == 0
+}
+
+// MergeStrategy controls how MergeWith combines list nodes.
+type MergeStrategy int
+
+// Merge strategies
+const (
+	// AppendArrays adds the items of the merged list after the existing ones.
+	AppendArrays MergeStrategy = iota
+	// ReplaceArrays replaces the existing items by the merged ones.
+	ReplaceArrays
+	// MergeByIndex merges each item with the existing item at the same
+	// position, and appends the items that have no counterpart.
+	MergeByIndex
+)
+
+// MergeWith merges c into g. Named nodes are matched by name: a node of c
+// that is not in g is added (as a copy), and one that is, is merged
+// recursively. Lists (nodes whose subnodes are all leaves or anonymous nodes,
+// see Kind) are combined according to the strategy given. Merging a list with
+// the item c into one with the items a and b gives a, b, c with AppendArrays,
+// c with ReplaceArrays, and c, b with MergeByIndex. A single value, as in
+// 'port 80', is a list with one item: it is replaced by ReplaceArrays and
+// MergeByIndex, and added to by AppendArrays.
+//
+// The receiver is modified; c is not.
+func (g *Graph) MergeWith(c *Graph, strategy MergeStrategy) {
+	if g == nil || c == nil {
+		return
+	}
+
+	for _, n := range c.Out {
+		if n == nil {
+			continue
+		}
+
+		// Anonymous nodes are transparent
+		if n.This == nil {
+			g.MergeWith(n, strategy)
+			continue
+		}
+
+		nn := g.Node(_string(n.This))
+		if nn == nil {
+			g.Add(n.Clone())
+			continue
+		}
+		nn.merge(n, strategy)
+	}
+}
+
+// merge merges the subnodes of c into the node g, which have the same name.
+func (g *Graph) merge(c *Graph, strategy MergeStrategy) {
+
+	if c.Len() == 0 {
+		return
+	}
+
+	if c.Kind() != KindList {
+		g.MergeWith(c, strategy)
+		return
+	}
+
+	switch strategy {
+	case AppendArrays:
+		for _, n := range c.Out {
+			g.Add(n.Clone())
+		}
+	case ReplaceArrays:
+		g.Out = nil
+		for _, n := range c.Out {
+			g.Add(n.Clone())
+		}
+	case MergeByIndex:
+		for i, n := range c.Out {
+			if i >= g.Len() {
+				g.Add(n.Clone())
+				continue
+			}
+			if n.This == nil && g.Out[i].This == nil {
+				g.Out[i].MergeWith(n, strategy)
+				continue
+			}
+			g.Out[i] = n.Clone()
+		}
+	}
+}
+
+// Conflict describes a path that was changed differently in the two graphs
+// given to Diff3. Base, Mine and Other are the nodes at that path in each
+// graph, or nil where the path does not exist (because it was deleted or
+// never existed).
+type Conflict struct {
+	Path  string
+	Base  *Graph
+	Mine  *Graph
+	Other *Graph
+}
+
+// Diff3 is a three-way merge: g and other are both derived from base, and the
+// changes made in each of them relative to base are combined into a new
+// graph. Nodes are matched by name, and repeated names by their position
+// among the siblings with the same name, as in Diff. A node changed (or
+// added, or deleted) in only one of the graphs takes that change; one changed
+// in both in the same way too. If both changed it differently, the node is
+// merged recursively if it is a map in both (see Kind), and otherwise a
+// Conflict is reported and the version in g is kept.
+func (g *Graph) Diff3(base, other *Graph) (*Graph, []Conflict) {
+	r := New()
+	var conflicts []Conflict
+	diff3(r, base, g, other, "", &conflicts)
+	return r, conflicts
+}
+
+func diff3(r, base, mine, other *Graph, path string, conflicts *[]Conflict) {
+
+	for _, key := range diff3Keys(mine, other, base) {
+		for i := 0; ; i++ {
+			b := base.nthNode(key, i)
+			m := mine.nthNode(key, i)
+			o := other.nthNode(key, i)
+			if b == nil && m == nil && o == nil {
+				break
+			}
+
+			p := key
+			if i > 0 {
+				p += "{" + strconv.Itoa(i) + "}"
+			}
+			if len(path) != 0 {
+				p = path + "." + p
+			}
+
+			var n *Graph
+
+			switch {
+			case m.Equals(o):
+				n = m
+			case m.Equals(b):
+				n = o
+			case o.Equals(b):
+				n = m
+			case m != nil && o != nil && m.Kind() == KindMap && o.Kind() == KindMap:
+				nn := r.Add(m.This)
+				diff3(nn, b, m, o, p, conflicts)
+				continue
+			default:
+				*conflicts = append(*conflicts, Conflict{p, b, m, o})
+				n = m
+			}
+
+			if n != nil {
+				r.Add(n.Clone())
+			}
+		}
+	}
+}
+
+// diff3Keys returns the names of the subnodes of the graphs given, in order
+// of appearance and without repetitions.
+func diff3Keys(gg ...*Graph) []string {
+	var keys []string
+	seen := make(map[string]bool)
+
+	for _, g := range gg {
+		if g == nil {
+			continue
+		}
+		for _, n := range g.Out {
+			key := _string(n.This)
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// Difference describes a node that is in only one of the graphs given to
+// Diff, or a single value (as in 'port 80') that differs between them. Mine
+// and Other are the nodes at Path in each graph, nil where the path does not
+// exist.
+type Difference struct {
+	Path  string
+	Mine  *Graph
+	Other *Graph
+}
+
+// Diff compares g with other and returns their differences: nodes that are
+// only in g (Other is nil), nodes that are only in other (Mine is nil), and
+// single values that changed (both are set). Nodes are matched by name, and
+// repeated names by their position among the siblings with the same name, as
+// in Get. The path of the second and later occurrences includes a selector,
+// as in item{1}.name. Nodes that are in both graphs are compared
+// recursively, and only the nodes below them that differ are reported.
+func (g *Graph) Diff(other *Graph) []Difference {
+	var r []Difference
+	diff(g, other, "", &r)
+	return r
+}
+
+func diff(a, b *Graph, path string, r *[]Difference) {
+
+	for _, key := range diff3Keys(a, b) {
+		for i := 0; ; i++ {
+			na := a.nthNode(key, i)
+			nb := b.nthNode(key, i)
+			if na == nil && nb == nil {
+				break
+			}
+
+			p := key
+			if i > 0 {
+				p += "{" + strconv.Itoa(i) + "}"
+			}
+			if len(path) != 0 {
+				p = path + "." + p
+			}
+
+			switch {
+			case na == nil || nb == nil:
+				*r = append(*r, Difference{p, na, nb})
+			case na.isSingleValue() && nb.isSingleValue():
+				if !na.Equals(nb) {
+					*r = append(*r, Difference{p, na, nb})
+				}
+			default:
+				diff(na, nb, p, r)
+			}
+		}
+	}
+}
+
+// OverridesOf returns a new graph with the nodes of g that are not in base
+// or that differ from it, so that merging the result into base gives g back
+// (except for deletions, which are not represented). Nodes are matched by
+// name, and repeated names by their position among the siblings with the
+// same name, as in Merge. Maps (see Kind) are compared recursively, so that
+// only the values that changed are included, with their path.
+func (g *Graph) OverridesOf(base *Graph) *Graph {
+	r := New()
+	overrides(r, g, base)
+	return r
+}
+
+func overrides(r, g, base *Graph) {
+	if g == nil {
+		return
+	}
+
+	// Number of occurrences seen of each key in g
+	seen := make(map[string]int)
+
+	for _, n := range g.Out {
+		if n == nil {
+			continue
+		}
+
+		key := _string(n.This)
+		b := base.nthNode(key, seen[key])
+		seen[key]++
+
+		switch {
+		case b == nil:
+			r.Add(n.Clone())
+		case n.Equals(b):
+		case n.Kind() == KindMap && b.Kind() == KindMap:
+			nn := New(n.This)
+			overrides(nn, n, b)
+			if nn.Len() != 0 {
+				r.Add(nn)
+			}
+		default:
+			r.Add(n.Clone())
+		}
+	}
+}
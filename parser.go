@@ -19,9 +19,15 @@ const (
 	TypeVariable   = "!v"
 	TypeSelector   = "!s"
 	TypeIndex      = "!i"
+	TypeSlice      = "!:"
 	TypeGroup      = "!g"
+	TypeCount      = "!#"
+	TypeNullSafe   = "!?"
+	TypeWildcard   = "!*"
+	TypeFilter     = "!f"
 	TypeTemplate   = "!t"
 	TypeString     = "!string"
+	TypeComment    = "!comment"
 
 	TypeIf    = "!if"
 	TypeEnd   = "!end"
@@ -58,21 +64,55 @@ type parser struct {
 	// the number of characters after a NL was found (used in Quoted)
 	lastnl int
 
+	// the width added by expanding the tabs in the indentation of the
+	// current line, so that lastnl can be converted into a column (used
+	// in Quoted)
+	tabs int
+
 	// line keeps track of the line number
 	line int
 
 	// saved spaces at end of block
 	spaces int
+
+	// opts holds the options given by the user
+	opts ParserOptions
+
+	// sep is the path separator
+	sep int
+}
+
+// ParserOptions modify the behavior of the OGDL text parser. The zero value
+// gives the standard behavior.
+type ParserOptions struct {
+	// RawQuotes enables strings quoted with backticks (`), in which no escape
+	// sequences are processed, like Go raw strings.
+	RawQuotes bool
+
+	// Null, if not empty, is the marker for explicit null values, for
+	// example "~" or "null". An unquoted scalar equal to it is parsed as a
+	// node with nil content, which can be told apart from a missing node.
+	Null string
+
+	// TabWidth is the distance between tab stops used to compute the
+	// indentation of lines that contain tabs. The default (0) means 8.
+	TabWidth int
+
+	// Comments keeps the comments found, which are otherwise discarded, as
+	// nodes with TypeComment content and the text after the '#' as their
+	// subnode. They are added at the level where they appear, so that a
+	// comment after a scalar is a subnode of it.
+	Comments bool
 }
 
 // NewStringParser creates an OGDL parser from a string
 func newStringParser(s string) *parser {
-	return &parser{strings.NewReader(s), newEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 1, 0}
+	return &parser{strings.NewReader(s), newEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 0, 1, 0, ParserOptions{}, '.'}
 }
 
 // NewParser creates an OGDL parser from a generic io.Reader
 func newParser(r io.Reader) *parser {
-	return &parser{bufio.NewReader(r), newEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 1, 0}
+	return &parser{bufio.NewReader(r), newEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 0, 1, 0, ParserOptions{}, '.'}
 }
 
 // NewFileParser creates an OGDL parser that reads from a file
@@ -83,13 +123,13 @@ func newFileParser(s string) *parser {
 	}
 
 	buf := bytes.NewBuffer(b)
-	return &parser{buf, newEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 1, 0}
+	return &parser{buf, newEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 0, 1, 0, ParserOptions{}, '.'}
 }
 
 // NewBytesParser creates an OGDL parser from a []byte source
 func newBytesParser(b []byte) *parser {
 	buf := bytes.NewBuffer(b)
-	return &parser{buf, newEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 1, 0}
+	return &parser{buf, newEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 0, 1, 0, ParserOptions{}, '.'}
 }
 
 // FromBytes parses OGDL text contained in a byte array. It returns a *Graph
@@ -106,6 +146,22 @@ func FromString(s string) *Graph {
 	return p.graph()
 }
 
+// FromStringWith parses OGDL text from the given string, with the given
+// parser options. It returns a *Graph
+func FromStringWith(s string, opts ParserOptions) *Graph {
+	p := newBytesParser([]byte(s))
+	p.opts = opts
+	p.Ogdl()
+	return p.graph()
+}
+
+// FromCompact parses the single line text produced by Graph.Compact1.
+func FromCompact(s string) *Graph {
+	p := newStringParser(s)
+	p.Compact()
+	return p.graph()
+}
+
 // FromReader parses OGDL text coming from a generic io.Reader
 func FromReader(r io.Reader) *Graph {
 	p := newParser(r)
@@ -113,6 +169,15 @@ func FromReader(r io.Reader) *Graph {
 	return p.graph()
 }
 
+// FromReaderWith parses OGDL text coming from a generic io.Reader, with the
+// given parser options.
+func FromReaderWith(r io.Reader, opts ParserOptions) *Graph {
+	p := newParser(r)
+	p.opts = opts
+	p.Ogdl()
+	return p.graph()
+}
+
 // FromFile parses OGDL text contained in a file. It returns a Graph
 func FromFile(s string) *Graph {
 	p := newFileParser(s)
@@ -166,6 +231,7 @@ func (p *parser) Read() int {
 
 	if c == 10 {
 		p.lastnl = 0
+		p.tabs = 0
 		p.line++
 	} else {
 		p.lastnl++
@@ -4,13 +4,194 @@
 
 package ogdl
 
+import (
+	"bytes"
+	"strings"
+)
+
 // NewPath takes a Unicode string representing an OGDL path, parses it and
 // returns it as a Graph object.
 //
 // It also parses extended paths, as those used in templates, which may have
 // argument lists.
-func NewPath(s string) *Graph {
+//
+// The separator between path elements is '.', unless another one is given.
+// With another separator, elements can contain dots without being quoted.
+func NewPath(s string, sep ...rune) *Graph {
 	parse := newStringParser(s)
+	if len(sep) != 0 {
+		parse.sep = int(sep[0])
+	}
 	parse.Path()
 	return parse.graphTop(TypePath)
 }
+
+// PathString returns the text form of a path Graph, as returned by NewPath.
+// The result is canonical: elements are separated by dots, white space is
+// removed except after commas, and elements that are not made only of
+// letters, digits and '_' are quoted. Parsing it again with NewPath
+// gives the same path.
+//
+//    NewPath("a.'b.c'[ i + 1 ].d{ 1 }").PathString()
+//
+// returns a."b.c"[i+1].d{1}
+func (g *Graph) PathString() string {
+	if g == nil {
+		return ""
+	}
+	buf := &bytes.Buffer{}
+	g.pathString(buf)
+	return buf.String()
+}
+
+func (g *Graph) pathString(buf *bytes.Buffer) {
+
+	for i, n := range g.Out {
+		switch s := n.ThisString(); s {
+		case TypeIndex:
+			buf.WriteByte('[')
+			n.exprList(buf)
+			buf.WriteByte(']')
+		case TypeSlice:
+			buf.WriteByte('[')
+			n.GetAt(0).exprList(buf)
+			buf.WriteByte(':')
+			n.GetAt(1).exprList(buf)
+			buf.WriteByte(']')
+		case TypeFilter:
+			buf.WriteString("[?")
+			n.exprList(buf)
+			buf.WriteByte(']')
+		case TypeSelector:
+			buf.WriteByte('{')
+			n.exprList(buf)
+			buf.WriteByte('}')
+		case TypeGroup:
+			n.argList(buf)
+		case TypeCount:
+			buf.WriteByte('#')
+		case TypeNullSafe:
+			buf.WriteByte('?')
+		case TypeWildcard:
+			if i != 0 {
+				buf.WriteByte('.')
+			}
+			buf.WriteByte('*')
+		case TypeExpression:
+			// a.(b): the argument list is an expression
+			if i != 0 {
+				buf.WriteByte('.')
+			}
+			n.argList(buf)
+		default:
+			if i != 0 {
+				buf.WriteByte('.')
+			}
+			buf.WriteString(pathQuote(s))
+		}
+	}
+}
+
+// argList writes the subnodes of g, which are expressions, separated by
+// commas and within parenthesis.
+func (g *Graph) argList(buf *bytes.Buffer) {
+	buf.WriteByte('(')
+	for i, n := range g.Out {
+		if i != 0 {
+			buf.WriteString(", ")
+		}
+		// Each argument is an expression, without parentheses of its own
+		if n.ThisString() == TypeExpression {
+			n.exprList(buf)
+		} else {
+			n.exprString(buf)
+		}
+	}
+	buf.WriteByte(')')
+}
+
+// exprList writes the subnodes of g, which are parts of an expression or a
+// list of expressions, as found in indexes and selectors. Operands that
+// follow each other are separated by commas.
+func (g *Graph) exprList(buf *bytes.Buffer) {
+	if g == nil {
+		return
+	}
+	operand := false
+	for _, n := range g.Out {
+		if op, ok := n.Operator(); ok && n.Len() == 0 {
+			buf.WriteString(op)
+			operand = false
+			continue
+		}
+		if operand {
+			buf.WriteString(", ")
+		}
+		n.exprString(buf)
+		operand = true
+	}
+}
+
+// exprString writes an expression node, be it a path, a quoted string, an
+// operator with its operands, a subexpression (within parentheses) or a
+// literal value.
+func (g *Graph) exprString(buf *bytes.Buffer) {
+
+	switch s := g.ThisString(); s {
+	case TypePath:
+		g.pathString(buf)
+	case TypeString:
+		buf.WriteString(quote(g.String()))
+	case TypeExpression:
+		buf.WriteByte('(')
+		g.exprList(buf)
+		buf.WriteByte(')')
+	case TypeGroup:
+		g.argList(buf)
+	default:
+		if op, ok := g.Operator(); ok && g.Len() == 2 {
+			g.Out[0].exprString(buf)
+			buf.WriteString(op)
+			g.Out[1].exprString(buf)
+			return
+		}
+		if op, ok := g.Operator(); ok && g.Len() == 1 {
+			buf.WriteString(op)
+			g.Out[0].exprString(buf)
+			return
+		}
+		buf.WriteString(s)
+	}
+}
+
+// pathQuote returns s double quoted if it is not a token (letters, digits
+// and '_').
+func pathQuote(s string) string {
+	if isTokenString(s) {
+		return s
+	}
+	return quote(s)
+}
+
+// quote returns s within double quotes, or single quotes if it contains
+// double quotes but no single ones.
+func quote(s string) string {
+	if strings.IndexByte(s, '"') != -1 && strings.IndexByte(s, '\'') == -1 {
+		return "'" + s + "'"
+	}
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// isTokenString returns true if s is not empty and is made only of token
+// characters.
+func isTokenString(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if !isTokenChar(int(c)) {
+			return false
+		}
+	}
+	return true
+}
@@ -61,12 +61,7 @@ func (p *parser) Ogdl() error {
 //
 func (p *parser) Line() (bool, error) {
 
-	sp, n := p.Space()
-
-	// if a line begins with non-uniform space, throw a syntax error.
-	if sp && n == 0 {
-		return false, errors.New("non-uniform space")
-	}
+	_, n := p.Space()
 
 	if p.End() {
 		return false, nil
@@ -89,7 +84,7 @@ func (p *parser) Line() (bool, error) {
 			return true, nil
 		}
 
-		s, ok := p.Block()
+		s, ok := p.Block(n)
 
 		if ok {
 			p.ev.Add(s)
@@ -101,10 +96,17 @@ func (p *parser) Line() (bool, error) {
 				// TODO handle what previously was allowed (flow and block mixed)
 				// Maybe just treat ( and ) as text characters
 			} else {
+				c := p.Read()
+				p.Unread()
 				b, ok := p.Scalar()
 
 				if ok {
-					p.ev.Add(b)
+					if len(p.opts.Null) != 0 && b == p.opts.Null && c != '"' && c != '\'' && c != '`' {
+						// Explicit null: a node without content
+						p.ev.AddNull()
+					} else {
+						p.ev.Add(b)
+					}
 				} else {
 					p.Break()
 					break
@@ -143,6 +145,13 @@ func (p *parser) Line() (bool, error) {
 //     index := '[' Expression ']'
 //     selector := '{' Expression '}'
 //
+//     A trailing '#' counts the occurrences of the last element.
+//
+//     A '?.' instead of '.' is the null-safe separator: the path evaluates to
+//     nil if the element before it is not found.
+//
+// The separator can be other than '.' (see NewPath).
+//
 // The OGDL parser doesn't need to know about Unicode. The character
 // classification relies on values < 127, thus in the ASCII range,
 // which is also part of Unicode.
@@ -164,7 +173,7 @@ func (p *parser) Path() bool {
 
 	for {
 
-		// Expect: token | quoted | index | group | selector | dot,
+		// Expect: token | quoted | wildcard | index | group | selector | dot,
 		// or else we abort.
 
 		// A dot is requiered before a token or quoted, except at
@@ -173,7 +182,23 @@ func (p *parser) Path() bool {
 		if !begin {
 			c := p.Read()
 
-			if c != '.' {
+			if c == '#' {
+				// Count modifier, only allowed at the end.
+				p.ev.Add(TypeCount)
+				break
+			}
+
+			if c == '?' {
+				// Null-safe separator: ?.
+				if !p.nextByteIs(p.sep) {
+					p.Unread()
+					break
+				}
+				p.ev.Add(TypeNullSafe)
+				c = p.sep
+			}
+
+			if c != p.sep {
 				dot = false
 				p.Unread()
 
@@ -188,6 +213,13 @@ func (p *parser) Path() bool {
 
 		begin = false
 
+		if p.nextByteIs('*') {
+			// Wildcard: all subnodes
+			p.ev.Add(TypeWildcard)
+			anything = true
+			continue
+		}
+
 		b, ok = p.Quoted()
 		if ok {
 			p.ev.Add(b)
@@ -195,6 +227,16 @@ func (p *parser) Path() bool {
 			continue
 		}
 
+		if p.sep != '.' {
+			// With another separator, elements can contain dots
+			b, ok = p.PathElement()
+			if ok {
+				p.ev.Add(b)
+				anything = true
+				continue
+			}
+		}
+
 		b, ok = p.Number()
 		if ok {
 			p.ev.Add(b)
@@ -330,11 +372,19 @@ func (p *parser) Comment() bool {
 	c := p.Read()
 
 	if c == '#' {
+		var buf []byte
 		for {
 			c = p.Read()
 			if isEndChar(c) || isBreakChar(c) {
 				break
 			}
+			buf = append(buf, byte(c))
+		}
+		if p.opts.Comments {
+			p.ev.Add(TypeComment)
+			p.ev.Inc()
+			p.ev.Add(string(buf))
+			p.ev.Dec()
 		}
 		return true
 	}
@@ -377,18 +427,22 @@ func (p *parser) String() (string, bool) {
 }
 
 // Quoted string. Can have newlines in it.
+//
+// If the RawQuotes option is set, strings can also be quoted with backticks,
+// and then backslashes have no special meaning.
 func (p *parser) Quoted() (string, bool) {
 
 	cs := p.Read()
-	if cs != '"' && cs != '\'' {
+	if cs != '"' && cs != '\'' && (cs != '`' || !p.opts.RawQuotes) {
 		p.Unread()
 		return "", false
 	}
 
 	buf := make([]byte, 0, 16)
 
-	// p.lastnl is the indentation of this quoted string
-	lnl := p.lastnl
+	// p.lastnl is the indentation of this quoted string (in characters,
+	// while Space() returns a width, with tabs expanded)
+	lnl := p.lastnl + p.tabs
 
 	/* Handle \", \', and spaces after NL */
 	for {
@@ -405,8 +459,13 @@ func (p *parser) Quoted() (string, bool) {
 			for ; n-lnl > 0; n-- {
 				buf = append(buf, ' ')
 			}
-		} else if c == '\\' {
+		} else if c == '\\' && cs != '`' {
 			c = p.Read()
+			if c == 'x' {
+				// \xHH: a byte given in hexadecimal
+				buf = p.hexEscape(buf)
+				continue
+			}
 			if c != '"' && c != '\'' {
 				buf = append(buf, '\\')
 			}
@@ -418,8 +477,34 @@ func (p *parser) Quoted() (string, bool) {
 	return string(buf), true
 }
 
+// hexEscape reads the two hexadecimal digits that follow \x within a quoted
+// string, and appends the byte they represent to buf. If they are not there,
+// the escape sequence is kept as is.
+func (p *parser) hexEscape(buf []byte) []byte {
+
+	// buf ends with the backslash
+	buf = buf[:len(buf)-1]
+
+	h1 := p.Read()
+	if !isHexDigit(h1) {
+		p.Unread()
+		return append(buf, '\\', 'x')
+	}
+	h2 := p.Read()
+	if !isHexDigit(h2) {
+		p.Unread()
+		return append(buf, '\\', 'x', byte(h1))
+	}
+
+	return append(buf, byte(hexValue(h1)<<4|hexValue(h2)))
+}
+
 // Block ::= '\\' NL LINES_OF_TEXT
-func (p *parser) Block() (string, bool) {
+//
+// The block ends at the first line indented as much as the line where it
+// starts (which has indentation n), or less. Lines indented more than the
+// first one keep the extra spaces.
+func (p *parser) Block(n int) (string, bool) {
 
 	c := p.Read()
 	if c != '\\' {
@@ -434,18 +519,10 @@ func (p *parser) Block() (string, bool) {
 		return "", false
 	}
 
-	// read lines until indentation is >= indentation of upper level.
-	i := 0
-	if p.ev.Level() > 0 {
-		i = p.ind[p.ev.Level()-1]
-	}
-
-	u, ns := p.Space()
+	// read lines until indentation is <= indentation of this line.
+	i := n
 
-	if u && ns == 0 {
-		println("Non uniform space at beginning of block at line", p.line)
-		panic("")
-	}
+	_, ns := p.Space()
 
 	buffer := &bytes.Buffer{}
 
@@ -461,6 +538,9 @@ func (p *parser) Block() (string, bool) {
 		if j < ns {
 			ns = j
 		}
+		for ; j > ns; j-- {
+			buffer.WriteByte(' ')
+		}
 
 		// Read bytes until end of line
 		for {
@@ -525,7 +605,9 @@ func (p *parser) WhiteSpace() bool {
 
 // Space is (0x20|0x09)+. It returns a boolean indicating
 // if space has been found, and an integer indicating
-// how many spaces, iff uniform (either all 0x20 or 0x09)
+// its width, with tabs expanded to the next tab stop (see
+// ParserOptions.TabWidth), so that indentation made with tabs and
+// spaces can be compared.
 func (p *parser) Space() (bool, int) {
 
 	// The Block() production eats to many spaces trying to
@@ -536,30 +618,32 @@ func (p *parser) Space() (bool, int) {
 		return true, i
 	}
 
-	c := p.Read()
-	if c != 32 && c != 9 {
-		p.Unread()
-		return false, 0
+	tw := p.opts.TabWidth
+	if tw <= 0 {
+		tw = 8
 	}
 
-	n := 1
-
-	// We keep 'c' to tell us what spaces will count as uniform.
+	n := 0
+	start := p.lastnl
 
 	for {
-		cs := p.Read()
-		if cs != 32 && cs != 9 {
-			p.Unread()
-			break
-		}
-		if n != 0 && cs == c {
+		c := p.Read()
+		if c == 32 {
 			n++
+		} else if c == 9 {
+			n = (n/tw + 1) * tw
 		} else {
-			n = 0
+			p.Unread()
+			break
 		}
 	}
 
-	return true, n
+	// Indentation: remember the width added by tabs
+	if start == 0 {
+		p.tabs = n - p.lastnl
+	}
+
+	return n > 0, n
 }
 
 // End returns true if the end of stream has been reached.
@@ -622,6 +706,24 @@ func (p *parser) Token() (string, bool) {
 	return string(buf), true
 }
 
+// PathElement reads a path element when the separator is not a dot: any
+// sequence of text characters other than the separator, '[', '{' and '#'.
+func (p *parser) PathElement() (string, bool) {
+
+	var buf []byte
+
+	for {
+		c := p.Read()
+		if !isTextChar(c) || c == p.sep || c == '[' || c == '{' || c == '#' {
+			p.Unread()
+			break
+		}
+		buf = append(buf, byte(c))
+	}
+
+	return string(buf), len(buf) > 0
+}
+
 // Number returns true if it finds a number at the current parser position
 // It returns also the number found.
 func (p *parser) Number() (string, bool) {
@@ -658,7 +760,8 @@ func (p *parser) Number() (string, bool) {
 }
 
 // Operator returns true if it finds an operator at the current parser position
-// It returns also the operator found.
+// It returns also the operator found. The power operator ** ends the
+// operator, so that a sign can follow it, as in 2**-1.
 func (p *parser) Operator() (string, bool) {
 
 	c := p.Read()
@@ -672,6 +775,9 @@ func (p *parser) Operator() (string, bool) {
 	buf[0] = byte(c)
 
 	for {
+		if string(buf) == "**" {
+			break
+		}
 		c = p.Read()
 		if !isOperatorChar(c) {
 			p.Unread()
@@ -683,7 +789,7 @@ func (p *parser) Operator() (string, bool) {
 	return string(buf), true
 }
 
-// Expression := expr1 (op2 expr1)*
+// Expression := expr1 (op2 expr1)* ('?' Expression ':' Expression)?
 //
 func (p *parser) Expression() bool {
 	if !p.UnaryExpression() {
@@ -696,7 +802,7 @@ func (p *parser) Expression() bool {
 		if ok {
 			p.ev.Add(b)
 		} else {
-			return true
+			return p.Conditional()
 		}
 		p.Space()
 		if !p.UnaryExpression() {
@@ -706,6 +812,40 @@ func (p *parser) Expression() bool {
 	}
 }
 
+// Conditional parses the branches of a conditional expression, as in
+// a > 0 ? 'pos' : 'neg', if present. They are added as two subexpressions
+// of a ? node, which ast() completes with the condition.
+//
+// Conditional := '?' Expression ':' Expression
+func (p *parser) Conditional() bool {
+	if !p.nextByteIs('?') {
+		return true
+	}
+
+	p.ev.Add("?")
+	p.ev.Inc()
+	defer p.ev.Dec()
+
+	p.ev.Add(TypeExpression)
+	p.ev.Inc()
+	p.Space()
+	ok := p.Expression()
+	p.Space()
+	p.ev.Dec()
+
+	if !ok || !p.nextByteIs(':') {
+		return false
+	}
+
+	p.ev.Add(TypeExpression)
+	p.ev.Inc()
+	p.Space()
+	ok = p.Expression()
+	p.ev.Dec()
+
+	return ok
+}
+
 // UnaryExpression := cpath | constant | op1 cpath | op1 constant | '(' expr ')' | op1 '(' expr ')'
 //
 func (p *parser) UnaryExpression() bool {
@@ -741,9 +881,12 @@ func (p *parser) UnaryExpression() bool {
 		p.ev.Add(b)
 	}
 
+	// A parenthesized expression is a subexpression, so that it is
+	// reorganized by ast() according to precedence, and evaluated as one
+	// operand.
 	if p.nextByteIs('(') {
 
-		p.ev.Add(TypeGroup)
+		p.ev.Add(TypeExpression)
 		p.ev.Inc()
 		p.Space()
 		p.Expression()
@@ -832,7 +975,7 @@ func (p *parser) Variable() bool {
 
 }
 
-// Index ::= '[' expression ']'
+// Index ::= '[' expression (',' expression)* ']' | Slice | Filter
 func (p *parser) Index() bool {
 
 	if !p.nextByteIs('[') {
@@ -841,6 +984,11 @@ func (p *parser) Index() bool {
 
 	i := p.ev.Level()
 
+	p.Space()
+	if p.nextByteIs('?') {
+		return p.Filter(i)
+	}
+
 	p.ev.Add(TypeIndex)
 	p.ev.Inc()
 
@@ -848,6 +996,18 @@ func (p *parser) Index() bool {
 	p.Expression()
 	p.Space()
 
+	if p.nextByteIs(':') {
+		return p.Slice(i)
+	}
+
+	// A list of indexes
+	for p.nextByteIs(',') {
+		p.ev.SetLevel(i + 1)
+		p.Space()
+		p.Expression()
+		p.Space()
+	}
+
 	if !p.nextByteIs(']') {
 		return false // error
 	}
@@ -857,6 +1017,62 @@ func (p *parser) Index() bool {
 	return true
 }
 
+// Slice ::= '[' expression? ':' expression? ']'
+//
+// Slice is called by Index when it finds the colon, and converts the index
+// node just created at level i into a slice node, with the start and end
+// expressions as subnodes (!e). Any of them can be empty.
+func (p *parser) Slice(i int) bool {
+
+	n := p.ev.Last(i)
+	if n == nil {
+		return false
+	}
+
+	start := New(TypeExpression)
+	start.Out = n.Out
+	n.This = TypeSlice
+	n.Out = []*Graph{start}
+
+	p.ev.SetLevel(i + 1)
+	p.ev.Add(TypeExpression)
+	p.ev.Inc()
+
+	p.Space()
+	p.Expression()
+	p.Space()
+
+	if !p.nextByteIs(']') {
+		return false // error
+	}
+
+	p.ev.SetLevel(i)
+	return true
+}
+
+// Filter ::= '[' '?' expression ']'
+//
+// Filter is called by Index when it finds the question mark, and adds a
+// filter node at level i, with the parts of the expression as subnodes.
+func (p *parser) Filter(i int) bool {
+
+	p.ev.Add(TypeFilter)
+	p.ev.Inc()
+
+	p.Space()
+	if !p.Expression() {
+		return false
+	}
+	p.Space()
+
+	if !p.nextByteIs(']') {
+		return false // error
+	}
+
+	p.ev.SetLevel(i)
+	return true
+}
+
 // Selector ::= '{' expression? '}'
 func (p *parser) Selector() bool {
 
@@ -957,6 +1173,58 @@ func (p *parser) Template() {
 	}
 }
 
+// Compact parses the single line form produced by Graph.Compact1.
+//
+//     Compact ::= Item? (',' Item?)*
+//     Item ::= Scalar (Space Scalar)* (Space? '{' Compact '}')?
+//
+// Consecutive scalars are nested, as in OGDL text, and the items within
+// braces are subnodes of the last scalar before them.
+func (p *parser) Compact() bool {
+
+	i := p.ev.Level()
+
+	for {
+		p.WhiteSpace()
+		p.CompactItem()
+		p.WhiteSpace()
+
+		if !p.nextByteIs(',') {
+			return true
+		}
+		p.ev.SetLevel(i)
+	}
+}
+
+// CompactItem ::= Scalar (Space Scalar)* (Space? '{' Compact '}')?
+func (p *parser) CompactItem() bool {
+
+	n := 0
+
+	for {
+		p.Space()
+
+		if n > 0 && p.nextByteIs('{') {
+			p.Compact()
+			return p.nextByteIs('}')
+		}
+
+		c := p.Read()
+		p.Unread()
+		if c == '{' || c == '}' {
+			return n > 0
+		}
+
+		s, ok := p.Scalar()
+		if !ok {
+			return n > 0
+		}
+		p.ev.Add(s)
+		p.ev.Inc()
+		n++
+	}
+}
+
 // TokenList ::= token [, token]*
 func (p *parser) TokenList() {
 
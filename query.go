@@ -0,0 +1,127 @@
+// Copyright 2012-2017, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import "strconv"
+
+// Query returns all the nodes that match the query given. A query is a path,
+// as given to Get, where each element is applied to all the nodes matched so
+// far, not only to the first one:
+//
+//    name    the subnodes with that name
+//    *       all subnodes
+//    [N]     the Nth subnode, and also [N,M,...] and [N:M], as in Get
+//    {N}     the Nth occurrence of the preceding name, within each parent
+//    [?expr] the nodes for which the expression is true, evaluated with the
+//            node as context
+//
+// For example, given:
+//
+//    items
+//      item
+//        name a
+//        price 10
+//      item
+//        name b
+//        price 20
+//
+// items.*[?price > 15].name returns the node 'name b', and items.item{0} the
+// first item. Query returns nil if nothing matches or the query has elements
+// that do not select nodes, as a trailing # or a function call.
+func (g *Graph) Query(q string) []*Graph {
+	if g == nil {
+		return nil
+	}
+
+	path := NewPath(q)
+	if path == nil {
+		return nil
+	}
+
+	// Nodes are kept grouped by parent, for {N}.
+	groups := [][]*Graph{{g}}
+
+	for _, elem := range path.Out {
+		var next [][]*Graph
+
+		switch s := elem.ThisString(); s {
+		case TypeNullSafe:
+			continue
+
+		case TypeCount, TypeGroup, TypeExpression, "_len":
+			return nil
+
+		case TypeIndex, TypeSlice:
+			// Resolved by Get, for each node
+			step := New(TypePath)
+			step.Out = []*Graph{elem}
+			for _, group := range groups {
+				for _, n := range group {
+					nn := n.get(step)
+					if nn == nil {
+						continue
+					}
+					if nn.This == nil {
+						next = append(next, nn.Out)
+					} else {
+						next = append(next, []*Graph{nn})
+					}
+				}
+			}
+
+		case TypeSelector:
+			i := -1
+			if elem.Len() != 0 {
+				var err error
+				i, err = strconv.Atoi(elem.Out[0].ThisString())
+				if err != nil || i < 0 {
+					return nil
+				}
+			}
+			for _, group := range groups {
+				if i < 0 {
+					next = append(next, group)
+				} else if i < len(group) {
+					next = append(next, []*Graph{group[i]})
+				}
+			}
+
+		case TypeFilter:
+			e := filterExpression(elem)
+			for _, group := range groups {
+				var r []*Graph
+				for _, n := range group {
+					if b, _ := _boolf(n.evalFilter(e)); b {
+						r = append(r, n)
+					}
+				}
+				next = append(next, r)
+			}
+
+		default:
+			// A token, or all subnodes
+			all := s == TypeWildcard
+			for _, group := range groups {
+				for _, n := range group {
+					var r []*Graph
+					for _, nn := range n.Out {
+						if nn != nil && (all || _string(nn.This) == s) {
+							r = append(r, nn)
+						}
+					}
+					next = append(next, r)
+				}
+			}
+		}
+
+		groups = next
+	}
+
+	var r []*Graph
+	for _, group := range groups {
+		r = append(r, group...)
+	}
+	return r
+}
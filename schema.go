@@ -4,6 +4,8 @@
 
 package ogdl
 
+import "errors"
+
 // Check returns true if the Graph given as a parameter conforms to the
 // schema represented by the receiver Graph.
 func (g *Graph) Check(x *Graph) (bool, string) {
@@ -69,3 +71,105 @@ func (g *Graph) checkNode(x *Graph) bool {
 
 	return false
 }
+
+// Validate checks the receiver graph against a schema, and returns an error
+// for each difference found, or nil if there are none. The schema is an OGDL
+// document that lists the keys that must be present, and the type of their
+// value:
+//
+//    name string
+//    server
+//      host string
+//      port int
+//
+// A key with only a type below it, one of string, int, float, bool and
+// binary (optionally preceded by '!', as in Check), must have a single value
+// that converts to that type. Any value converts to a string. A key with
+// other keys below it must have them too, and they are checked in the same
+// way, and a key without anything below it only needs to be present. Keys
+// not in the schema are allowed. The errors start with the path of the node
+// concerned.
+func (g *Graph) Validate(schema *Graph) []error {
+	var errs []error
+	g.validate(schema, "", &errs)
+	return errs
+}
+
+func (g *Graph) validate(schema *Graph, path string, errs *[]error) {
+
+	if schema == nil {
+		return
+	}
+
+	for _, s := range schema.Out {
+		if s == nil {
+			continue
+		}
+
+		key := s.ThisString()
+		p := pathQuote(key)
+		if len(path) != 0 {
+			p = path + "." + p
+		}
+
+		n := g.Node(key)
+		if n == nil {
+			*errs = append(*errs, errors.New(p+": missing"))
+			continue
+		}
+
+		typ, ok := schemaType(s)
+		if !ok {
+			n.validate(s, p, errs)
+			continue
+		}
+
+		if n.Len() != 1 || n.Out[0].Len() != 0 {
+			*errs = append(*errs, errors.New(p+": want a single "+typ+" value"))
+			continue
+		}
+
+		if v := n.Out[0].This; !isType(typ, v) {
+			*errs = append(*errs, errors.New(p+": want "+typ+", got "+quote(_string(v))))
+		}
+	}
+}
+
+// schemaType returns the type that a schema node gives to its value, if it
+// has one.
+func schemaType(s *Graph) (string, bool) {
+	if s.Len() != 1 || s.Out[0].Len() != 0 {
+		return "", false
+	}
+
+	typ := s.Out[0].ThisString()
+	if len(typ) != 0 && typ[0] == '!' {
+		typ = typ[1:]
+	}
+
+	switch typ {
+	case "string", "int", "float", "bool", "binary":
+		return typ, true
+	}
+	return "", false
+}
+
+// isType returns true if v converts to the schema type given.
+func isType(typ string, v interface{}) bool {
+
+	var ok bool
+
+	switch typ {
+	case "int":
+		_, ok = _int64f(v)
+	case "float":
+		_, ok = _float64f(v)
+	case "bool":
+		_, ok = _boolf(v)
+	case "binary":
+		_, ok = v.([]byte)
+	case "string":
+		ok = v != nil
+	}
+	return ok
+}
@@ -0,0 +1,69 @@
+// Copyright 2012-2017, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import "log/slog"
+
+// LogAttrs converts the graph into a list of attributes for structured
+// logging with log/slog. Each subnode gives an attribute with the node name
+// as key:
+//
+//    user joe
+//    id 12
+//    req
+//      method GET
+//      path /
+//
+// A node with one leaf subnode gives an attribute with that value, converted
+// to int64, float64 or bool if possible (user=joe, id=12). A node with deeper
+// subnodes gives a group (req.method=GET, req.path=/). A node with several
+// leaf subnodes gives a []interface{} value, and a leaf node an attribute
+// with a nil value.
+func (g *Graph) LogAttrs() []slog.Attr {
+	if g == nil {
+		return nil
+	}
+
+	var attrs []slog.Attr
+
+	for _, n := range g.Out {
+		if n == nil {
+			continue
+		}
+		if n.This == nil {
+			attrs = append(attrs, n.LogAttrs()...)
+			continue
+		}
+
+		key := n.ThisString()
+
+		switch {
+		case n.Len() == 0:
+			attrs = append(attrs, slog.Any(key, nil))
+		case n.Len() == 1 && n.Out[0].Len() == 0:
+			attrs = append(attrs, slog.Any(key, n.Out[0].ThisScalar()))
+		case n.leaves():
+			var list []interface{}
+			for _, nn := range n.Out {
+				list = append(list, nn.ThisScalar())
+			}
+			attrs = append(attrs, slog.Any(key, list))
+		default:
+			attrs = append(attrs, slog.Attr{Key: key, Value: slog.GroupValue(n.LogAttrs()...)})
+		}
+	}
+
+	return attrs
+}
+
+// leaves returns true if all subnodes of g are leaf nodes.
+func (g *Graph) leaves() bool {
+	for _, n := range g.Out {
+		if n.Len() != 0 {
+			return false
+		}
+	}
+	return true
+}
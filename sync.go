@@ -0,0 +1,93 @@
+// Copyright 2012-2017, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import "sync"
+
+// SyncGraph is a Graph that can be used from several goroutines at once. Read
+// operations can run concurrently, while those that modify the graph run
+// alone.
+//
+// The nodes returned by Get are copies, so that they can be used after the
+// lock is released. To work directly on the underlying Graph, as when doing
+// several operations that must not be interleaved with others, use Do.
+type SyncGraph struct {
+	mu sync.RWMutex
+	g  *Graph
+}
+
+// NewSyncGraph returns a SyncGraph that guards g, or a new empty Graph if g
+// is nil. The caller should not use g directly afterwards.
+func NewSyncGraph(g *Graph) *SyncGraph {
+	if g == nil {
+		g = New()
+	}
+	return &SyncGraph{g: g}
+}
+
+// Get returns a copy of the node found at the given path, as Graph.Get, or
+// nil.
+func (s *SyncGraph) Get(path string) *Graph {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := s.g.Get(path)
+	if n == nil {
+		return nil
+	}
+	return n.Clone()
+}
+
+// Text returns the textual representation of the graph, as Graph.Text.
+func (s *SyncGraph) Text() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.g.Text()
+}
+
+// Set sets the given path to the value given, as Graph.Set.
+func (s *SyncGraph) Set(path string, val interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.g.Set(path, val)
+}
+
+// Add adds a subnode to the root of the graph, as Graph.Add.
+func (s *SyncGraph) Add(n interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.g.Add(n)
+}
+
+// Delete removes the subnodes of the root with the given content, as
+// Graph.Delete.
+func (s *SyncGraph) Delete(n interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.g.Delete(n)
+}
+
+// DeleteByPath removes the node found at the given path, as
+// Graph.DeleteByPath, and returns true if it was found.
+func (s *SyncGraph) DeleteByPath(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.g.DeleteByPath(path)
+}
+
+// Do calls fn with the underlying Graph, holding the lock for writing while
+// it runs. fn should not keep references to the graph or its nodes, nor call
+// other methods of s, which would deadlock.
+func (s *SyncGraph) Do(fn func(g *Graph)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(s.g)
+}
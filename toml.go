@@ -0,0 +1,735 @@
+// Copyright 2012-2017, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FromTOML converts a TOML document into a Graph.
+//
+// Tables and keys become named nodes, and values become leaf nodes with the
+// corresponding Go type: string, int64, float64, bool or time.Time (local
+// dates and times are given in UTC). The items of an array are added as
+// subnodes of its key, in order. Array items that are themselves arrays or
+// tables, including the tables of an array of tables ([[name]]), are added as
+// anonymous (transparent) nodes, as FromJSON does.
+//
+//    [server]
+//    host = "localhost"
+//    ports = [ 80, 443 ]
+//
+// gives:
+//
+//    server
+//      host localhost
+//      ports
+//        80
+//        443
+func FromTOML(b []byte) (*Graph, error) {
+	p := &tomlParser{s: string(b), line: 1}
+	g := New()
+	if err := p.parse(g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// TOML converts the Graph into a TOML document, the inverse of FromTOML.
+//
+// A node with one leaf subnode gives a key with a value, and a node with
+// several leaf subnodes an array. A node whose subnodes are all anonymous
+// tables gives an array of tables, and any other node with subnodes a table.
+// Values are written according to their Go type, so that strings are always
+// TOML strings, even if they look like numbers: use Normalize on the values
+// of a graph read from OGDL text to get numbers and booleans. A leaf node
+// without a value, except as an array item, cannot be represented and
+// returns an error.
+func (g *Graph) TOML() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if g == nil {
+		return buf.Bytes(), nil
+	}
+	err := g.tomlTable(buf, "")
+	return buf.Bytes(), err
+}
+
+// ---- Emitter ----
+
+// tomlTable writes the keys of g, and then its subtables.
+func (g *Graph) tomlTable(buf *bytes.Buffer, path string) error {
+
+	nodes := tomlNodes(g)
+
+	for _, n := range nodes {
+		k, err := tomlKind(n)
+		if err != nil {
+			return err
+		}
+		switch k {
+		case 'v':
+			buf.WriteString(tomlKey(n.ThisString()) + " = " + tomlValue(n.Out[0].This) + "\n")
+		case 'a':
+			v, err := tomlArray(n)
+			if err != nil {
+				return err
+			}
+			buf.WriteString(tomlKey(n.ThisString()) + " = " + v + "\n")
+		}
+	}
+
+	for _, n := range nodes {
+		k, _ := tomlKind(n)
+		p := tomlKey(n.ThisString())
+		if len(path) != 0 {
+			p = path + "." + p
+		}
+
+		switch k {
+		case 't':
+			buf.WriteString("\n[" + p + "]\n")
+			if err := n.tomlTable(buf, p); err != nil {
+				return err
+			}
+		case 'T':
+			for _, nn := range n.Out {
+				buf.WriteString("\n[[" + p + "]]\n")
+				if err := nn.tomlTable(buf, p); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// tomlNodes returns the subnodes of g, replacing anonymous nodes by their
+// subnodes.
+func tomlNodes(g *Graph) []*Graph {
+	var r []*Graph
+	for _, n := range g.Out {
+		if n == nil {
+			continue
+		}
+		if n.This == nil {
+			r = append(r, tomlNodes(n)...)
+			continue
+		}
+		r = append(r, n)
+	}
+	return r
+}
+
+// tomlKind tells how a named node is written: as a key with a value ('v'),
+// a key with an array ('a'), a table ('t') or an array of tables ('T').
+func tomlKind(n *Graph) (int, error) {
+
+	if n.Len() == 0 {
+		return 0, errors.New("ogdl: TOML: key without value: " + n.ThisString())
+	}
+
+	if n.Len() == 1 && n.Out[0].Len() == 0 && n.Out[0].This != nil {
+		return 'v', nil
+	}
+
+	leaves, anon, tables := true, true, true
+	for _, nn := range n.Out {
+		if nn.Len() != 0 {
+			leaves = false
+		}
+		if nn.This != nil {
+			anon = false
+		} else if nn.leaves() {
+			tables = false
+		}
+	}
+
+	switch {
+	case leaves:
+		return 'a', nil
+	case anon && tables:
+		return 'T', nil
+	case anon:
+		return 'a', nil
+	}
+	return 't', nil
+}
+
+// tomlArray returns the subnodes of n as an inline array.
+func tomlArray(n *Graph) (string, error) {
+	var items []string
+	for _, nn := range n.Out {
+		v := ""
+		var err error
+		switch {
+		case nn.This != nil:
+			v = tomlValue(nn.This)
+		case nn.leaves():
+			v, err = tomlArray(nn)
+		default:
+			v, err = tomlInline(nn)
+		}
+		if err != nil {
+			return "", err
+		}
+		items = append(items, v)
+	}
+	return "[ " + strings.Join(items, ", ") + " ]", nil
+}
+
+// tomlInline returns the subnodes of n as an inline table.
+func tomlInline(n *Graph) (string, error) {
+	var items []string
+	for _, nn := range tomlNodes(n) {
+		k, err := tomlKind(nn)
+		if err != nil {
+			return "", err
+		}
+		v := ""
+		switch k {
+		case 'v':
+			v = tomlValue(nn.Out[0].This)
+		case 'a', 'T':
+			v, err = tomlArray(nn)
+		default:
+			v, err = tomlInline(nn)
+		}
+		if err != nil {
+			return "", err
+		}
+		items = append(items, tomlKey(nn.ThisString())+" = "+v)
+	}
+	return "{ " + strings.Join(items, ", ") + " }", nil
+}
+
+// tomlKey returns the key given, quoted if it is not a bare key.
+func tomlKey(s string) string {
+	if len(s) == 0 {
+		return `""`
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '_' && c != '-' {
+			return tomlQuote(s)
+		}
+	}
+	return s
+}
+
+// tomlValue returns a scalar value in TOML syntax.
+func tomlValue(v interface{}) string {
+
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		switch {
+		case math.IsInf(v, 1):
+			return "inf"
+		case math.IsInf(v, -1):
+			return "-inf"
+		case math.IsNaN(v):
+			return "nan"
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEn") {
+			s += ".0"
+		}
+		return s
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+
+	return tomlQuote(_string(v))
+}
+
+// tomlQuote returns s as a TOML basic string.
+func tomlQuote(s string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 32 || r == 127 {
+				buf.WriteString(`\u00` + strconv.FormatInt(int64(r)>>4, 16) + strconv.FormatInt(int64(r)&15, 16))
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// ---- Parser ----
+
+type tomlParser struct {
+	s    string
+	i    int
+	line int
+}
+
+func (p *tomlParser) error(msg string) error {
+	return errors.New("ogdl: TOML: line " + strconv.Itoa(p.line) + ": " + msg)
+}
+
+func (p *tomlParser) parse(root *Graph) error {
+
+	current := root
+
+	for {
+		p.skip(true)
+		if p.i >= len(p.s) {
+			return nil
+		}
+
+		if p.s[p.i] == '[' {
+			array := strings.HasPrefix(p.s[p.i:], "[[")
+			if array {
+				p.i += 2
+			} else {
+				p.i++
+			}
+
+			keys, err := p.key()
+			if err != nil {
+				return err
+			}
+
+			p.space()
+			end := "]"
+			if array {
+				end = "]]"
+			}
+			if !strings.HasPrefix(p.s[p.i:], end) {
+				return p.error("expected " + end)
+			}
+			p.i += len(end)
+
+			if array {
+				// A new table in the array
+				t := tomlPath(root, keys[:len(keys)-1])
+				n := t.Node(keys[len(keys)-1])
+				if n == nil {
+					n = t.Add(keys[len(keys)-1])
+				}
+				current = n.Add(New())
+			} else {
+				current = tomlPath(root, keys)
+			}
+		} else {
+			keys, err := p.key()
+			if err != nil {
+				return err
+			}
+			p.space()
+			if p.i >= len(p.s) || p.s[p.i] != '=' {
+				return p.error("expected =")
+			}
+			p.i++
+			p.space()
+
+			v, err := p.value()
+			if err != nil {
+				return err
+			}
+
+			n := tomlPath(current, keys[:len(keys)-1]).Add(keys[len(keys)-1])
+			tomlAdd(n, v)
+		}
+
+		// Only a comment may follow, up to the end of line
+		p.space()
+		if p.i < len(p.s) && p.s[p.i] == '#' {
+			p.skip(false)
+		}
+		if p.i < len(p.s) && p.s[p.i] != '\n' && p.s[p.i] != '\r' {
+			return p.error("unexpected character " + strconv.QuoteRune(rune(p.s[p.i])))
+		}
+	}
+}
+
+// tomlPath returns the node at the given path of keys, creating it if it
+// does not exist. A key that holds an array of tables refers to the last
+// table in it.
+func tomlPath(g *Graph, keys []string) *Graph {
+	for _, k := range keys {
+		n := g.Node(k)
+		if n == nil {
+			n = g.Add(k)
+		}
+		if n.Len() != 0 && n.Out[n.Len()-1].This == nil {
+			n = n.Out[n.Len()-1]
+		}
+		g = n
+	}
+	return g
+}
+
+// tomlAdd adds a value to a node: arrays and inline tables (given as *Graph)
+// add their items.
+func tomlAdd(n *Graph, v interface{}) {
+	if g, ok := v.(*Graph); ok {
+		n.AddNodes(g)
+		return
+	}
+	n.Add(v)
+}
+
+// space skips spaces and tabs.
+func (p *tomlParser) space() {
+	for p.i < len(p.s) && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+// skip skips white space and comments, and also newlines if nl is set.
+func (p *tomlParser) skip(nl bool) {
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+		case c == '\n' && nl:
+			p.line++
+		case c == '#':
+			for p.i < len(p.s) && p.s[p.i] != '\n' {
+				p.i++
+			}
+			continue
+		default:
+			return
+		}
+		p.i++
+	}
+}
+
+// key parses a (possibly dotted) key.
+func (p *tomlParser) key() ([]string, error) {
+
+	var keys []string
+
+	for {
+		p.space()
+		if p.i >= len(p.s) {
+			return nil, p.error("expected a key")
+		}
+
+		var k string
+		var err error
+
+		switch p.s[p.i] {
+		case '"':
+			k, err = p.basicString()
+		case '\'':
+			k, err = p.literalString()
+		default:
+			j := p.i
+			for p.i < len(p.s) && (isLetter(int(p.s[p.i])) || isDigit(int(p.s[p.i])) || p.s[p.i] == '-') {
+				p.i++
+			}
+			if j == p.i {
+				return nil, p.error("expected a key")
+			}
+			k = p.s[j:p.i]
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+
+		p.space()
+		if p.i >= len(p.s) || p.s[p.i] != '.' {
+			return keys, nil
+		}
+		p.i++
+	}
+}
+
+// value parses a value: a scalar, or a *Graph for arrays and inline tables.
+func (p *tomlParser) value() (interface{}, error) {
+
+	if p.i >= len(p.s) {
+		return nil, p.error("expected a value")
+	}
+
+	switch p.s[p.i] {
+	case '"':
+		return p.basicString()
+	case '\'':
+		return p.literalString()
+	case '[':
+		return p.array()
+	case '{':
+		return p.inlineTable()
+	}
+
+	j := p.i
+	for p.i < len(p.s) && !strings.ContainsRune(" \t\r\n,]}#", rune(p.s[p.i])) {
+		p.i++
+	}
+
+	// Date and time separated by a space
+	if p.i-j == 10 && p.i+3 < len(p.s) && p.s[p.i] == ' ' && isDigit(int(p.s[p.i+1])) && p.s[p.i+3] == ':' {
+		p.i++
+		for p.i < len(p.s) && !strings.ContainsRune(" \t\r\n,]}#", rune(p.s[p.i])) {
+			p.i++
+		}
+	}
+
+	s := p.s[j:p.i]
+
+	switch s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+
+	if !tomlLeadingZero(s) {
+		if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, nil
+		}
+	}
+
+	s = strings.Replace(s, " ", "T", 1)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02", "15:04:05.999999999"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return nil, p.error("invalid value " + strconv.Quote(s))
+}
+
+// tomlLeadingZero returns true if s is a decimal number with a leading zero,
+// as 017 or -01.5, which TOML does not allow (and which would otherwise be
+// read as octal).
+func tomlLeadingZero(s string) bool {
+	if len(s) != 0 && (s[0] == '+' || s[0] == '-') {
+		s = s[1:]
+	}
+	return len(s) > 1 && s[0] == '0' && (isDigit(int(s[1])) || s[1] == '_')
+}
+
+// array parses [ v, ... ]. Arrays and tables within it are added as
+// anonymous nodes.
+func (p *tomlParser) array() (interface{}, error) {
+
+	p.i++ // [
+	g := New()
+
+	for {
+		p.skip(true)
+		if p.i >= len(p.s) {
+			return nil, p.error("unterminated array")
+		}
+		if p.s[p.i] == ']' {
+			p.i++
+			return g, nil
+		}
+
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := v.(*Graph); ok {
+			g.Add(n)
+		} else {
+			g.Add(v)
+		}
+
+		p.skip(true)
+		if p.i < len(p.s) && p.s[p.i] == ',' {
+			p.i++
+		}
+	}
+}
+
+// inlineTable parses { k = v, ... }.
+func (p *tomlParser) inlineTable() (interface{}, error) {
+
+	p.i++ // {
+	g := New()
+
+	for {
+		p.space()
+		if p.i >= len(p.s) {
+			return nil, p.error("unterminated inline table")
+		}
+		if p.s[p.i] == '}' {
+			p.i++
+			return g, nil
+		}
+
+		keys, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		p.space()
+		if p.i >= len(p.s) || p.s[p.i] != '=' {
+			return nil, p.error("expected =")
+		}
+		p.i++
+		p.space()
+
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		tomlAdd(tomlPath(g, keys[:len(keys)-1]).Add(keys[len(keys)-1]), v)
+
+		p.space()
+		if p.i < len(p.s) && p.s[p.i] == ',' {
+			p.i++
+		}
+	}
+}
+
+// basicString parses "..." and """...""", with escapes.
+func (p *tomlParser) basicString() (string, error) {
+
+	multi := strings.HasPrefix(p.s[p.i:], `"""`)
+	if multi {
+		p.i += 3
+		p.newline()
+	} else {
+		p.i++
+	}
+
+	buf := &bytes.Buffer{}
+
+	for {
+		if p.i >= len(p.s) {
+			return "", p.error("unterminated string")
+		}
+
+		c := p.s[p.i]
+
+		switch {
+		case multi && strings.HasPrefix(p.s[p.i:], `"""`):
+			p.i += 3
+			return buf.String(), nil
+		case !multi && c == '"':
+			p.i++
+			return buf.String(), nil
+		case !multi && c == '\n':
+			return "", p.error("newline in string")
+		case c == '\\':
+			p.i++
+			if p.i >= len(p.s) {
+				return "", p.error("unterminated string")
+			}
+			e := p.s[p.i]
+			p.i++
+			switch e {
+			case 'b':
+				buf.WriteByte('\b')
+			case 't':
+				buf.WriteByte('\t')
+			case 'n':
+				buf.WriteByte('\n')
+			case 'f':
+				buf.WriteByte('\f')
+			case 'r':
+				buf.WriteByte('\r')
+			case '"', '\\':
+				buf.WriteByte(e)
+			case 'u', 'U':
+				n := 4
+				if e == 'U' {
+					n = 8
+				}
+				if p.i+n > len(p.s) {
+					return "", p.error("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(p.s[p.i:p.i+n], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", p.error("invalid unicode escape")
+				}
+				buf.WriteRune(rune(r))
+				p.i += n
+			default:
+				if !multi || !strings.ContainsRune(" \t\r\n", rune(e)) {
+					return "", p.error("invalid escape")
+				}
+				// Line ending backslash: trim the white space and newlines
+				// that follow
+				p.i--
+				for p.i < len(p.s) && strings.ContainsRune(" \t\r\n", rune(p.s[p.i])) {
+					if p.s[p.i] == '\n' {
+						p.line++
+					}
+					p.i++
+				}
+			}
+		default:
+			if c == '\n' {
+				p.line++
+			}
+			buf.WriteByte(c)
+			p.i++
+		}
+	}
+}
+
+// literalString parses '...' and '''...''', without escapes.
+func (p *tomlParser) literalString() (string, error) {
+
+	end := "'"
+	if strings.HasPrefix(p.s[p.i:], "'''") {
+		end = "'''"
+		p.i += 3
+		p.newline()
+	} else {
+		p.i++
+	}
+
+	j := strings.Index(p.s[p.i:], end)
+	if j < 0 {
+		return "", p.error("unterminated string")
+	}
+
+	s := p.s[p.i : p.i+j]
+	if end == "'" && strings.ContainsRune(s, '\n') {
+		return "", p.error("newline in string")
+	}
+	p.line += strings.Count(s, "\n")
+	p.i += j + len(end)
+
+	return s, nil
+}
+
+// newline skips a newline right after the opening of a multiline string.
+func (p *tomlParser) newline() {
+	if strings.HasPrefix(p.s[p.i:], "\r\n") {
+		p.i += 2
+		p.line++
+	} else if strings.HasPrefix(p.s[p.i:], "\n") {
+		p.i++
+		p.line++
+	}
+}